@@ -1,7 +1,9 @@
 package common
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -52,3 +54,139 @@ func SplitMapsFileEntry(entry string) []string {
 	res = append(res, strings.TrimLeft(entry, " "))
 	return res
 }
+
+// MapsEntry is the parsed representation of a single line of /proc/PID/maps.
+type MapsEntry struct {
+	Start uintptr
+	End   uintptr
+
+	Readable   bool
+	Writable   bool
+	Executable bool
+	// Shared is true for shared mappings ('s') and false for private, copy-on-write, ones ('p').
+	Shared bool
+
+	Offset   uint64
+	DevMajor uint32
+	DevMinor uint32
+	Inode    uint64
+
+	// Pathname is the file or pseudo-path backing the mapping, without the " (deleted)" suffix. It is empty for
+	// anonymous mappings.
+	Pathname string
+	// Deleted is true if the kernel marked the backing file as deleted.
+	Deleted bool
+	// Pseudo is true for kernel pseudo-paths like [heap], [stack], [vdso] or [anon:name].
+	Pseudo bool
+}
+
+// DeletedSuffix is appended by the kernel to the paths of the files deleted after they were mapped.
+const DeletedSuffix = " (deleted)"
+
+// Size returns the size in bytes of the mapping.
+func (e MapsEntry) Size() uint {
+	return uint(e.End - e.Start)
+}
+
+// MapsPathname returns the path as shown in the maps file, with the DeletedSuffix if the file was deleted.
+func (e MapsEntry) MapsPathname() string {
+	if e.Deleted {
+		return e.Pathname + DeletedSuffix
+	}
+	return e.Pathname
+}
+
+// Private returns true if the mapping is private (copy-on-write).
+func (e MapsEntry) Private() bool {
+	return !e.Shared
+}
+
+// Anonymous returns true if the mapping isn't backed by a file. This includes named anonymous mappings
+// ([anon:name]) but not other pseudo-paths like [heap] or [stack].
+func (e MapsEntry) Anonymous() bool {
+	return e.Pathname == "" || strings.HasPrefix(e.Pathname, "[anon:")
+}
+
+// ParseMapsFileEntry parses a line of a /proc/PID/maps file. If it can't be parsed, the error is a *MapsParseError.
+func ParseMapsFileEntry(line string) (entry MapsEntry, err error) {
+	items := SplitMapsFileEntry(line)
+	if len(items) != 6 {
+		return entry, &MapsParseError{Line: line}
+	}
+
+	entry.Start, entry.End, err = ParseMapsFileMemoryLimits(items[0])
+	if err != nil {
+		return entry, &MapsParseError{Line: line, Field: "memory limits", Err: err}
+	}
+
+	perms := items[1]
+	if len(perms) != 4 {
+		return entry, &MapsParseError{Line: line, Field: "permissions"}
+	}
+	entry.Readable = perms[0] == 'r'
+	entry.Writable = perms[1] == 'w'
+	entry.Executable = perms[2] == 'x'
+	entry.Shared = perms[3] == 's'
+
+	entry.Offset, err = strconv.ParseUint(items[2], 16, 64)
+	if err != nil {
+		return entry, &MapsParseError{Line: line, Field: "offset", Err: err}
+	}
+
+	entry.DevMajor, entry.DevMinor, err = parseMapsFileDevice(items[3])
+	if err != nil {
+		return entry, &MapsParseError{Line: line, Field: "device", Err: err}
+	}
+
+	entry.Inode, err = strconv.ParseUint(items[4], 10, 64)
+	if err != nil {
+		return entry, &MapsParseError{Line: line, Field: "inode", Err: err}
+	}
+
+	path := items[5]
+	if strings.HasSuffix(path, DeletedSuffix) {
+		path = path[:len(path)-len(DeletedSuffix)]
+		entry.Deleted = true
+	}
+	entry.Pathname = path
+	entry.Pseudo = len(path) > 1 && path[0] == '[' && path[len(path)-1] == ']'
+
+	return entry, nil
+}
+
+// ParseMapsFile parses all the entries of a /proc/PID/maps file. If a line can't be parsed, the error is a
+// *MapsParseError with its Number set.
+func ParseMapsFile(r io.Reader) (entries []MapsEntry, err error) {
+	entries = make([]MapsEntry, 0, 64)
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		entry, err := ParseMapsFileEntry(scanner.Text())
+		if err != nil {
+			err.(*MapsParseError).Number = number
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseMapsFileDevice parses a device as found in /proc/PID/maps, with the form major:minor in hexa.
+func parseMapsFileDevice(dev string) (major uint32, minor uint32, err error) {
+	fields := strings.Split(dev, ":")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Invalid device, it must have two hexa numbers separeted by a single :")
+	}
+
+	major64, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	minor64, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint32(major64), uint32(minor64), nil
+}
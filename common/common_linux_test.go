@@ -1,6 +1,8 @@
 package common
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -75,6 +77,77 @@ func TestParseMapsFileMemoryLimits(t *testing.T) {
 
 }
 
+func TestParseMapsFileEntry(t *testing.T) {
+	var entries = []string{
+		"7fb8faf65000-7fb8faf66000 rw-p 00023000 08:01 922969                     /lib/x86_64-linux-gnu/ld-2.19.so",
+		"7fb8faf65000-7fb8faf66000 r-xs 00000000 fd:1a 131                        /dev/shm/with spaces (deleted)",
+		"7fb8faf66000-7fb8faf67000 rw-p 00000000 00:00 0",
+		"7fff231a6000-7fff231c7000 rw-p 00000000 00:00 0                          [stack]",
+		"7fff231a6000-7fff231c7000 rw-p 00000000 00:00 0                          [anon:libc_malloc]",
+	}
+
+	var results = []MapsEntry{
+		MapsEntry{Start: 0x7fb8faf65000, End: 0x7fb8faf66000, Readable: true, Writable: true, Offset: 0x23000,
+			DevMajor: 8, DevMinor: 1, Inode: 922969, Pathname: "/lib/x86_64-linux-gnu/ld-2.19.so"},
+		MapsEntry{Start: 0x7fb8faf65000, End: 0x7fb8faf66000, Readable: true, Executable: true, Shared: true,
+			DevMajor: 0xfd, DevMinor: 0x1a, Inode: 131, Pathname: "/dev/shm/with spaces", Deleted: true},
+		MapsEntry{Start: 0x7fb8faf66000, End: 0x7fb8faf67000, Readable: true, Writable: true},
+		MapsEntry{Start: 0x7fff231a6000, End: 0x7fff231c7000, Readable: true, Writable: true, Pathname: "[stack]",
+			Pseudo: true},
+		MapsEntry{Start: 0x7fff231a6000, End: 0x7fff231c7000, Readable: true, Writable: true,
+			Pathname: "[anon:libc_malloc]", Pseudo: true},
+	}
+
+	var anonymous = []bool{false, false, true, false, true}
+
+	for i, line := range entries {
+		entry, err := ParseMapsFileEntry(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entry != results[i] {
+			t.Error("Error parsing map entry", line, " - Expected:", results[i], " - Got: ", entry)
+		}
+
+		if entry.Anonymous() != anonymous[i] {
+			t.Error("Wrong Anonymous() for map entry", line)
+		}
+
+		// The maps path keeps the " (deleted)" suffix.
+		if fields := SplitMapsFileEntry(line); entry.MapsPathname() != fields[len(fields)-1] {
+			t.Errorf("Expected maps path %q and got %q", fields[len(fields)-1], entry.MapsPathname())
+		}
+	}
+
+	var invalidEntries = []string{
+		"",
+		"7fb8faf65000-7fb8faf66000 rw-p",
+		"7fb8faf65000-7fb8faf66000 rw 00023000 08:01 922969",
+		"7fb8faf65000-7fb8faf66000 rw-p 0002300z 08:01 922969",
+		"7fb8faf65000-7fb8faf66000 rw-p 00023000 0801 922969",
+		"7fb8faf65000-7fb8faf66000 rw-p 00023000 08:01 -1",
+	}
+
+	for _, line := range invalidEntries {
+		_, err := ParseMapsFileEntry(line)
+		if err == nil {
+			t.Error("an error should have been returned when parsing ", line)
+		}
+
+		var parseErr *MapsParseError
+		if !errors.As(err, &parseErr) || parseErr.Line != line {
+			t.Errorf("Parsing %q returned %v, expected a MapsParseError", line, err)
+		}
+	}
+
+	_, err := ParseMapsFile(strings.NewReader(entries[0] + "\n" + entries[1] + "\n" + invalidEntries[3] + "\n"))
+	var parseErr *MapsParseError
+	if !errors.As(err, &parseErr) || parseErr.Number != 3 || parseErr.Field != "offset" {
+		t.Errorf("Expected an invalid offset in the line 3, and got %v", err)
+	}
+}
+
 func compareStringSlices(a []string, b []string) bool {
 	if len(a) != len(b) {
 		return false
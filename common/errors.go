@@ -0,0 +1,176 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Errors that tell why accessing a process failed. The errors returned by masche wrap them when the cause is known,
+// so they can be checked with errors.Is, and also wrap the underlying syscall errors.
+var (
+	// ErrPermissionDenied means that we are not allowed to access the process or its memory.
+	ErrPermissionDenied = errors.New("Permission denied")
+
+	// ErrProcessExited means that the process doesn't exist anymore.
+	ErrProcessExited = errors.New("The process exited")
+
+	// ErrUnmapped means that the memory accessed is not mapped, or not mapped with the needed access.
+	ErrUnmapped = errors.New("The memory is not mapped")
+
+	// ErrShortRead means that only part of the memory could be read. The error is a *ShortReadError.
+	ErrShortRead = errors.New("Could not read the entire buffer")
+
+	// ErrShortWrite means that only part of the memory could be written. The error is a *ShortWriteError.
+	ErrShortWrite = errors.New("Could not write the entire buffer")
+)
+
+// causeOf returns the error among ErrPermissionDenied, ErrProcessExited and ErrUnmapped that err wraps or that
+// corresponds to the syscall error wrapped by err, or nil if there is none. Files under /proc/<pid> don't exist once
+// the process exits, so a missing file means ErrProcessExited too.
+func causeOf(err error) error {
+	for _, cause := range []error{ErrPermissionDenied, ErrProcessExited, ErrUnmapped} {
+		if errors.Is(err, cause) {
+			return cause
+		}
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return nil
+	}
+
+	switch errno {
+	case syscall.EPERM, syscall.EACCES:
+		return ErrPermissionDenied
+	case syscall.ESRCH, syscall.ENOENT:
+		return ErrProcessExited
+	case syscall.EFAULT, syscall.EIO:
+		return ErrUnmapped
+	}
+	return nil
+}
+
+// ProcessError is an error accessing the process Pid. Err is the underlying error, and errors.Is reports if it was
+// caused by ErrPermissionDenied or ErrProcessExited.
+type ProcessError struct {
+	Pid int
+	// Op describes what was being done, like "open the maps file".
+	Op  string
+	Err error
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("Unable to %s of process %d (%v)", e.Op, e.Pid, e.Err)
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ProcessError) Is(target error) bool {
+	return target != nil && causeOf(e.Err) == target
+}
+
+// MemoryError is an error reading or writing Length bytes starting at Address of the process Pid. Err is the
+// underlying error, and errors.Is reports if it was caused by ErrPermissionDenied, ErrProcessExited or ErrUnmapped.
+type MemoryError struct {
+	Pid     int
+	Write   bool
+	Address uintptr
+	Length  int
+	Err     error
+}
+
+func (e *MemoryError) Error() string {
+	op := "reading"
+	if e.Write {
+		op = "writing"
+	}
+	return fmt.Sprintf("Error while %s %d bytes starting at %x of process %d: %v", op, e.Length, e.Address, e.Pid,
+		e.Err)
+}
+
+func (e *MemoryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MemoryError) Is(target error) bool {
+	return target != nil && causeOf(e.Err) == target
+}
+
+// ShortReadError is the error returned when only Read bytes of the Length bytes starting at Address could be read.
+// It matches ErrShortRead with errors.Is, and also ErrPermissionDenied, ErrProcessExited or ErrUnmapped if Err was
+// caused by them.
+type ShortReadError struct {
+	Address uintptr
+	Length  int
+	Read    int
+	// Err is the error that stopped the read, or nil if it isn't known.
+	Err error
+}
+
+func (e *ShortReadError) Error() string {
+	msg := fmt.Sprintf("Could not read the entire buffer: read %d of %d bytes starting at %x", e.Read, e.Length,
+		e.Address)
+	if e.Err != nil {
+		msg += fmt.Sprintf(" (%v)", e.Err)
+	}
+	return msg
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ShortReadError) Is(target error) bool {
+	return target == ErrShortRead || (target != nil && causeOf(e.Err) == target)
+}
+
+// ShortWriteError is the error returned when only Written bytes of the Length bytes starting at Address could be
+// written. It matches ErrShortWrite with errors.Is.
+type ShortWriteError struct {
+	Address uintptr
+	Length  int
+	Written int
+}
+
+func (e *ShortWriteError) Error() string {
+	return fmt.Sprintf("Could not write the entire buffer: wrote %d of %d bytes starting at %x", e.Written, e.Length,
+		e.Address)
+}
+
+func (e *ShortWriteError) Is(target error) bool {
+	return target == ErrShortWrite
+}
+
+// MapsParseError is the error returned when a line of a /proc/<pid>/maps file can't be parsed.
+type MapsParseError struct {
+	// Line is the text of the line.
+	Line string
+	// Number is the number of the line in the file, starting from 1, or 0 if it isn't known.
+	Number int
+	// Field is the field of the line that is invalid, or empty if the line couldn't be split in fields.
+	Field string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *MapsParseError) Error() string {
+	msg := "Unrecognised maps line"
+	if e.Field != "" {
+		msg = fmt.Sprintf("Invalid %s in maps line", e.Field)
+	}
+	if e.Number > 0 {
+		msg += fmt.Sprintf(" %d", e.Number)
+	}
+	msg += ": " + e.Line
+	if e.Err != nil {
+		msg += fmt.Sprintf(" (%v)", e.Err)
+	}
+	return msg
+}
+
+func (e *MapsParseError) Unwrap() error {
+	return e.Err
+}
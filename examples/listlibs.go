@@ -4,13 +4,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"regexp"
 
-	"github.com/polyverse/masche/listlibs"
-	"github.com/polyverse/masche/process"
+	"github.com/polyverse/masche/scan"
 )
 
 var rstr = flag.String("r", "", "library name regexp")
@@ -23,49 +23,33 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ps, hard, softs := process.OpenAll()
+	results, hard, softs := scan.Run(context.Background(), scan.Options{}, scan.LibrariesJob(r))
 	if hard != nil {
 		log.Fatal(hard)
 	}
-	defer process.CloseAll(ps)
 	for _, e := range softs {
 		log.Println(e)
 	}
 
-	matches, hard, softs := findProcWithLib(r, ps)
-	if hard != nil {
-		log.Fatal(hard)
-	}
-	for _, e := range softs {
-		fmt.Println(e)
-	}
-
 	fmt.Printf("Processes matching: %s\n", *rstr)
-	for p, libs := range matches {
-		n, hard, _ := p.Name()
-		if hard != nil {
-			log.Fatal(hard)
+	for _, result := range results {
+		if result.HardError != nil {
+			log.Printf("[%d] %v\n", result.Pid, result.HardError)
+			continue
 		}
-		fmt.Printf("[%d] %s\n", p.Pid(), n)
-		for _, l := range libs {
-			fmt.Printf("\t%s\n", l)
+		for _, e := range result.SoftErrors {
+			log.Printf("[%d] %v\n", result.Pid, e)
 		}
-	}
-
-}
 
-func findProcWithLib(r *regexp.Regexp, ps []process.Process) (matches map[process.Process][]string, harderror error, softerrors []error) {
-	matches = make(map[process.Process][]string)
-	softerrors = make([]error, 0)
-	for _, p := range ps {
-		libs, hard, softs := listlibs.GetMatchingLoadedLibraries(p, r)
-		if hard != nil {
-			return nil, hard, softerrors
+		libs := result.Value.([]string)
+		if len(libs) == 0 {
+			continue
 		}
-		softerrors = append(softerrors, softs...)
-		if len(libs) != 0 {
-			matches[p] = libs
+
+		fmt.Printf("[%d] %s\n", result.Pid, result.Name)
+		for _, l := range libs {
+			fmt.Printf("\t%s\n", l)
 		}
 	}
-	return matches, nil, softerrors
+
 }
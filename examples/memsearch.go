@@ -6,12 +6,10 @@
 package main
 
 import (
-	"encoding/hex"
 	"flag"
 	"io/ioutil"
 	"log"
 	"regexp"
-	"strings"
 
 	"github.com/polyverse/masche/memaccess"
 	"github.com/polyverse/masche/memsearch"
@@ -33,7 +31,8 @@ var (
 	regexpString = flag.String("regexp", "regexp?", "Regexp to search for")
 
 	// file-search action flags
-	fileneedle = flag.String("fileneedle", "example.in", "Filename that contains hex-encoded needle (spaces are ignored)")
+	fileneedle = flag.String("fileneedle", "example.in",
+		"Filename that contains a YARA-style hex string needle, like DE AD ?? EF [2-8] (90 | C3)")
 )
 
 func logErrors(harderror error, softerrors []error) {
@@ -48,7 +47,7 @@ func logErrors(harderror error, softerrors []error) {
 func main() {
 	flag.Parse()
 
-	proc, harderror, softerrors := process.OpenFromPid(uint(*pid))
+	proc, harderror, softerrors := process.OpenFromPid(*pid)
 	logErrors(harderror, softerrors)
 
 	switch *action {
@@ -60,12 +59,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		encoded := strings.Replace(strings.Replace(strings.TrimSpace(string(data)), " ", "", -1), "\n", "", -1)
-		data, err = hex.DecodeString(encoded)
+		h, err := memsearch.CompileHexString(string(data))
 		if err != nil {
 			log.Fatal(err)
 		}
-		found, address, harderror, softerrors := memsearch.FindBytesSequence(proc, uintptr(*addr), data)
+		found, address, harderror, softerrors := memsearch.FindHexStringMatch(proc, uintptr(*addr), h)
 		logErrors(harderror, softerrors)
 		if found {
 			log.Printf("Found in address: %x\n", address)
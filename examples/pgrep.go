@@ -20,26 +20,22 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ps, hard, soft := process.OpenByName(r)
-	if hard != nil {
-		log.Fatal(err)
-	}
-	if soft != nil {
-		for _, err := range soft {
-			log.Println(err)
-		}
-	}
-
-	for _, p := range ps {
+	// Only one process is open at a time, and it's closed once it's printed.
+	hard, soft := process.WalkByName(r, func(p process.Process) bool {
 		name, hard, soft := p.Name()
 		if hard != nil {
-			log.Fatal(err)
+			log.Fatal(hard)
 		}
-		if soft != nil {
-			for _, err := range soft {
-				log.Println(err)
-			}
+		for _, err := range soft {
+			log.Println(err)
 		}
 		fmt.Printf("Process: %s\nPid: %d\n\n", name, p.Pid())
+		return true
+	})
+	if hard != nil {
+		log.Fatal(hard)
+	}
+	for _, err := range soft {
+		log.Println(err)
 	}
 }
@@ -6,6 +6,83 @@ import (
 	"github.com/polyverse/masche/process"
 )
 
+// Segment is one of the memory mappings of a Library.
+type Segment struct {
+	Start uintptr
+	End   uintptr
+
+	Readable   bool
+	Writable   bool
+	Executable bool
+
+	// Offset is the offset in the file of the start of the segment.
+	Offset uint64
+}
+
+// Library describes a library, or the main executable, loaded by a process.
+type Library struct {
+	// Path is the absolute path of the library file.
+	Path string
+	// Base is the address where the start of the file is loaded, the one to subtract from an address in the library to
+	// get its address in the file.
+	Base uintptr
+	// Segments are the memory mappings of the library, sorted by address. They are only known on Linux, elsewhere
+	// there is a single segment for the whole library, without its permissions, if its size is known.
+	Segments []Segment
+
+	// DevMajor, DevMinor and Inode identify the file that was loaded, even if it was replaced later. They are 0 if
+	// they are not known.
+	DevMajor uint32
+	DevMinor uint32
+	Inode    uint64
+	// Deleted is true if the file was deleted or replaced after it was loaded.
+	Deleted bool
+
+	// MainExecutable is true for the executable of the process.
+	MainExecutable bool
+}
+
+// ListLibraries lists the libraries loaded by a process, and its main executable, with their segments. Unlike
+// ListLoadedLibraries, a path loaded from different files, if it was replaced between the loads, is listed once for
+// each file.
+func ListLibraries(p process.Process) (libraries []Library, harderror error, softerrors []error) {
+	return listLibraries(p)
+}
+
+// LibraryStatus tells if the file of a loaded Library changed on disk after it was loaded.
+type LibraryStatus struct {
+	Library
+
+	// Missing is true if there is no file at the path of the library anymore.
+	Missing bool
+	// Replaced is true if the path of the library, in the root directory of the process, refers to a different file
+	// than the one loaded, by its inode. That's what upgrades usually do, so the library is Deleted too unless the old
+	// file has another link. It's false if the Inode of the library is not known.
+	Replaced bool
+
+	// LoadedHash and CurrentHash are the SHA-256 hashes, in hexadecimal, of the file loaded and the file at the path
+	// of the library now. They are only computed if they are asked for, and empty if a file can't be read.
+	LoadedHash  string
+	CurrentHash string
+	// ContentChanged is true if both hashes are known and they differ, which also detects a file modified in place.
+	ContentChanged bool
+}
+
+// Stale returns true if the process is not running the library that is on disk now.
+func (s LibraryStatus) Stale() bool {
+	return s.Deleted || s.Missing || s.Replaced || s.ContentChanged
+}
+
+// CheckLibraries lists the libraries loaded by a process as ListLibraries, telling for each one if its file changed on
+// disk since it was loaded, like a library still running after it was upgraded. If hash is true the contents of the
+// files are compared too, reading the files loaded from /proc/<pid>/map_files, which needs the CAP_SYS_ADMIN
+// capability; the hashes that can't be computed are reported as soft errors.
+//
+// It's only supported on Linux.
+func CheckLibraries(p process.Process, hash bool) (statuses []LibraryStatus, harderror error, softerrors []error) {
+	return checkLibraries(p, hash)
+}
+
 // ListLoadedLibraries lists all the libraries (their absolute paths) loaded by a process.
 func ListLoadedLibraries(p process.Process) (libraries []string, harderror error, softerrors []error) {
 	return listLoadedLibraries(p)
@@ -28,3 +105,19 @@ func GetMatchingLoadedLibraries(p process.Process, r *regexp.Regexp) (libraries
 
 	return
 }
+
+// LoadsLibrary is a process.Filter that matches the processes which loaded a library whose path matches r.
+func LoadsLibrary(r *regexp.Regexp) process.Filter {
+	return func(c *process.Candidate) (bool, error) {
+		p, err := c.Process()
+		if err != nil {
+			return false, err
+		}
+
+		libraries, err, _ := GetMatchingLoadedLibraries(p, r)
+		if err != nil {
+			return false, err
+		}
+		return len(libraries) > 0, nil
+	}
+}
@@ -5,9 +5,11 @@ package listlibs
 import "C"
 
 import (
+	"fmt"
 	"github.com/polyverse/masche/cresponse"
 	"github.com/polyverse/masche/process"
 	"reflect"
+	"runtime"
 	"unsafe"
 )
 
@@ -55,3 +57,28 @@ func listLoadedLibraries(p process.Process) (libraries []string, harderror error
 
 	return
 }
+
+// listLibraries only knows the paths of the libraries, as listLoadedLibraries, and the executable of the process.
+func listLibraries(p process.Process) (libraries []Library, harderror error, softerrors []error) {
+	processName, harderror, softerrors := p.Name()
+	if harderror != nil {
+		return
+	}
+
+	paths, harderror, softs := listLoadedLibraries(p)
+	softerrors = append(softerrors, softs...)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	libraries = append(libraries, Library{Path: processName, MainExecutable: true})
+	for _, path := range paths {
+		libraries = append(libraries, Library{Path: path})
+	}
+
+	return libraries, nil, softerrors
+}
+
+func checkLibraries(p process.Process, hash bool) (statuses []LibraryStatus, harderror error, softerrors []error) {
+	return nil, fmt.Errorf("Checking the files of the loaded libraries is not supported on %s", runtime.GOOS), nil
+}
@@ -1,61 +1,110 @@
 package listlibs
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
 	"github.com/polyverse/masche/common"
 	"github.com/polyverse/masche/process"
-	"os"
 )
 
 func listLoadedLibraries(p process.Process) (libraries []string, harderror error, softerrors []error) {
-
-	mapsFile, harderror := os.Open(common.MapsFilePathFromPid(uint(p.Pid())))
+	libs, harderror, softerrors := listLibraries(p)
 	if harderror != nil {
-		return
+		return nil, harderror, softerrors
+	}
+
+	libraries = make([]string, 0, 10)
+	for _, lib := range libs {
+		// The paths are listed as in the maps file, so the deleted files keep their suffix.
+		path := lib.Path
+		if lib.Deleted {
+			path += common.DeletedSuffix
+		}
+		if lib.MainExecutable || inSlice(path, libraries) {
+			continue
+		}
+
+		libraries = append(libraries, path)
 	}
-	defer mapsFile.Close()
 
-	scanner := bufio.NewScanner(mapsFile)
+	return libraries, nil, softerrors
+}
+
+func listLibraries(p process.Process) (libraries []Library, harderror error, softerrors []error) {
 	processName, harderror, softerrors := p.Name()
 	if harderror != nil {
 		return
 	}
 
-	libs := make([]string, 0, 10)
-	for scanner.Scan() {
-		line := scanner.Text()
-		items := common.SplitMapsFileEntry(line)
+	entries, harderror := process.ReadMapsEntries(p)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
 
-		if len(items) != 6 {
-			return libs, fmt.Errorf("Unrecognised maps line: %s", line), softerrors
-		}
+	// The exe link identifies the executable even if it was deleted, when its path doesn't match the maps anymore.
+	var exe *syscall.Stat_t
+	if info, err := os.Stat(filepath.Join("/proc", strconv.Itoa(p.Pid()), "exe")); err == nil {
+		exe, _ = info.Sys().(*syscall.Stat_t)
+	}
 
-		path := items[5]
-		if path == processName {
+	// The segments of a library are the entries for the same file, which are usually contiguous.
+	index := make(map[libraryKey]int)
+	for _, entry := range entries {
+		if entry.Pathname == "" || entry.Pseudo || entry.Pathname == "/dev/zero" {
 			continue
 		}
 
-		if path == "/dev/zero" || path == "/dev/zero (deleted)" {
-			continue
+		key := libraryKey{entry.Pathname, entry.DevMajor, entry.DevMinor, entry.Inode}
+		i, ok := index[key]
+		if !ok {
+			i = len(libraries)
+			index[key] = i
+			libraries = append(libraries, Library{Path: entry.Pathname, DevMajor: entry.DevMajor,
+				DevMinor: entry.DevMinor, Inode: entry.Inode, Deleted: entry.Deleted,
+				MainExecutable: entry.Pathname == processName || isFile(entry, exe)})
 		}
 
-		if path == "" {
-			continue
-		}
+		lib := &libraries[i]
+		lib.Segments = append(lib.Segments, Segment{Start: entry.Start, End: entry.End, Readable: entry.Readable,
+			Writable: entry.Writable, Executable: entry.Executable, Offset: entry.Offset})
+		lib.Deleted = lib.Deleted || entry.Deleted
+	}
 
-		if path[0] == '[' {
-			continue
-		}
+	// The maps are sorted by address, so the first segment is the lowest one.
+	for i := range libraries {
+		first := libraries[i].Segments[0]
+		libraries[i].Base = first.Start - uintptr(first.Offset)
+	}
 
-		if inSlice(path, libs) {
-			continue
-		}
+	return libraries, nil, softerrors
+}
+
+type libraryKey struct {
+	path     string
+	devMajor uint32
+	devMinor uint32
+	inode    uint64
+}
 
-		libs = append(libs, path)
+// isFile returns true if the file mapped by the entry is the one described by stat. An inode of 0 is unknown, so it
+// never matches.
+//
+// Only the inodes are compared: on overlayfs and btrfs the maps show the device of the underlying filesystem, while
+// stat(2) returns the one of the overlay or the subvolume.
+func isFile(entry common.MapsEntry, stat *syscall.Stat_t) bool {
+	if stat == nil || entry.Inode == 0 {
+		return false
 	}
 
-	return libs, nil, nil
+	return entry.Inode == uint64(stat.Ino)
 }
 
 func inSlice(s string, slice []string) bool {
@@ -67,3 +116,122 @@ func inSlice(s string, slice []string) bool {
 
 	return false
 }
+
+func checkLibraries(p process.Process, hash bool) (statuses []LibraryStatus, harderror error, softerrors []error) {
+	libraries, harderror, softerrors := listLibraries(p)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	// Many libraries are usually loaded from the same files, so each file is only hashed once.
+	hashes := make(map[string]string)
+	hashFileOnce := func(path string) (string, error) {
+		if h, ok := hashes[path]; ok {
+			return h, nil
+		}
+		h, err := hashFile(path)
+		if err == nil {
+			hashes[path] = h
+		}
+		return h, err
+	}
+
+	// The same loaded file can be mapped with different paths, so it's identified by its device and inode.
+	loadedHashes := make(map[libraryKey]string)
+	hashLoadedOnce := func(lib Library, mapFile string) (string, error) {
+		key := libraryKey{devMajor: lib.DevMajor, devMinor: lib.DevMinor, inode: lib.Inode}
+		if h, ok := loadedHashes[key]; ok && lib.Inode != 0 {
+			return h, nil
+		}
+		h, err := hashFile(mapFile)
+		if err == nil && lib.Inode != 0 {
+			loadedHashes[key] = h
+		}
+		return h, err
+	}
+
+	// The libraries are looked up in the root directory of the process, which can be a chroot or a container.
+	procRoot := filepath.Join("/proc", strconv.Itoa(p.Pid()), "root")
+	root, err := os.Readlink(procRoot)
+	if err != nil {
+		softerrors = append(softerrors, fmt.Errorf("Unable to read the root directory of process %d (%v)", p.Pid(),
+			err))
+	}
+
+	statuses = make([]LibraryStatus, 0, len(libraries))
+	for _, lib := range libraries {
+		status := LibraryStatus{Library: lib}
+		path := lib.Path
+		if root != "" {
+			path = rootPath(procRoot, root, lib.Path)
+		}
+
+		// Without the inode of the library loaded, it can't be told whether the file was replaced.
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			status.Missing = true
+		} else if err != nil {
+			softerrors = append(softerrors, fmt.Errorf("Unable to check the library %s (%v)", lib.Path, err))
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && lib.Inode != 0 {
+			status.Replaced = !isFile(common.MapsEntry{DevMajor: lib.DevMajor, DevMinor: lib.DevMinor,
+				Inode: lib.Inode}, stat)
+		}
+
+		if hash {
+			// The map_files entries are named after the addresses of the mappings, and open the file mapped even if
+			// it was deleted.
+			first := lib.Segments[0]
+			mapFile := filepath.Join("/proc", strconv.Itoa(p.Pid()), "map_files",
+				fmt.Sprintf("%x-%x", first.Start, first.End))
+			if status.LoadedHash, err = hashLoadedOnce(lib, mapFile); err != nil {
+				softerrors = append(softerrors, fmt.Errorf("Unable to hash the loaded library %s (%v)", lib.Path,
+					err))
+			}
+			if !status.Missing {
+				if status.CurrentHash, err = hashFileOnce(path); err != nil {
+					softerrors = append(softerrors, fmt.Errorf("Unable to hash the library %s (%v)", lib.Path, err))
+				}
+			}
+			status.ContentChanged = status.LoadedHash != "" && status.CurrentHash != "" &&
+				status.LoadedHash != status.CurrentHash
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	// The files loaded could have been read from another process with the same pid.
+	if err := process.CheckIdentity(p); err != nil {
+		return nil, err, softerrors
+	}
+
+	return statuses, nil, softerrors
+}
+
+// rootPath returns the path under procRoot, the /proc/<pid>/root link of a process, of a file at path in the maps of
+// the process. The paths in the maps and root, the target of the link, are relative to our root directory if the
+// files can be reached from it, or to the root of the mount namespace of the process otherwise, as in containers. So
+// root is stripped from the path, unless the file is outside of it.
+func rootPath(procRoot, root, path string) string {
+	if root == "/" {
+		return filepath.Join(procRoot, path)
+	}
+	if strings.HasPrefix(path, root+"/") {
+		return filepath.Join(procRoot, path[len(root):])
+	}
+	return path
+}
+
+// hashFile returns the SHA-256 hash of the file at path, in hexadecimal.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,291 @@
+package listlibs
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/polyverse/masche/process"
+	"github.com/polyverse/masche/test"
+)
+
+func TestListLibraries(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	p, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	libraries, err, softerrors := ListLibraries(p)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	var main, libc *Library
+	for i, lib := range libraries {
+		if lib.MainExecutable {
+			if main != nil {
+				t.Errorf("Both %s and %s are the main executable", main.Path, lib.Path)
+			}
+			main = &libraries[i]
+		} else {
+			paths = append(paths, lib.Path)
+		}
+		if regexp.MustCompile(`/libc[-.]`).MatchString(lib.Path) {
+			libc = &libraries[i]
+		}
+
+		if lib.Inode == 0 || lib.Deleted || len(lib.Segments) == 0 {
+			t.Errorf("Unexpected library %+v", lib)
+		}
+		for j, segment := range lib.Segments {
+			if segment.Start >= segment.End || (j > 0 && segment.Start < lib.Segments[j-1].End) {
+				t.Errorf("Unexpected segments of %s: %+v", lib.Path, lib.Segments)
+			}
+		}
+		if first := lib.Segments[0]; first.Start-uintptr(first.Offset) != lib.Base {
+			t.Errorf("The first segment %+v of %s doesn't match its base %x", first, lib.Path, lib.Base)
+		}
+	}
+
+	if main == nil || main.Path != test.GetTestCasePath() {
+		t.Fatalf("The test program should be the main executable, got %+v", main)
+	}
+	if libc == nil {
+		t.Fatalf("The test program should load libc, got %v", paths)
+	}
+	executable := false
+	for _, segment := range libc.Segments {
+		executable = executable || segment.Executable
+	}
+	if !executable {
+		t.Errorf("libc should have an executable segment, got %+v", libc.Segments)
+	}
+
+	loaded, err, _ := ListLoadedLibraries(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(paths) {
+		t.Fatalf("Expected the paths %v and got %v", paths, loaded)
+	}
+	for i := range loaded {
+		if loaded[i] != paths[i] {
+			t.Errorf("Expected the paths %v and got %v", paths, loaded)
+		}
+	}
+}
+
+func TestCheckLibraries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listlibs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original, err := ioutil.ReadFile(test.GetTestCasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, original, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test program closes its stdout once it's initialized.
+	cmd := exec.Command(path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	io.Copy(ioutil.Discard, stdout)
+
+	p, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	check := func(hash bool) (main LibraryStatus) {
+		statuses, err, softerrors := CheckLibraries(p, hash)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, status := range statuses {
+			if status.MainExecutable {
+				main = status
+			} else if status.Stale() {
+				t.Errorf("The library %s should not be stale: %+v", status.Path, status)
+			}
+		}
+		if main.Path != path {
+			t.Fatalf("The copy of the test program should be the main executable, got %+v", main)
+		}
+		return main
+	}
+
+	if main := check(false); main.Stale() || main.LoadedHash != "" || main.CurrentHash != "" {
+		t.Errorf("The main executable should not be stale nor hashed: %+v", main)
+	}
+
+	// Replace the file as an upgrade does, with a new one renamed over it.
+	modified := append(append([]byte{}, original...), 0)
+	if err := ioutil.WriteFile(path+".new", modified, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	main := check(true)
+	if !main.Stale() || !main.Deleted || !main.Replaced || main.Missing {
+		t.Errorf("The main executable should be replaced: %+v", main)
+	}
+	if main.CurrentHash == "" || (main.LoadedHash != "" && !main.ContentChanged) {
+		t.Errorf("The contents of the main executable should differ: %+v", main)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if main := check(false); !main.Missing || !main.Deleted || main.Replaced {
+		t.Errorf("The main executable should be missing: %+v", main)
+	}
+}
+
+func TestCheckLibrariesInRootDirectory(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	p, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	libraries, err, softerrors := ListLibraries(p)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root directory is a tmpfs with copies of the test program at /test and of its libraries at their paths.
+	// It's only left mounted in the mount namespace of the test program, so its files can only be found through the
+	// root directory of the process, as in a container.
+	dir, err := ioutil.TempDir("", "listlibs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Unable to mount the root directory (%v)", err)
+	}
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	copyFile := func(from, to string) {
+		data, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, to)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, to), data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyFile(test.GetTestCasePath(), "/test")
+	for _, lib := range libraries {
+		if !lib.MainExecutable {
+			copyFile(lib.Path, lib.Path)
+		}
+	}
+
+	// The interpreter is usually loaded through a link to the path in the maps.
+	exe, err := elf.Open(test.GetTestCasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+	for _, prog := range exe.Progs {
+		if prog.Type == elf.PT_INTERP {
+			interp, err := ioutil.ReadAll(prog.Open())
+			if err != nil {
+				t.Fatal(err)
+			}
+			copyFile(string(bytes.TrimRight(interp, "\x00")), string(bytes.TrimRight(interp, "\x00")))
+		}
+	}
+
+	// The path isn't looked up, as /test is only in the root directory.
+	chrooted := &exec.Cmd{Path: "/test", Args: []string{"/test"},
+		SysProcAttr: &syscall.SysProcAttr{Chroot: dir, Unshareflags: syscall.CLONE_NEWNS}}
+	stdout, err := chrooted.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chrooted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer chrooted.Process.Kill()
+	io.Copy(ioutil.Discard, stdout)
+
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err, softerrors := process.OpenFromPid(chrooted.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	statuses, err, softerrors := CheckLibraries(q, true)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var main *LibraryStatus
+	for i, status := range statuses {
+		if status.MainExecutable {
+			main = &statuses[i]
+		}
+		if _, err := os.Stat(status.Path); !os.IsNotExist(err) {
+			t.Errorf("The library %s should only be in the root directory (%v)", status.Path, err)
+		}
+		if status.Stale() || status.CurrentHash == "" {
+			t.Errorf("The library %s should be checked in the root directory: %+v", status.Path, status)
+		}
+	}
+	if main == nil || filepath.Base(main.Path) != "test" {
+		t.Errorf("The copy of the test program should be the main executable, got %+v", main)
+	}
+}
@@ -3,6 +3,7 @@ package listlibs
 import (
 	"fmt"
 	"reflect"
+	"runtime"
 	"unsafe"
 
 	"github.com/polyverse/masche/process"
@@ -32,3 +33,32 @@ func listLoadedLibraries(p process.Process) (libraries []string, harderror error
 	}
 	return mods, nil, nil
 }
+
+func listLibraries(p process.Process) (libraries []Library, harderror error, softerrors []error) {
+	r := C.getModules(C.process_handle_t(p.Handle()))
+	defer C.EnumProcessModulesResponse_Free(r)
+	if r.error != 0 {
+		return nil, fmt.Errorf("getModules failed with error: %d", r.error), nil
+	}
+	libraries = make([]Library, r.length)
+	cmods := *(*[]C.ModuleInfo)(unsafe.Pointer(
+		&reflect.SliceHeader{
+			Data: uintptr(unsafe.Pointer(r.modules)),
+			Len:  int(r.length),
+			Cap:  int(r.length)}))
+	for i := range libraries {
+		// The modules of a process start with its executable, and each one is mapped as a whole.
+		base := uintptr(cmods[i].info.lpBaseOfDll)
+		libraries[i] = Library{
+			Path:           C.GoString(cmods[i].filename),
+			Base:           base,
+			Segments:       []Segment{{Start: base, End: base + uintptr(cmods[i].info.SizeOfImage)}},
+			MainExecutable: i == 0,
+		}
+	}
+	return libraries, nil, nil
+}
+
+func checkLibraries(p process.Process, hash bool) (statuses []LibraryStatus, harderror error, softerrors []error) {
+	return nil, fmt.Errorf("Checking the files of the loaded libraries is not supported on %s", runtime.GOOS), nil
+}
@@ -2,7 +2,9 @@
 package memaccess
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/polyverse/masche/process"
 	"strconv"
@@ -107,18 +109,12 @@ func NextMemoryRegionAccess(p process.Process, address uintptr, access Access) (
 //
 // If there aren't more regions available the special value NoRegionAvailable is returned.
 func NextReadableMemoryRegion(p process.Process, address uintptr) (region MemoryRegion, harderror error, softerrors []error) {
-	r1, h1, s1 := NextMemoryRegionAccess(p, address, Readable)
-	for {
-		r2, h2, _ := NextMemoryRegionAccess(p, r1.Address+uintptr(r1.Size), Readable)
-		if (h2 != nil) || (r2 == NoRegionAvailable) || (r2.Address > r1.Address+uintptr(r1.Size)) {
-			break
-		} // if
-
-		r1.Size += r2.Size
+	m, harderror, softerrors := ReadMemoryMap(p)
+	if harderror != nil {
+		return NoRegionAvailable, harderror, softerrors
 	}
 
-	return r1, h1, s1
-	// return NextMemoryRegionAccess(p, address, Readable)
+	return m.NextReadable(address), nil, softerrors
 }
 
 // CopyMemory fills the entire buffer with memory from the process starting in address (in the process address space).
@@ -128,6 +124,55 @@ func CopyMemory(p process.Process, address uintptr, buffer []byte) (harderror er
 	return copyMemory(p, address, buffer)
 }
 
+// WriteMemory writes data into the memory of the process starting at address (in the process address space).
+//
+// The memory is written only if all of it is mapped as writable, otherwise a hard error is returned and nothing is
+// written. If the write fails part way a hard error is returned and written has the amount of bytes that were
+// actually written.
+func WriteMemory(p process.Process, address uintptr, data []byte) (written int, harderror error, softerrors []error) {
+	return writeMemory(p, address, data)
+}
+
+// MemoryVec is a chunk of memory of a process: Address is in the process address space, and Buffer is the memory
+// that will be copied from or to it.
+type MemoryVec struct {
+	Address uintptr
+	Buffer  []byte
+}
+
+// CopyMemoryVec works as CopyMemory but fills the buffers of many, possibly disjoint, memory chunks, reading them in
+// as few system calls as the OS allows.
+//
+// A chunk that can't be read entirely doesn't make the others fail: a soft error is returned for it, and copied has
+// the amount of bytes that were actually read into each buffer.
+func CopyMemoryVec(p process.Process, vecs []MemoryVec) (copied []int, harderror error, softerrors []error) {
+	return copyMemoryVec(p, vecs)
+}
+
+// copyMemoryVecSequentially implements CopyMemoryVec with a call to copyMemory for each chunk.
+func copyMemoryVecSequentially(p process.Process, vecs []MemoryVec) (copied []int, harderror error,
+	softerrors []error) {
+
+	copied = make([]int, len(vecs))
+	softerrors = make([]error, 0)
+	for i, vec := range vecs {
+		if len(vec.Buffer) == 0 {
+			continue
+		}
+
+		err, serrs := copyMemory(p, vec.Address, vec.Buffer)
+		softerrors = append(softerrors, serrs...)
+		if err != nil {
+			softerrors = append(softerrors, err)
+			continue
+		}
+
+		copied[i] = len(vec.Buffer)
+	}
+
+	return copied, nil, softerrors
+}
+
 // This type represents a function used for walking through the memory, see WalkMemory for more details.
 type WalkFunc func(address uintptr, buf []byte) (keepSearching bool)
 
@@ -135,71 +180,136 @@ type WalkFunc func(address uintptr, buf []byte) (keepSearching bool)
 // and calling walkFn with the buffer and the start address of the memory in the buffer. If walkFn returns false
 // WalkMemory stop reading the memory.
 //
+// The memory regions to read are taken from a single MemoryMap snapshot, which is only read again if a region can't
+// be read because the process changed its memory layout.
+//
 // NOTE: It can call to walkFn with a smaller buffer when reading the last part of a memory region.
 func WalkMemory(p process.Process, startAddress uintptr, bufSize uint, walkFn WalkFunc) (harderror error,
 	softerrors []error) {
 
-	var region MemoryRegion
-	region, harderror, softerrors = NextReadableMemoryRegion(p, startAddress)
+	return WalkMemoryContext(context.Background(), p, startAddress, bufSize, walkFn)
+}
+
+// CanceledError is the hard error returned by the functions taking a context.Context when the context is done before
+// they finish.
+type CanceledError struct {
+	// Err is the error of the context, context.Canceled or context.DeadlineExceeded.
+	Err error
+	// Address is where the walk stopped: the memory from Address on wasn't passed to the walk function.
+	Address uintptr
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("Stopped walking the memory at %x: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the error of the context, so errors.Is(err, context.DeadlineExceeded) works with a CanceledError.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// IsCanceled returns true if err is a CanceledError, or wraps one.
+func IsCanceled(err error) bool {
+	var canceledErr *CanceledError
+	return errors.As(err, &canceledErr)
+}
+
+// WalkMemoryContext works as WalkMemory, but it stops as soon as ctx is done, checking it between chunks. In that
+// case the hard error is a *CanceledError with the address where it stopped.
+func WalkMemoryContext(ctx context.Context, p process.Process, startAddress uintptr, bufSize uint,
+	walkFn WalkFunc) (harderror error, softerrors []error) {
+
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Err: err, Address: startAddress}, nil
+	}
+
+	m, harderror, softerrors := ReadMemoryMap(p)
 	if harderror != nil {
 		return
 	}
 
-	// The first region can start befor startAddress. If that happens, it must contain it. In that case, we set the
-	// region's Adrress to startAdress to behave as documented.
-	if region.Address < startAddress {
-		if region.Address+uintptr(region.Size) <= startAddress {
-			harderror = fmt.Errorf("First memory region doesn't contain the startAddress. This is a bug.")
-			return
-		}
+	var canceled error
+	harderror, serrs := walkMemory(p, m, startAddress, ^uintptr(0), make([]byte, bufSize),
+		func(address uintptr, buf []byte) (keepSearching bool) {
+			if err := ctx.Err(); err != nil {
+				canceled = &CanceledError{Err: err, Address: address}
+				return false
+			}
+			return walkFn(address, buf)
+		})
+	softerrors = append(softerrors, serrs...)
+
+	// The memory may have been read from a new process with the same pid, which is checked once for the whole walk.
+	// This function is implemented by the OS-specific checkIdentity function.
+	if err := checkIdentity(p); err != nil {
+		return err, softerrors
+	}
 
-		region.Size -= uint(startAddress - region.Address)
-		region.Address = startAddress
+	if harderror == nil {
+		harderror = canceled
 	}
+	return harderror, softerrors
+}
+
+// walkMemory works as WalkMemory, but takes the regions to read from m, stops at endAddress, and reads the memory
+// into buf.
+func walkMemory(p process.Process, m *MemoryMap, startAddress uintptr, endAddress uintptr, buf []byte,
+	walkFn WalkFunc) (harderror error, softerrors []error) {
+
+	softerrors = make([]error, 0)
+	region := nextReadableRegionFrom(m, startAddress)
 
 	const max_retries int = 5
 
-	buf := make([]byte, bufSize)
 	retries := max_retries
 
-	for region != NoRegionAvailable {
+	for region != NoRegionAvailable && region.Address < endAddress {
+		if region.Address+uintptr(region.Size) > endAddress {
+			region.Size = uint(endAddress - region.Address)
+		}
 
 		keepWalking, addr, err, serrs := walkRegion(p, region, buf, walkFn)
 		softerrors = append(softerrors, serrs...)
 
 		if err != nil && retries > 0 {
-			// An error occurred: retry using the nearest region to the address that failed.
+			// An error occurred: the memory layout may have changed since we took the snapshot, so we take a new
+			// one and retry using the nearest region to the address that failed.
 			retries--
-			region, harderror, serrs = NextReadableMemoryRegion(p, addr)
+			m, harderror, serrs = ReadMemoryMap(p)
 			softerrors = append(softerrors, serrs...)
 			if harderror != nil {
 				return
 			}
 
 			// if some chunk of this new region was already read we don't want to read it again.
-			if region.Address < addr {
-				region.Address = addr
-			}
-
+			region = nextReadableRegionFrom(m, addr)
 			continue
 		} else if err != nil {
 			// we have exceeded our retries, mark the error as soft error and keep going.
-			softerrors = append(softerrors, fmt.Errorf("Retries exceeded on reading %d bytes starting at %x: %s",
-				len(buf), addr, err.Error()))
+			softerrors = append(softerrors, fmt.Errorf("Retries exceeded on reading %d bytes starting at %x: %w",
+				len(buf), addr, err))
 		} else if !keepWalking {
 			return
 		}
 
-		region, harderror, serrs = NextReadableMemoryRegion(p, region.Address+uintptr(region.Size))
-		softerrors = append(softerrors, serrs...)
-		if harderror != nil {
-			return
-		}
+		region = nextReadableRegionFrom(m, region.Address+uintptr(region.Size))
 		retries = max_retries
 	}
 	return
 }
 
+// nextReadableRegionFrom returns the next readable region of m at or after address, as NextReadable does, but if the
+// region starts before address it's trimmed to start at it.
+func nextReadableRegionFrom(m *MemoryMap, address uintptr) MemoryRegion {
+	region := m.NextReadable(address)
+	if region != NoRegionAvailable && region.Address < address {
+		region.Size -= uint(address - region.Address)
+		region.Address = address
+	}
+
+	return region
+}
+
 // This function walks through a single memory region calling walkFunc with a given buffer. It always fills as much of
 // the buffer as possible before calling walkFunc, but it never calls it with overlaped memory sections.
 //
@@ -242,10 +352,17 @@ func walkRegion(p process.Process, region MemoryRegion, buf []byte, walkFn WalkF
 // Thiw function works as WalkMemory, except that it reads overlapped bytes. It first calls walkFn with a full buffer,
 // then advances just half of the buffer size, and calls it again.
 // As with WalkRegion, the buffer can be smaller at the end of a region.
-// NOTE: It doesn't work with odd bufSize.
+// NOTE: It doesn't work with odd bufSize, use OverlappingWalkMemory to choose the window size and overlap freely.
 func SlidingWalkMemory(p process.Process, startAddress uintptr, bufSize uint, walkFn WalkFunc) (
 	harderror error, softerrors []error) {
 
+	return SlidingWalkMemoryContext(context.Background(), p, startAddress, bufSize, walkFn)
+}
+
+// SlidingWalkMemoryContext works as SlidingWalkMemory, but it stops as soon as ctx is done, as WalkMemoryContext does.
+func SlidingWalkMemoryContext(ctx context.Context, p process.Process, startAddress uintptr, bufSize uint,
+	walkFn WalkFunc) (harderror error, softerrors []error) {
+
 	if bufSize%2 != 0 {
 		return fmt.Errorf("SlidingWalkMemory doesn't support odd bufferSizes"), softerrors
 	}
@@ -254,7 +371,7 @@ func SlidingWalkMemory(p process.Process, startAddress uintptr, bufSize uint, wa
 	halfBufferSize := bufSize / 2
 	currentBufferStartsAt := uintptr(0)
 	bufferedBytes := uint(0)
-	harderror, softerrors = WalkMemory(p, startAddress, halfBufferSize,
+	harderror, softerrors = WalkMemoryContext(ctx, p, startAddress, halfBufferSize,
 		func(address uintptr, currentBuffer []byte) (keepSearching bool) {
 
 			fromAnotherRegion := currentBufferStartsAt+uintptr(bufferedBytes) < address && currentBufferStartsAt != 0
@@ -288,7 +405,7 @@ func SlidingWalkMemory(p process.Process, startAddress uintptr, bufSize uint, wa
 			}
 
 			if bufferedBytes == bufSize {
-				copy(buffer, buffer[:halfBufferSize])
+				copy(buffer, buffer[halfBufferSize:])
 				currentBufferStartsAt += uintptr(halfBufferSize)
 			}
 
@@ -308,9 +425,56 @@ func SlidingWalkMemory(p process.Process, startAddress uintptr, bufSize uint, wa
 		})
 
 	// If we only have half buffer filled we haven't called walkFn yet with it
-	if bufferedBytes == halfBufferSize {
+	if harderror == nil && bufferedBytes == halfBufferSize {
 		walkFn(currentBufferStartsAt, buffer[:halfBufferSize])
 	}
 
 	return
 }
+
+// OverlappingWalkMemory works as WalkMemory, but calls walkFn with windows of up to windowSize bytes that overlap.
+// Each window begins with the last overlap bytes (or all of them, if there are less) of the previous one, unless the
+// previous window ended in a different region of contiguous memory. Both windowSize and overlap can be odd.
+//
+// This way every bytes sequence of up to overlap bytes is entirely in at least one window. To see each of them only
+// once, walkFn must ignore the ones that end at or before the end of the previous window, as they were already in it.
+func OverlappingWalkMemory(p process.Process, startAddress uintptr, windowSize uint, overlap uint, walkFn WalkFunc) (
+	harderror error, softerrors []error) {
+
+	return OverlappingWalkMemoryContext(context.Background(), p, startAddress, windowSize, overlap, walkFn)
+}
+
+// OverlappingWalkMemoryContext works as OverlappingWalkMemory, but it stops as soon as ctx is done, as
+// WalkMemoryContext does.
+func OverlappingWalkMemoryContext(ctx context.Context, p process.Process, startAddress uintptr, windowSize uint,
+	overlap uint, walkFn WalkFunc) (harderror error, softerrors []error) {
+
+	if overlap >= windowSize {
+		return fmt.Errorf("The overlap (%d bytes) must be smaller than the window size (%d bytes)", overlap,
+			windowSize), softerrors
+	}
+
+	// Every window is the end of the previous one followed by a chunk read by WalkMemory.
+	window := make([]byte, 0, windowSize)
+	windowStartsAt := uintptr(0)
+	harderror, softerrors = WalkMemoryContext(ctx, p, startAddress, windowSize-overlap,
+		func(address uintptr, chunk []byte) (keepSearching bool) {
+			if windowStartsAt+uintptr(len(window)) != address {
+				// The contiguous memory finished, so nothing from the previous window is kept.
+				window = window[:0]
+			} else if uint(len(window)) > overlap {
+				kept := uint(len(window)) - overlap
+				window = append(window[:0], window[kept:]...)
+				windowStartsAt += uintptr(kept)
+			}
+
+			if len(window) == 0 {
+				windowStartsAt = address
+			}
+			window = append(window, chunk...)
+
+			return walkFn(windowStartsAt, window)
+		})
+
+	return
+}
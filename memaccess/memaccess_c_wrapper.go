@@ -8,8 +8,10 @@ import "C"
 
 import (
 	"fmt"
+	"github.com/polyverse/masche/common"
 	"github.com/polyverse/masche/cresponse"
 	"github.com/polyverse/masche/process"
+	"runtime"
 	"unsafe"
 )
 
@@ -32,6 +34,24 @@ func nextMemoryRegion(p process.Process, address uintptr) (region MemoryRegion,
 	return MemoryRegion{uintptr(cRegion.start_address), uint(cRegion.length), Access(cRegion.access), C.GoString(cRegion.kind)}, harderror, softerrors
 }
 
+func readMemoryMap(p process.Process) (m *MemoryMap, harderror error, softerrors []error) {
+	return readMemoryMapByRegions(p)
+}
+
+// checkIdentity checks that p is still the process it was opened for. The handles of the processes can't be reused
+// by other processes, so there is nothing to check.
+func checkIdentity(p process.Process) error {
+	return nil
+}
+
+func copyMemoryVec(p process.Process, vecs []MemoryVec) (copied []int, harderror error, softerrors []error) {
+	return copyMemoryVecSequentially(p, vecs)
+}
+
+func writeMemory(p process.Process, address uintptr, data []byte) (written int, harderror error, softerrors []error) {
+	return 0, fmt.Errorf("Writing the memory of a process is not supported on %s", runtime.GOOS), nil
+}
+
 func copyMemory(p process.Process, address uintptr, buffer []byte) (harderror error, softerrors []error) {
 	buf := unsafe.Pointer(&buffer[0])
 
@@ -49,12 +69,12 @@ func copyMemory(p process.Process, address uintptr, buffer []byte) (harderror er
 	C.response_free(resp)
 
 	if harderror != nil {
-		harderror = fmt.Errorf("Error while copying %d bytes starting at %x: %s", n, address, harderror.Error())
+		harderror = &common.MemoryError{Pid: p.Pid(), Address: address, Length: n, Err: harderror}
 		return
 	}
 
 	if len(buffer) != int(bytesRead) {
-		harderror = fmt.Errorf("Could not copy %d bytes starting at %x, copyed %d", len(buffer), address, bytesRead)
+		harderror = &common.ShortReadError{Address: address, Length: len(buffer), Read: int(bytesRead)}
 	}
 
 	return
@@ -1,80 +1,168 @@
 package memaccess
 
 import (
-	"bufio"
-	"fmt"
 	"github.com/polyverse/masche/common"
 	"github.com/polyverse/masche/process"
 	"os"
 )
 
 func nextMemoryRegion(p process.Process, address uintptr) (region MemoryRegion, harderror error, softerrors []error) {
-
-	mapsFile, harderror := os.Open(common.MapsFilePathFromPid(uint(p.Pid())))
+	m, harderror, softerrors := readMemoryMap(p)
 	if harderror != nil {
-		return
+		return NoRegionAvailable, harderror, softerrors
 	}
-	defer mapsFile.Close()
-
-	region = MemoryRegion{}
-	scanner := bufio.NewScanner(mapsFile)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		items := common.SplitMapsFileEntry(line)
-
-		if len(items) != 6 {
-			return region, fmt.Errorf("Unrecognised maps line: %s", line), softerrors
-		}
+	return m.Next(address), nil, softerrors
+}
 
-		start, end, err := common.ParseMapsFileMemoryLimits(items[0])
-		if err != nil {
-			return region, err, softerrors
-		}
+func readMemoryMap(p process.Process) (m *MemoryMap, harderror error, softerrors []error) {
+	entries, harderror := process.ReadMapsEntries(p)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
 
+	m = &MemoryMap{Regions: make([]MemoryRegion, 0, len(entries))}
+	for _, entry := range entries {
 		// Skip vsyscall as it can't be read. It's a special page mapped by the kernel to accelerate some syscalls.
-		if items[5] == "[vsyscall]" {
+		if entry.Pathname == "[vsyscall]" {
 			continue
 		}
 
-		if end <= address {
-			continue
-		}
+		m.Regions = append(m.Regions, memoryRegionFromMapsEntry(entry))
+	}
 
-		access := None
-		if items[1][0] != '-' {
-			access += Readable
+	return m, nil, softerrors
+}
+
+// memoryRegionFromMapsEntry converts a parsed maps file entry into a MemoryRegion.
+func memoryRegionFromMapsEntry(entry common.MapsEntry) MemoryRegion {
+	access := None
+	if entry.Readable {
+		access |= Readable
+	}
+	if entry.Writable {
+		access |= Writable
+	}
+	if entry.Executable {
+		access |= Executable
+	}
+	return MemoryRegion{Address: entry.Start, Size: entry.Size(), Access: access, Kind: entry.MapsPathname()}
+}
+
+func copyMemory(p process.Process, address uintptr, buffer []byte) (harderror error, softerrors []error) {
+	harderror, softerrors = readMemory(p, address, buffer)
+
+	// The memory read by pid may come from a new process with the same pid. Checking it after every read would
+	// double the system calls of a walk, so it's only checked here if the read failed, which happens from the moment
+	// the process exits until its pid is reused, and the walks check it once they finish.
+	if harderror != nil {
+		if err := process.CheckIdentity(p); err != nil {
+			return err, softerrors
 		}
-		if items[1][1] != '-' {
-			access += Writable
+	}
+	return harderror, softerrors
+}
+
+// checkIdentity checks that p is still the process it was opened for.
+func checkIdentity(p process.Process) error {
+	return process.CheckIdentity(p)
+}
+
+// readMemory implements copyMemory, without checking the identity of the process.
+func readMemory(p process.Process, address uintptr, buffer []byte) (harderror error, softerrors []error) {
+	if useProcessVM() {
+		fallback, harderror := copyMemoryWithProcessVMReadv(p, address, buffer)
+		if !fallback {
+			return harderror, softerrors
 		}
-		if items[1][2] != '-' {
-			access += Executable
+	}
+
+	mem := process.MemFile(p)
+	if mem == nil {
+		mem, harderror = os.Open(common.MemFilePathFromPid(uint(p.Pid())))
+		if harderror != nil {
+			return &common.ProcessError{Pid: p.Pid(), Op: "open the mem file", Err: harderror}, softerrors
 		}
-		return MemoryRegion{Address: start, Size: uint(end - start), Access: access, Kind: items[5]}, nil, softerrors
+		defer mem.Close()
+	}
+
+	bytes_read, harderror := mem.ReadAt(buffer, int64(address))
+	if bytes_read > 0 && bytes_read != len(buffer) {
+		harderror = &common.ShortReadError{Address: address, Length: len(buffer), Read: bytes_read, Err: harderror}
+		return harderror, softerrors
+	}
+
+	if harderror != nil {
+		harderror = &common.MemoryError{Pid: p.Pid(), Address: address, Length: len(buffer), Err: harderror}
+		return harderror, softerrors
 	}
 
-	return NoRegionAvailable, nil, softerrors
+	return nil, softerrors
 }
 
-func copyMemory(p process.Process, address uintptr, buffer []byte) (harderror error, softerrors []error) {
-	mem, harderror := os.Open(common.MemFilePathFromPid(uint(p.Pid())))
+func writeMemory(p process.Process, address uintptr, data []byte) (written int, harderror error, softerrors []error) {
+	byPid, written, harderror, softerrors := writeMemoryChecked(p, address, data)
 
+	// The memory may have been written into a new process with the same pid. It can't be undone, but at least we
+	// report it. As when reading, the mem file kept open by p can only write into the original process.
+	if byPid || harderror != nil {
+		if err := process.CheckIdentity(p); err != nil {
+			return written, err, softerrors
+		}
+	}
+	return written, harderror, softerrors
+}
+
+// writeMemoryChecked implements writeMemory, checking the protection of the memory but not the identity of the
+// process after writing. byPid is true if the memory was written by the pid of the process.
+func writeMemoryChecked(p process.Process, address uintptr, data []byte) (byPid bool, written int, harderror error,
+	softerrors []error) {
+
+	if len(data) == 0 {
+		return false, 0, nil, nil
+	}
+
+	// Reading the memory map checks the identity of the process too, so we don't write into a recycled pid.
+	m, harderror, softerrors := readMemoryMap(p)
 	if harderror != nil {
-		harderror := fmt.Errorf("Error while reading %d bytes starting at %x: %s", len(buffer), address, harderror)
-		return harderror, softerrors
+		return false, 0, harderror, softerrors
 	}
-	defer mem.Close()
 
-	bytes_read, harderror := mem.ReadAt(buffer, int64(address))
+	// Writes to /proc/<pid>/mem ignore the protection of the pages, so we must check it ourselves.
+	if !m.HasAccess(address, uint(len(data)), Writable) {
+		harderror = &common.MemoryError{Pid: p.Pid(), Write: true, Address: address, Length: len(data),
+			Err: common.ErrUnmapped}
+		return false, 0, harderror, softerrors
+	}
+
+	if useProcessVM() {
+		fallback, written, harderror := writeMemoryWithProcessVMWritev(p, address, data)
+		if !fallback {
+			return true, written, harderror, softerrors
+		}
+	}
+
+	mem, harderror := process.MemWriteFile(p)
 	if harderror != nil {
-		harderror := fmt.Errorf("Error while reading %d bytes starting at %x: %s", len(buffer), address, harderror)
-		return harderror, softerrors
+		return false, 0, harderror, softerrors
 	}
 
-	if bytes_read != len(buffer) {
-		return fmt.Errorf("Could not read the entire buffer"), softerrors
+	if mem == nil {
+		byPid = true
+		mem, harderror = os.OpenFile(common.MemFilePathFromPid(uint(p.Pid())), os.O_WRONLY, 0)
+		if harderror != nil {
+			harderror := &common.ProcessError{Pid: p.Pid(), Op: "open the mem file for writing", Err: harderror}
+			return byPid, 0, harderror, softerrors
+		}
+		defer mem.Close()
 	}
 
-	return nil, softerrors
+	written, harderror = mem.WriteAt(data, int64(address))
+	if harderror != nil {
+		harderror := &common.MemoryError{Pid: p.Pid(), Write: true, Address: address, Length: len(data),
+			Err: harderror}
+		return byPid, written, harderror, softerrors
+	}
+
+	return byPid, written, nil, softerrors
 }
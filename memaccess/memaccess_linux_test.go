@@ -0,0 +1,319 @@
+package memaccess
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/polyverse/masche/common"
+	"github.com/polyverse/masche/process"
+	"github.com/polyverse/masche/test"
+)
+
+func TestCopyMemoryVec(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	m, err, softerrors := ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageSize := uint(os.Getpagesize())
+	region := m.NextReadable(0)
+	for region != NoRegionAvailable && region.Size < 2*pageSize {
+		region = m.NextReadable(region.Address + uintptr(region.Size))
+	}
+	if region == NoRegionAvailable {
+		t.Fatalf("We couldn't find a region of %d bytes", 2*pageSize)
+	}
+	regionEnd := region.Address + uintptr(region.Size)
+
+	defer SetBackend(GetBackend())
+	for _, backend := range []MemoryBackend{ProcMemBackend, ProcessVMBackend, AutoBackend} {
+		SetBackend(backend)
+
+		vecs := []MemoryVec{
+			{Address: region.Address, Buffer: make([]byte, 16)},
+			{Address: region.Address + 100, Buffer: make([]byte, pageSize)},
+			// Entirely outside the region
+			{Address: regionEnd, Buffer: make([]byte, 8)},
+			{Address: region.Address + 200, Buffer: make([]byte, 0)},
+			{Address: regionEnd - 32, Buffer: make([]byte, 32)},
+		}
+		expected := []int{16, int(pageSize), 0, 0, 32}
+
+		copied, err, softerrors := CopyMemoryVec(proc, vecs)
+		if err != nil {
+			t.Fatal(backend, err)
+		}
+
+		if len(softerrors) != 1 {
+			t.Errorf("%v: expected a single softerror and got %v", backend, softerrors)
+		} else if !errors.Is(softerrors[0], common.ErrUnmapped) {
+			t.Errorf("%v: reading outside the region returned %v, expected ErrUnmapped", backend, softerrors[0])
+		}
+
+		for i, vec := range vecs {
+			if copied[i] != expected[i] {
+				t.Errorf("%v: copied %d bytes at %x, expected %d", backend, copied[i], vec.Address, expected[i])
+			}
+
+			if copied[i] != len(vec.Buffer) || copied[i] == 0 {
+				continue
+			}
+
+			buf := make([]byte, len(vec.Buffer))
+			err, softerrors = CopyMemory(proc, vec.Address, buf)
+			test.PrintSoftErrors(softerrors)
+			if err != nil {
+				t.Fatal(backend, err)
+			}
+
+			if !bytes.Equal(buf, vec.Buffer) {
+				t.Errorf("%v: CopyMemoryVec and CopyMemory read different data at %x", backend, vec.Address)
+			}
+		}
+	}
+}
+
+func TestWriteMemory(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	m, err, softerrors := ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writable := m.NextAccess(0, Readable|Writable)
+	readOnly := m.NextAccess(0, Readable)
+	for readOnly != NoRegionAvailable && (readOnly.Access&Writable) == Writable {
+		readOnly = m.NextAccess(readOnly.Address+uintptr(readOnly.Size), Readable)
+	}
+	if writable == NoRegionAvailable || readOnly == NoRegionAvailable {
+		t.Fatal("We couldn't find a writable and a read-only region")
+	}
+
+	defer SetBackend(GetBackend())
+	for i, backend := range []MemoryBackend{ProcMemBackend, ProcessVMBackend, AutoBackend} {
+		SetBackend(backend)
+
+		data := []byte{0xde, 0xad, 0xbe, 0xef, byte(i)}
+		written, err, softerrors := WriteMemory(proc, writable.Address, data)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(backend, err)
+		}
+
+		if written != len(data) {
+			t.Errorf("%v: wrote %d bytes, expected %d", backend, written, len(data))
+		}
+
+		buf := make([]byte, len(data))
+		err, softerrors = CopyMemory(proc, writable.Address, buf)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(backend, err)
+		}
+
+		if !bytes.Equal(buf, data) {
+			t.Errorf("%v: read %v after writing %v", backend, buf, data)
+		}
+
+		original := make([]byte, len(data))
+		err, softerrors = CopyMemory(proc, readOnly.Address, original)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(backend, err)
+		}
+
+		written, err, softerrors = WriteMemory(proc, readOnly.Address, data)
+		test.PrintSoftErrors(softerrors)
+		if err == nil || written != 0 {
+			t.Errorf("%v: wrote %d bytes into a read-only region", backend, written)
+		}
+		if !errors.Is(err, common.ErrUnmapped) {
+			t.Errorf("%v: writing into a read-only region returned %v, expected ErrUnmapped", backend, err)
+		}
+
+		err, softerrors = CopyMemory(proc, readOnly.Address, buf)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(backend, err)
+		}
+
+		if !bytes.Equal(buf, original) {
+			t.Errorf("%v: a read-only region was modified", backend)
+		}
+	}
+}
+
+func TestCopyMemoryFromGoneProcess(t *testing.T) {
+	defer SetBackend(GetBackend())
+
+	// The mem file kept open by the process is only checked when reading it fails, process_vm_readv after each read.
+	for _, backend := range []MemoryBackend{ProcMemBackend, ProcessVMBackend} {
+		SetBackend(backend)
+
+		cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+
+		proc, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proc.Close()
+
+		region, err, softerrors := NextReadableMemoryRegion(proc, 0)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		err, softerrors = CopyMemory(proc, region.Address, make([]byte, 16))
+		test.PrintSoftErrors(softerrors)
+		if !process.IsProcessGone(err) || !errors.Is(err, common.ErrProcessExited) {
+			t.Errorf("Expected a ProcessGoneError with the %v backend and got %v", backend, err)
+		}
+	}
+}
+
+func TestCopyMemoryErrors(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	proc, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	m, err, softerrors := ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A readable region followed by unmapped memory, so reading past its end is a short read.
+	var last MemoryRegion
+	for _, region := range m.Regions {
+		end := region.Address + uintptr(region.Size)
+		if region.Access&Readable == Readable && m.Next(end).Address != end {
+			last = region
+			break
+		}
+	}
+	if last.Size == 0 {
+		t.Fatal("We couldn't find a readable region followed by unmapped memory")
+	}
+
+	defer SetBackend(GetBackend())
+	for _, backend := range []MemoryBackend{ProcMemBackend, ProcessVMBackend} {
+		SetBackend(backend)
+
+		err, softerrors = CopyMemory(proc, 0, make([]byte, 16))
+		test.PrintSoftErrors(softerrors)
+		if !errors.Is(err, common.ErrUnmapped) {
+			t.Errorf("%v: reading unmapped memory returned %v, expected ErrUnmapped", backend, err)
+		}
+
+		address := last.Address + uintptr(last.Size) - 8
+		err, softerrors = CopyMemory(proc, address, make([]byte, 16))
+		test.PrintSoftErrors(softerrors)
+		var shortErr *common.ShortReadError
+		if !errors.As(err, &shortErr) || !errors.Is(err, common.ErrShortRead) {
+			t.Errorf("%v: reading past the end of a region returned %v, expected a ShortReadError", backend, err)
+		} else if shortErr.Address != address || shortErr.Length != 16 || shortErr.Read != 8 ||
+			!errors.Is(err, common.ErrUnmapped) {
+			t.Errorf("%v: unexpected short read %+v", backend, shortErr)
+		}
+	}
+}
+
+func TestShortWriteWithProcessVMWritev(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	proc, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	m, err, softerrors := ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writable region followed by unmapped memory, so the kernel stops writing at its end.
+	var last MemoryRegion
+	for _, region := range m.Regions {
+		end := region.Address + uintptr(region.Size)
+		if region.Access&Writable == Writable && m.Next(end).Address != end {
+			last = region
+			break
+		}
+	}
+	if last.Size == 0 {
+		t.Fatal("We couldn't find a writable region followed by unmapped memory")
+	}
+
+	defer SetBackend(GetBackend())
+	SetBackend(ProcessVMBackend)
+
+	address := last.Address + uintptr(last.Size) - 8
+	_, written, err := writeMemoryWithProcessVMWritev(proc, address, make([]byte, 16))
+	var memErr *common.MemoryError
+	var shortErr *common.ShortWriteError
+	if !errors.As(err, &memErr) || !errors.As(err, &shortErr) || !errors.Is(err, common.ErrShortWrite) {
+		t.Fatalf("Writing past the end of a region returned %v, expected a MemoryError with a ShortWriteError", err)
+	}
+	if !memErr.Write || memErr.Pid != proc.Pid() || memErr.Address != address || memErr.Length != 16 {
+		t.Errorf("Unexpected memory error %+v", memErr)
+	}
+	if written != 8 || shortErr.Address != address || shortErr.Length != 16 || shortErr.Written != 8 {
+		t.Errorf("Unexpected short write %+v, %d bytes written", shortErr, written)
+	}
+}
@@ -2,13 +2,19 @@ package memaccess
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/polyverse/masche/process"
 	"github.com/polyverse/masche/test"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func roy0(t *testing.T, proc process.Process) {
@@ -75,7 +81,7 @@ func roy(t *testing.T, proc process.Process) {
 }
 
 func TestManuallyWalk(t *testing.T) {
-	fmt.Println("TestManuallyWalk: Enter\n")
+	fmt.Println("TestManuallyWalk: Enter")
 	cmd, err := test.LaunchTestCase()
 	if err != nil {
 		t.Fatal(err)
@@ -116,7 +122,7 @@ func TestManuallyWalk(t *testing.T) {
 
 		previousRegion = region
 	}
-	fmt.Println("TestManuallyWalk: Exit\n")
+	fmt.Println("TestManuallyWalk: Exit")
 }
 
 func TestCopyMemory(t *testing.T) {
@@ -148,7 +154,7 @@ func TestCopyMemory(t *testing.T) {
 
 	for region.Size < min_region_size {
 		if region == NoRegionAvailable {
-			t.Fatal("We couldn't find a region of %d bytes", min_region_size)
+			t.Fatalf("We couldn't find a region of %d bytes", min_region_size)
 		}
 
 		region, err, softerrors = NextReadableMemoryRegion(proc, region.Address+uintptr(region.Size))
@@ -272,7 +278,7 @@ func TestWalkRegionReadsEntireRegion(t *testing.T) {
 	min_region_size := bufferSizes[len(bufferSizes)-1]
 	for region.Size < min_region_size {
 		if region == NoRegionAvailable {
-			t.Fatal("We couldn't find a region of %d bytes", min_region_size)
+			t.Fatalf("We couldn't find a region of %d bytes", min_region_size)
 		}
 
 		region, err, softerrors = NextReadableMemoryRegion(proc, region.Address+uintptr(region.Size))
@@ -383,3 +389,400 @@ func TestSlidingWalkMemory(t *testing.T) {
 		}
 	}
 }
+
+func TestMemoryMap(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err, softerrors := ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Len() == 0 {
+		t.Fatal("No regions in the memory map")
+	}
+
+	for i, region := range m.Regions {
+		if i > 0 && memoryRegionsOverlap(m.Regions[i-1], region) {
+			t.Error("Regions overlap or are not sorted:", m.Regions[i-1], region)
+		}
+
+		for _, address := range []uintptr{region.Address, region.Address + uintptr(region.Size) - 1} {
+			found, ok := m.Find(address)
+			if !ok || found != region {
+				t.Errorf("Find(%x) returned %v, expected %v", address, found, region)
+			}
+		}
+	}
+
+	last := m.Regions[m.Len()-1]
+	if _, ok := m.Find(last.Address + uintptr(last.Size)); ok {
+		t.Error("Found a region after the last one")
+	}
+
+	if m.Next(last.Address+uintptr(last.Size)) != NoRegionAvailable {
+		t.Error("Next returned a region after the last one")
+	}
+
+	region, err, softerrors := NextReadableMemoryRegion(proc, 0)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.NextReadable(0) != region {
+		t.Errorf("NextReadable returned %v, expected %v", m.NextReadable(0), region)
+	}
+}
+
+func TestSlidingWalkMemoryContents(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageSize := uint(os.Getpagesize())
+	bufferSizes := []uint{1024, pageSize, pageSize*2 + 124}
+	for _, size := range bufferSizes {
+		err, softerrors = SlidingWalkMemory(proc, 0, size, func(address uintptr, buffer []byte) (keepSearching bool) {
+			expected := make([]byte, len(buffer))
+			err, softerrors := CopyMemory(proc, address, expected)
+			test.PrintSoftErrors(softerrors)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buffer, expected) {
+				t.Errorf("Buffer of %d bytes at %x doesn't have the process memory", len(buffer), address)
+				return false
+			}
+			return true
+		})
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOverlappingWalkMemory(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageSize := uint(os.Getpagesize())
+	windows := []struct {
+		size    uint
+		overlap uint
+	}{
+		{1024, 512},
+		{1025, 0},
+		{pageSize, 1},
+		{pageSize + 101, 333},
+		{pageSize*3 + 7, pageSize*2 + 5},
+	}
+
+	for _, window := range windows {
+		previous := MemoryRegion{}
+		err, softerrors = OverlappingWalkMemory(proc, 0, window.size, window.overlap,
+			func(address uintptr, buffer []byte) (keepSearching bool) {
+				current := MemoryRegion{Address: address, Size: uint(len(buffer))}
+				if current.Size == 0 || current.Size > window.size {
+					t.Errorf("Window of %d bytes, expected at most %d", current.Size, window.size)
+					return false
+				}
+
+				previousLimit := previous.Address + uintptr(previous.Size)
+				if previous.Size > 0 && address <= previousLimit {
+					expectedOverlap := window.overlap
+					if previous.Size < expectedOverlap {
+						expectedOverlap = previous.Size
+					}
+
+					if previousLimit-address != uintptr(expectedOverlap) {
+						t.Errorf("Windows overlap by %d bytes, expected %d. window %v - previous %v - current %v",
+							previousLimit-address, expectedOverlap, window, previous, current)
+						return false
+					}
+				}
+
+				expected := make([]byte, len(buffer))
+				err, softerrors := CopyMemory(proc, address, expected)
+				test.PrintSoftErrors(softerrors)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(buffer, expected) {
+					t.Errorf("Window of %d bytes at %x doesn't have the process memory", len(buffer), address)
+					return false
+				}
+
+				previous = current
+				return true
+			})
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err, _ = OverlappingWalkMemory(proc, 0, 100, 100, func(address uintptr, buffer []byte) (keepSearching bool) {
+		return true
+	})
+	if err == nil {
+		t.Error("An overlap as big as the window should be an error")
+	}
+}
+
+func TestWalkMemoryContext(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	nextAddress := uintptr(0)
+	err, softerrors = WalkMemoryContext(ctx, proc, 0, 1024, func(address uintptr, buf []byte) (keepSearching bool) {
+		calls++
+		if calls == 3 {
+			cancel()
+		} else if calls > 3 {
+			t.Errorf("walkFn called after the context was canceled")
+		}
+		nextAddress = address + uintptr(len(buf))
+		return true
+	})
+	test.PrintSoftErrors(softerrors)
+
+	canceled, ok := err.(*CanceledError)
+	if !ok || !IsCanceled(err) {
+		t.Fatalf("Expected a CanceledError, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("%v is not context.Canceled", err)
+	}
+	if canceled.Address < nextAddress {
+		t.Errorf("Stopped at %x, but the memory was walked up to %x", canceled.Address, nextAddress)
+	}
+	if wrapped := fmt.Errorf("Unable to scan process %d: %w", pid, err); !IsCanceled(wrapped) {
+		t.Errorf("%v wraps a CanceledError", wrapped)
+	}
+	if IsCanceled(context.Canceled) {
+		t.Errorf("%v is not a CanceledError", context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	walkers := map[string]func(WalkFunc) (error, []error){
+		"WalkMemoryContext": func(walkFn WalkFunc) (error, []error) {
+			return WalkMemoryContext(ctx, proc, 0, 1024, walkFn)
+		},
+		"SlidingWalkMemoryContext": func(walkFn WalkFunc) (error, []error) {
+			return SlidingWalkMemoryContext(ctx, proc, 0, 1024, walkFn)
+		},
+		"OverlappingWalkMemoryContext": func(walkFn WalkFunc) (error, []error) {
+			return OverlappingWalkMemoryContext(ctx, proc, 0, 1024, 100, walkFn)
+		},
+	}
+
+	for name, walk := range walkers {
+		err, softerrors = walk(func(address uintptr, buf []byte) (keepSearching bool) {
+			t.Errorf("%s called walkFn after the deadline", name)
+			return false
+		})
+		test.PrintSoftErrors(softerrors)
+		if !IsCanceled(err) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s returned %v, expected an exceeded deadline", name, err)
+		}
+	}
+}
+
+func TestParallelWalkMemory(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bufSize = 1000
+	sequential := make([]MemoryRegion, 0)
+	err, softerrors = WalkMemory(proc, 0, bufSize, func(address uintptr, buf []byte) (keepSearching bool) {
+		sequential = append(sequential, MemoryRegion{Address: address, Size: uint(len(buf))})
+		return true
+	})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mtx sync.Mutex
+	parallel := make([]MemoryRegion, 0)
+	opts := ParallelWalkOptions{Workers: 4, BufSize: bufSize}
+	err, softerrors = ParallelWalkMemory(proc, 0, opts, func(address uintptr, buf []byte) (keepSearching bool) {
+		expected := make([]byte, len(buf))
+		err, _ := CopyMemory(proc, address, expected)
+		if err != nil || !bytes.Equal(buf, expected) {
+			t.Errorf("Buffer of %d bytes at %x doesn't have the process memory", len(buf), address)
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		parallel = append(parallel, MemoryRegion{Address: address, Size: uint(len(buf))})
+		return true
+	})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks can be split differently, but they must cover at least the same memory. It can be more, as a
+	// region that can't be read entirely is skipped by WalkMemory from the first chunk that fails, and by
+	// ParallelWalkMemory only until the end of the piece with the failing chunk.
+	sort.Slice(parallel, func(i, j int) bool {
+		return parallel[i].Address < parallel[j].Address
+	})
+	for i := 1; i < len(parallel); i++ {
+		if memoryRegionsOverlap(parallel[i-1], parallel[i]) {
+			t.Errorf("Chunks %v and %v overlap", parallel[i-1], parallel[i])
+		}
+	}
+
+	merged := mergeChunks(parallel)
+	for _, chunk := range mergeChunks(sequential) {
+		if !chunksCover(merged, chunk) {
+			t.Errorf("ParallelWalkMemory didn't walk %v", chunk)
+		}
+	}
+
+	// Stopping the walk from walkFn is not an error.
+	calls := 0
+	err, softerrors = ParallelWalkMemory(proc, 0, opts, func(address uintptr, buf []byte) (keepSearching bool) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls++
+		return false
+	})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if calls > opts.Workers {
+		t.Errorf("walkFn called %d times after returning false", calls-1)
+	}
+
+	// When canceled, all the memory before the address where it stopped must have been walked.
+	ctx, cancel := context.WithCancel(context.Background())
+	walked := make([]MemoryRegion, 0)
+	err, softerrors = ParallelWalkMemoryContext(ctx, proc, 0, opts, func(address uintptr, buf []byte) (
+		keepSearching bool) {
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		walked = append(walked, MemoryRegion{Address: address, Size: uint(len(buf))})
+		if len(walked) == 100 {
+			cancel()
+		}
+		return true
+	})
+	test.PrintSoftErrors(softerrors)
+	canceled, ok := err.(*CanceledError)
+	if !ok || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a CanceledError, got %v", err)
+	}
+
+	sort.Slice(walked, func(i, j int) bool {
+		return walked[i].Address < walked[j].Address
+	})
+	merged = mergeChunks(walked)
+	for _, chunk := range mergeChunks(sequential) {
+		if chunk.Address >= canceled.Address {
+			break
+		}
+		if chunk.Address+uintptr(chunk.Size) > canceled.Address {
+			chunk.Size = uint(canceled.Address - chunk.Address)
+		}
+
+		if !chunksCover(merged, chunk) {
+			t.Errorf("Canceled at %x without walking %v", canceled.Address, chunk)
+		}
+	}
+
+	_, _, err = ParallelWalkOptions{BufSize: 4096, MemoryBudget: 4000}.workers()
+	if err == nil {
+		t.Error("A memory budget smaller than the buffer size should be an error")
+	}
+
+	workers, _, _ := ParallelWalkOptions{Workers: 8, BufSize: 4096, MemoryBudget: 3 * 4096}.workers()
+	if workers != 3 {
+		t.Errorf("%d workers used with a memory budget for 3", workers)
+	}
+}
+
+// mergeChunks merges the contiguous chunks of memory of a sorted list of them.
+func mergeChunks(chunks []MemoryRegion) []MemoryRegion {
+	merged := make([]MemoryRegion, 0)
+	for _, chunk := range chunks {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Address+uintptr(merged[last].Size) == chunk.Address {
+			merged[last].Size += chunk.Size
+		} else {
+			merged = append(merged, chunk)
+		}
+	}
+	return merged
+}
+
+// chunksCover returns true if chunk is entirely in one of the merged chunks of memory.
+func chunksCover(merged []MemoryRegion, chunk MemoryRegion) bool {
+	for _, m := range merged {
+		if m.Address <= chunk.Address && m.Address+uintptr(m.Size) >= chunk.Address+uintptr(chunk.Size) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package memaccess
+
+import (
+	"sort"
+
+	"github.com/polyverse/masche/process"
+)
+
+// MemoryMap is a snapshot of the memory regions of a process taken at a single point in time.
+//
+// Regions are ordered by address and don't overlap. As the snapshot is not updated, the process may have changed its
+// memory layout by the time the regions are used.
+type MemoryMap struct {
+	Regions []MemoryRegion
+}
+
+// ReadMemoryMap reads all the memory regions of a process at once, returning them as a MemoryMap.
+func ReadMemoryMap(p process.Process) (m *MemoryMap, harderror error, softerrors []error) {
+	// This function is implemented by the OS-specific readMemoryMap function.
+	return readMemoryMap(p)
+}
+
+// readMemoryMapByRegions builds a MemoryMap by asking for each region with nextMemoryRegion. It's used by the
+// implementations that can't get all the regions in a single call.
+func readMemoryMapByRegions(p process.Process) (m *MemoryMap, harderror error, softerrors []error) {
+	m = &MemoryMap{Regions: make([]MemoryRegion, 0, 64)}
+	softerrors = make([]error, 0)
+
+	address := uintptr(0)
+	for {
+		region, err, serrs := nextMemoryRegion(p, address)
+		softerrors = append(softerrors, serrs...)
+		if err != nil {
+			return nil, err, softerrors
+		}
+
+		if region == NoRegionAvailable {
+			return m, nil, softerrors
+		}
+
+		m.Regions = append(m.Regions, region)
+		address = region.Address + uintptr(region.Size)
+	}
+}
+
+// Len returns the amount of regions in the MemoryMap.
+func (m *MemoryMap) Len() int {
+	return len(m.Regions)
+}
+
+// index returns the index of the first region that ends after address, or m.Len() if there is none.
+func (m *MemoryMap) index(address uintptr) int {
+	return sort.Search(len(m.Regions), func(i int) bool {
+		return m.Regions[i].Address+uintptr(m.Regions[i].Size) > address
+	})
+}
+
+// Find returns the region that contains address. If there is none found is false.
+func (m *MemoryMap) Find(address uintptr) (region MemoryRegion, found bool) {
+	region = m.Next(address)
+	if region == NoRegionAvailable || region.Address > address {
+		return NoRegionAvailable, false
+	}
+
+	return region, true
+}
+
+// Next returns the memory region at or after address.
+//
+// If there aren't more regions available the special value NoRegionAvailable is returned.
+func (m *MemoryMap) Next(address uintptr) MemoryRegion {
+	i := m.index(address)
+	if i == len(m.Regions) {
+		return NoRegionAvailable
+	}
+
+	return m.Regions[i]
+}
+
+// NextAccess returns the memory region at or after address with at least the given access.
+//
+// If there aren't more regions available the special value NoRegionAvailable is returned.
+func (m *MemoryMap) NextAccess(address uintptr, access Access) MemoryRegion {
+	for i := m.index(address); i < len(m.Regions); i++ {
+		if (m.Regions[i].Access & access) == access {
+			return m.Regions[i]
+		}
+	}
+
+	return NoRegionAvailable
+}
+
+// NextReadable works as NextReadableMemoryRegion, but using the snapshot: it returns a memory region containing
+// address, or the next readable region after address in case addresss is not in a readable region. Contiguous
+// readable regions are merged into a single one.
+//
+// If there aren't more regions available the special value NoRegionAvailable is returned.
+func (m *MemoryMap) NextReadable(address uintptr) MemoryRegion {
+	i := m.index(address)
+	for ; i < len(m.Regions); i++ {
+		if (m.Regions[i].Access & Readable) == Readable {
+			break
+		}
+	}
+
+	if i == len(m.Regions) {
+		return NoRegionAvailable
+	}
+
+	region := m.Regions[i]
+	for i++; i < len(m.Regions); i++ {
+		next := m.Regions[i]
+		if (next.Access&Readable) != Readable || next.Address != region.Address+uintptr(region.Size) {
+			break
+		}
+
+		region.Size += next.Size
+	}
+
+	return region
+}
+
+// HasAccess returns true if all the memory from address to address+size is mapped with at least the given access.
+func (m *MemoryMap) HasAccess(address uintptr, size uint, access Access) bool {
+	end := address + uintptr(size)
+	for i := m.index(address); address < end; i++ {
+		if i == len(m.Regions) {
+			return false
+		}
+
+		region := m.Regions[i]
+		if region.Address > address || (region.Access&access) != access {
+			return false
+		}
+
+		address = region.Address + uintptr(region.Size)
+	}
+
+	return true
+}
+
+// Each calls fn with every region of the MemoryMap, in order, starting with the one at or after address. If fn
+// returns false the iteration stops.
+func (m *MemoryMap) Each(address uintptr, fn func(region MemoryRegion) (keepIterating bool)) {
+	for i := m.index(address); i < len(m.Regions); i++ {
+		if !fn(m.Regions[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package memaccess
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/polyverse/masche/process"
+)
+
+// DefaultParallelBufSize is the size of the buffer of each worker of ParallelWalkMemory when none is given.
+const DefaultParallelBufSize = 64 * 1024
+
+// ParallelWalkOptions configures how ParallelWalkMemory reads the memory.
+type ParallelWalkOptions struct {
+	// Workers is the amount of goroutines reading the memory and calling the walk function. If it's 0,
+	// runtime.NumCPU() workers are used.
+	Workers int
+	// BufSize is the size of the buffer of each worker, and so the maximum size of the buffers passed to the walk
+	// function. If it's 0, DefaultParallelBufSize is used.
+	BufSize uint
+	// MemoryBudget limits the memory used by the buffers of all the workers: if Workers*BufSize is bigger than it,
+	// fewer workers are used. If it's 0 there is no limit.
+	MemoryBudget uint
+}
+
+// workers returns the amount of workers and the size of their buffers.
+func (o ParallelWalkOptions) workers() (workers int, bufSize uint, err error) {
+	workers = o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	bufSize = o.BufSize
+	if bufSize == 0 {
+		bufSize = DefaultParallelBufSize
+	}
+
+	if o.MemoryBudget > 0 {
+		if o.MemoryBudget < bufSize {
+			return 0, 0, fmt.Errorf("The memory budget (%d bytes) is smaller than the buffer size (%d bytes)",
+				o.MemoryBudget, bufSize)
+		}
+
+		if uint(workers) > o.MemoryBudget/bufSize {
+			workers = int(o.MemoryBudget / bufSize)
+		}
+	}
+
+	return workers, bufSize, nil
+}
+
+// pieceChunks is the amount of chunks of memory in each piece of work given to the workers of ParallelWalkMemory.
+const pieceChunks = 16
+
+// memoryPiece is a range of contiguous readable memory walked by one of the workers of ParallelWalkMemory.
+type memoryPiece struct {
+	start uintptr
+	end   uintptr
+}
+
+// ParallelWalkMemory works as WalkMemory, but the memory is split in pieces that are read by many workers at the
+// same time, each one with its own buffer.
+//
+// walkFn is called as in WalkMemory for each chunk of memory, but concurrently from the different workers, so it must
+// be safe to call it from many goroutines and the chunks are not passed in address order. If walkFn returns false all
+// the workers stop, after the calls already in progress return.
+func ParallelWalkMemory(p process.Process, startAddress uintptr, opts ParallelWalkOptions, walkFn WalkFunc) (
+	harderror error, softerrors []error) {
+
+	return ParallelWalkMemoryContext(context.Background(), p, startAddress, opts, walkFn)
+}
+
+// ParallelWalkMemoryContext works as ParallelWalkMemory, but it stops when ctx is done, as WalkMemoryContext does.
+// In that case, the Address of the *CanceledError is the first one that wasn't walked: all the memory before it was,
+// but some memory after it may have been walked too.
+func ParallelWalkMemoryContext(ctx context.Context, p process.Process, startAddress uintptr,
+	opts ParallelWalkOptions, walkFn WalkFunc) (harderror error, softerrors []error) {
+
+	workers, bufSize, harderror := opts.workers()
+	if harderror != nil {
+		return
+	}
+
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Err: err, Address: startAddress}, nil
+	}
+
+	m, harderror, softerrors := ReadMemoryMap(p)
+	if harderror != nil {
+		return
+	}
+
+	// done is closed when the workers must stop, because walkFn returned false, the context is done or there was a
+	// hard error.
+	done := make(chan struct{})
+	pieces := make(chan memoryPiece)
+
+	var mtx sync.Mutex
+	var canceled *CanceledError
+	stop := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if canceledErr, ok := err.(*CanceledError); ok {
+			if canceled == nil || canceledErr.Address < canceled.Address {
+				canceled = canceledErr
+			}
+		} else if err != nil && harderror == nil {
+			harderror = err
+		}
+
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, bufSize)
+			for piece := range pieces {
+				stopped := false
+				err, serrs := walkMemory(p, m, piece.start, piece.end, buf,
+					func(address uintptr, buf []byte) (keepSearching bool) {
+						if err := ctx.Err(); err != nil {
+							stop(&CanceledError{Err: err, Address: address})
+							stopped = true
+							return false
+						}
+
+						select {
+						case <-done:
+							// Another worker stopped the walk, so this piece won't be walked entirely.
+							stop(&CanceledError{Err: context.Canceled, Address: address})
+							stopped = true
+							return false
+						default:
+						}
+
+						if !walkFn(address, buf) {
+							stop(nil)
+							stopped = true
+							return false
+						}
+						return true
+					})
+
+				mtx.Lock()
+				softerrors = append(softerrors, serrs...)
+				mtx.Unlock()
+
+				if err != nil {
+					stop(err)
+				}
+				if err != nil || stopped {
+					return
+				}
+			}
+		}()
+	}
+
+	// Split the readable memory in pieces of at most pieceChunks chunks, and give them to the workers until there
+	// are no more or they must stop.
+	pieceSize := uintptr(bufSize) * pieceChunks
+	region := nextReadableRegionFrom(m, startAddress)
+producer:
+	for region != NoRegionAvailable {
+		piece := memoryPiece{start: region.Address, end: region.Address + uintptr(region.Size)}
+		if piece.end-piece.start > pieceSize {
+			piece.end = piece.start + pieceSize
+		}
+
+		select {
+		case pieces <- piece:
+		case <-done:
+			// The pieces from this one on won't be walked.
+			stop(&CanceledError{Err: context.Canceled, Address: piece.start})
+			break producer
+		}
+
+		region = nextReadableRegionFrom(m, piece.end)
+	}
+	close(pieces)
+	wg.Wait()
+
+	// The memory may have been read from a new process with the same pid, which is checked once for the whole walk.
+	// This function is implemented by the OS-specific checkIdentity function.
+	if err := checkIdentity(p); err != nil {
+		return err, softerrors
+	}
+
+	if harderror != nil || canceled == nil {
+		return
+	}
+
+	// The workers also stop when walkFn returns false, which is not a cancellation.
+	if err := ctx.Err(); err != nil {
+		canceled.Err = err
+		return canceled, softerrors
+	}
+	return
+}
@@ -0,0 +1,266 @@
+package memaccess
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/polyverse/masche/common"
+	"github.com/polyverse/masche/process"
+)
+
+// MemoryBackend selects how the memory of a process is read and written on Linux.
+type MemoryBackend int32
+
+const (
+	// AutoBackend uses process_vm_readv(2) and process_vm_writev(2) if the kernel supports them and we are allowed
+	// to use them, falling back to /proc/<pid>/mem otherwise. This is the default.
+	AutoBackend MemoryBackend = iota
+	// ProcMemBackend reads and writes the memory through /proc/<pid>/mem.
+	ProcMemBackend
+	// ProcessVMBackend reads and writes the memory with process_vm_readv(2) and process_vm_writev(2), which allow
+	// transferring many chunks of memory in a single system call.
+	ProcessVMBackend
+)
+
+func (b MemoryBackend) String() string {
+	switch b {
+	case AutoBackend:
+		return "auto"
+	case ProcMemBackend:
+		return "/proc/<pid>/mem"
+	case ProcessVMBackend:
+		return "process_vm_readv/process_vm_writev"
+	}
+	return fmt.Sprintf("MemoryBackend(%d)", int32(b))
+}
+
+var (
+	currentBackend = int32(AutoBackend)
+
+	// processVMUnavailable is set once the kernel reports it doesn't implement process_vm_readv/writev.
+	processVMUnavailable int32
+)
+
+// SetBackend changes the backend used by CopyMemory, CopyMemoryVec, WriteMemory and the functions built on them. It's
+// safe to call it concurrently with reads and writes.
+func SetBackend(b MemoryBackend) {
+	atomic.StoreInt32(&currentBackend, int32(b))
+}
+
+// GetBackend returns the backend set with SetBackend.
+func GetBackend() MemoryBackend {
+	return MemoryBackend(atomic.LoadInt32(&currentBackend))
+}
+
+// iovMax is the maximum amount of iovecs a single process_vm_readv/writev call accepts (IOV_MAX).
+const iovMax = 1024
+
+// iovec is the Go representation of struct iovec. We don't use syscall.Iovec because its base is a *byte, and the
+// remote iovecs point to the other process' address space.
+type iovec struct {
+	base uintptr
+	len  uintptr
+}
+
+// useProcessVM returns true if process_vm_readv/writev should be tried with the current backend.
+func useProcessVM() bool {
+	switch GetBackend() {
+	case ProcMemBackend:
+		return false
+	case ProcessVMBackend:
+		return true
+	}
+	return atomic.LoadInt32(&processVMUnavailable) == 0
+}
+
+// fallbackFromProcessVM returns true if a process_vm_readv/writev error means that the memory must be accessed
+// through /proc/<pid>/mem instead. This only happens with AutoBackend.
+func fallbackFromProcessVM(err error) bool {
+	if GetBackend() != AutoBackend {
+		return false
+	}
+
+	switch err {
+	case syscall.ENOSYS:
+		atomic.StoreInt32(&processVMUnavailable, 1)
+		return true
+	case syscall.EPERM:
+		// The mem file may have been opened when we still had the permissions to do it.
+		return true
+	}
+	return false
+}
+
+// processVMReadv reads the memory of the process with the given pid into the buffers of vecs with a single
+// process_vm_readv call. vecs can't have more than iovMax elements.
+//
+// The kernel stops at the first chunk that can't be read, so n is the amount of bytes read in order.
+func processVMReadv(pid int, vecs []MemoryVec) (n int, err error) {
+	return processVMTransfer(sysProcessVMReadv, pid, vecs)
+}
+
+// processVMWritev works as processVMReadv, but writing the buffers of vecs into the process memory with
+// process_vm_writev.
+func processVMWritev(pid int, vecs []MemoryVec) (n int, err error) {
+	return processVMTransfer(sysProcessVMWritev, pid, vecs)
+}
+
+// processVMTransfer implements processVMReadv and processVMWritev, trap is the system call to use.
+func processVMTransfer(trap uintptr, pid int, vecs []MemoryVec) (n int, err error) {
+	local := make([]iovec, 0, len(vecs))
+	remote := make([]iovec, 0, len(vecs))
+	for _, vec := range vecs {
+		if len(vec.Buffer) == 0 {
+			continue
+		}
+		local = append(local, iovec{base: uintptr(unsafe.Pointer(&vec.Buffer[0])), len: uintptr(len(vec.Buffer))})
+		remote = append(remote, iovec{base: vec.Address, len: uintptr(len(vec.Buffer))})
+	}
+
+	if len(local) == 0 {
+		return 0, nil
+	}
+
+	r, _, errno := syscall.Syscall6(trap, uintptr(pid),
+		uintptr(unsafe.Pointer(&local[0])), uintptr(len(local)),
+		uintptr(unsafe.Pointer(&remote[0])), uintptr(len(remote)), 0)
+	runtime.KeepAlive(vecs)
+	runtime.KeepAlive(local)
+	runtime.KeepAlive(remote)
+
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func copyMemoryVec(p process.Process, vecs []MemoryVec) (copied []int, harderror error, softerrors []error) {
+	if !useProcessVM() {
+		return copyMemoryVecSequentially(p, vecs)
+	}
+
+	copied = make([]int, len(vecs))
+	softerrors = make([]error, 0)
+	for start := 0; start < len(vecs); {
+		end := start + iovMax
+		if end > len(vecs) {
+			end = len(vecs)
+		}
+
+		var cause error
+		n, err := processVMReadv(p.Pid(), vecs[start:end])
+		if err != nil {
+			if fallbackFromProcessVM(err) {
+				rest, harderror, serrs := copyMemoryVecSequentially(p, vecs[start:])
+				copy(copied[start:], rest)
+				return copied, harderror, append(softerrors, serrs...)
+			}
+
+			if err == syscall.ESRCH {
+				if err := process.CheckIdentity(p); err != nil {
+					return copied, err, softerrors
+				}
+				harderror = &common.MemoryError{Pid: p.Pid(), Address: vecs[start].Address,
+					Length: len(vecs[start].Buffer), Err: err}
+				return copied, harderror, softerrors
+			}
+
+			// Nothing could be read from the first chunk.
+			n, cause = 0, err
+		}
+
+		i := start
+		for ; i < end && n >= len(vecs[i].Buffer); i++ {
+			copied[i] = len(vecs[i].Buffer)
+			n -= len(vecs[i].Buffer)
+		}
+
+		if i == end {
+			start = end
+			continue
+		}
+
+		// The i-th chunk couldn't be read entirely, so the kernel didn't read the following ones. Reading the rest of
+		// it tells why, then we continue with the next one.
+		if cause == nil {
+			n, cause = processVMReadFull(p.Pid(), vecs[i], n)
+		}
+		copied[i] = n
+		if n < len(vecs[i].Buffer) {
+			softerrors = append(softerrors, &common.ShortReadError{Address: vecs[i].Address,
+				Length: len(vecs[i].Buffer), Read: n, Err: cause})
+		}
+		start = i + 1
+	}
+
+	// The memory may have been read from a new process with the same pid.
+	if err := process.CheckIdentity(p); err != nil {
+		return copied, err, softerrors
+	}
+	return copied, nil, softerrors
+}
+
+// copyMemoryWithProcessVMReadv implements copyMemory with process_vm_readv. If fallback is true the memory must be
+// read from /proc/<pid>/mem instead.
+func copyMemoryWithProcessVMReadv(p process.Process, address uintptr, buffer []byte) (fallback bool,
+	harderror error) {
+
+	n, err := processVMReadv(p.Pid(), []MemoryVec{{Address: address, Buffer: buffer}})
+	if err != nil {
+		if fallbackFromProcessVM(err) {
+			return true, nil
+		}
+		return false, &common.MemoryError{Pid: p.Pid(), Address: address, Length: len(buffer), Err: err}
+	}
+
+	if n != len(buffer) {
+		n, err = processVMReadFull(p.Pid(), MemoryVec{Address: address, Buffer: buffer}, n)
+		if n != len(buffer) {
+			return false, &common.ShortReadError{Address: address, Length: len(buffer), Read: n, Err: err}
+		}
+	}
+
+	return false, nil
+}
+
+// processVMReadFull reads the buffer of vec from its n-th byte on, which is needed after a short read to find out
+// why the kernel stopped: it only reports an error when nothing can be read. It returns how many bytes of the
+// buffer were read in total, and the error that stopped the read if it wasn't read entirely.
+func processVMReadFull(pid int, vec MemoryVec, n int) (int, error) {
+	for n < len(vec.Buffer) {
+		r, err := processVMReadv(pid, []MemoryVec{{Address: vec.Address + uintptr(n), Buffer: vec.Buffer[n:]}})
+		if err != nil {
+			return n, err
+		}
+		if r == 0 {
+			break
+		}
+		n += r
+	}
+	return n, nil
+}
+
+// writeMemoryWithProcessVMWritev implements writeMemory with process_vm_writev. If fallback is true the memory must be
+// written through /proc/<pid>/mem instead.
+func writeMemoryWithProcessVMWritev(p process.Process, address uintptr, data []byte) (fallback bool, written int,
+	harderror error) {
+
+	n, err := processVMWritev(p.Pid(), []MemoryVec{{Address: address, Buffer: data}})
+	if err != nil {
+		if fallbackFromProcessVM(err) {
+			return true, 0, nil
+		}
+		return false, 0, &common.MemoryError{Pid: p.Pid(), Write: true, Address: address, Length: len(data), Err: err}
+	}
+
+	if n != len(data) {
+		harderror = &common.MemoryError{Pid: p.Pid(), Write: true, Address: address, Length: len(data),
+			Err: &common.ShortWriteError{Address: address, Length: len(data), Written: n}}
+		return false, n, harderror
+	}
+
+	return false, n, nil
+}
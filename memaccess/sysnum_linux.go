@@ -0,0 +1,11 @@
+//go:build linux && !amd64 && !386
+// +build linux,!amd64,!386
+
+package memaccess
+
+import "syscall"
+
+const (
+	sysProcessVMReadv  = syscall.SYS_PROCESS_VM_READV
+	sysProcessVMWritev = syscall.SYS_PROCESS_VM_WRITEV
+)
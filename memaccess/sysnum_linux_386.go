@@ -0,0 +1,7 @@
+package memaccess
+
+// The syscall package doesn't define these for 386.
+const (
+	sysProcessVMReadv  = 347
+	sysProcessVMWritev = 348
+)
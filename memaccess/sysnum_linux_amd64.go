@@ -0,0 +1,7 @@
+package memaccess
+
+// The syscall package doesn't define these for amd64.
+const (
+	sysProcessVMReadv  = 310
+	sysProcessVMWritev = 311
+)
@@ -0,0 +1,185 @@
+package memrules
+
+import (
+	"strings"
+
+	"github.com/polyverse/masche/memaccess"
+)
+
+// evalContext has what a condition needs to be evaluated for a region.
+type evalContext struct {
+	region memaccess.MemoryRegion
+	// matches has the matches in region of each string of the rule, by identifier.
+	matches map[string][]StringMatch
+}
+
+// boolExpr is a condition, or part of it, that evaluates to a boolean.
+type boolExpr interface {
+	eval(ctx *evalContext) bool
+}
+
+// intExpr is part of a condition that evaluates to an integer. If the value is undefined, like the address of a
+// match that doesn't exist, ok is false.
+type intExpr interface {
+	eval(ctx *evalContext) (value int64, ok bool)
+}
+
+type boolLiteral bool
+
+func (e boolLiteral) eval(ctx *evalContext) bool {
+	return bool(e)
+}
+
+type andExpr struct {
+	left, right boolExpr
+}
+
+func (e andExpr) eval(ctx *evalContext) bool {
+	return e.left.eval(ctx) && e.right.eval(ctx)
+}
+
+type orExpr struct {
+	left, right boolExpr
+}
+
+func (e orExpr) eval(ctx *evalContext) bool {
+	return e.left.eval(ctx) || e.right.eval(ctx)
+}
+
+type notExpr struct {
+	expr boolExpr
+}
+
+func (e notExpr) eval(ctx *evalContext) bool {
+	return !e.expr.eval(ctx)
+}
+
+// stringRef is true if the string was found in the region.
+type stringRef string
+
+func (e stringRef) eval(ctx *evalContext) bool {
+	return len(ctx.matches[string(e)]) > 0
+}
+
+// ofExpr is true if at least min of the strings were found in the region. A negative min means all of them.
+type ofExpr struct {
+	min         int
+	identifiers []string
+}
+
+func (e ofExpr) eval(ctx *evalContext) bool {
+	min := e.min
+	if min < 0 {
+		min = len(e.identifiers)
+	}
+
+	found := 0
+	for _, identifier := range e.identifiers {
+		if len(ctx.matches[identifier]) > 0 {
+			found++
+		}
+	}
+	return found >= min
+}
+
+type intLiteral int64
+
+func (e intLiteral) eval(ctx *evalContext) (int64, bool) {
+	return int64(e), true
+}
+
+// countExpr is the amount of matches of a string in the region (#a).
+type countExpr string
+
+func (e countExpr) eval(ctx *evalContext) (int64, bool) {
+	return int64(len(ctx.matches[string(e)])), true
+}
+
+// addressExpr is the address of the index-th match of a string in the region (@a[index]), starting from 1.
+type addressExpr struct {
+	identifier string
+	index      intExpr
+}
+
+func (e addressExpr) eval(ctx *evalContext) (int64, bool) {
+	index, ok := e.index.eval(ctx)
+	matches := ctx.matches[e.identifier]
+	if !ok || index < 1 || index > int64(len(matches)) {
+		return 0, false
+	}
+	return int64(matches[index-1].Address), true
+}
+
+type comparison int
+
+const (
+	equal comparison = iota
+	notEqual
+	less
+	lessOrEqual
+	greater
+	greaterOrEqual
+	contains
+)
+
+// intComparison compares two integers. It's false if any of them is undefined.
+type intComparison struct {
+	op          comparison
+	left, right intExpr
+}
+
+func (e intComparison) eval(ctx *evalContext) bool {
+	left, ok := e.left.eval(ctx)
+	if !ok {
+		return false
+	}
+	right, ok := e.right.eval(ctx)
+	if !ok {
+		return false
+	}
+
+	switch e.op {
+	case equal:
+		return left == right
+	case notEqual:
+		return left != right
+	case less:
+		return left < right
+	case lessOrEqual:
+		return left <= right
+	case greater:
+		return left > right
+	case greaterOrEqual:
+		return left >= right
+	}
+	return false
+}
+
+// regionPredicate compares an attribute of the region (access, kind or path) with a string.
+type regionPredicate struct {
+	attribute string
+	op        comparison
+	value     string
+}
+
+func (e regionPredicate) eval(ctx *evalContext) bool {
+	var attribute string
+	switch e.attribute {
+	case "access":
+		attribute = regionAccess(ctx.region)
+	case "kind":
+		attribute = regionKind(ctx.region)
+	case "path":
+		attribute = ctx.region.Kind
+	}
+
+	switch e.op {
+	case equal:
+		return attribute == e.value
+	case notEqual:
+		return attribute != e.value
+	case contains:
+		return strings.Contains(attribute, e.value)
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+// This package evaluates YARA-like rules against the memory of a process.
+//
+// Rules are written in a subset of the YARA language:
+//
+//	rule suspicious_shellcode {
+//	    meta:
+//	        author = "someone"
+//	    strings:
+//	        $text = "cmd.exe" nocase wide ascii
+//	        $hex = { 90 90 ?? E8 [2-4] (C3 | CC) }
+//	        $re = /https?:\/\/[a-z.]+/i
+//	    condition:
+//	        2 of ($text, $hex, $re) and #hex > 1 and access == "rwx" and kind == "anonymous"
+//	}
+//
+// Conditions are evaluated independently for each memory region of the process, so all the strings referenced by a
+// condition must be found in the same region. Besides the YARA boolean operators, string references ($a), counts (#a),
+// addresses of the matches (@a[i]) and the "of" sets (any of them, 2 of ($a*), ...), the conditions can use these
+// region predicates, which compare strings with ==, != or contains:
+//   - access: the region permissions, as "rwx" with a - for the missing ones.
+//   - kind: one of "anonymous", "heap", "stack" or "file", or the name of other pseudo-paths like "vdso".
+//   - path: the file or pseudo-path backing the region.
+package memrules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/polyverse/masche/memaccess"
+	"github.com/polyverse/masche/memsearch"
+	"github.com/polyverse/masche/process"
+)
+
+// DefaultMaxMatchesPerString is the MaxMatchesPerString of the rulesets returned by Compile.
+const DefaultMaxMatchesPerString = 10000
+
+// Ruleset is a list of compiled rules.
+type Ruleset struct {
+	Rules []*Rule
+
+	// MaxMatchesPerString limits the amount of matches recorded for each string of a rule. Once it's reached the rest
+	// of the matches of that string are ignored, and a soft error is returned. If it's not positive
+	// DefaultMaxMatchesPerString is used. It must not be changed while the ruleset is used by a scan.
+	MaxMatchesPerString int
+}
+
+// Rule is a compiled rule.
+type Rule struct {
+	Name string
+	Meta map[string]string
+
+	strings   []*stringDef
+	condition boolExpr
+}
+
+type stringKind int
+
+const (
+	textString stringKind = iota
+	hexString
+	regexpString
+)
+
+// stringDef is a string defined in the strings section of a rule.
+type stringDef struct {
+	identifier string
+	kind       stringKind
+
+	// text, with the modifiers used with it, is used by textString
+	text   string
+	nocase bool
+	ascii  bool
+	wide   bool
+
+	hex    *memsearch.HexString
+	regexp *regexpDef
+}
+
+// StringMatch is a match of one of the strings of a rule.
+type StringMatch struct {
+	// Identifier is the identifier of the string in the rule, like $a.
+	Identifier string
+	Address    uintptr
+	Data       []byte
+}
+
+// RuleMatch is a rule whose condition is true for a memory region of a process.
+type RuleMatch struct {
+	Rule   string
+	Region memaccess.MemoryRegion
+	// Strings has the matches in Region of all the strings of the rule, sorted by address.
+	Strings []StringMatch
+}
+
+// Compile parses the rules in src.
+func Compile(src string) (*Ruleset, error) {
+	rules, err := parseRules(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ruleset{Rules: rules, MaxMatchesPerString: DefaultMaxMatchesPerString}, nil
+}
+
+// MustCompile is like Compile but panics if the rules cannot be parsed.
+func MustCompile(src string) *Ruleset {
+	rs, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// searchTarget is a string of a rule to be searched for.
+type searchTarget struct {
+	rule int
+	def  *stringDef
+
+	// byRegion has the matches found, keyed by the address of the region containing them.
+	byRegion map[uintptr][]StringMatch
+	count    int
+	// maxCount is the MaxMatchesPerString of the ruleset, and truncated is set once a match is ignored because of it.
+	maxCount  int
+	truncated bool
+}
+
+// add records a match of the target, returning false if it was ignored because maxCount was reached.
+func (t *searchTarget) add(match memsearch.Match) bool {
+	if t.count >= t.maxCount {
+		t.truncated = true
+		return false
+	}
+	t.count++
+
+	if match.Region == memaccess.NoRegionAvailable {
+		return true
+	}
+
+	t.byRegion[match.Region.Address] = append(t.byRegion[match.Region.Address],
+		StringMatch{Identifier: t.def.identifier, Address: match.Address, Data: match.Data})
+	return true
+}
+
+// Scan evaluates the rules of rs against each of the memory regions of p. The memory is searched once for all the
+// text strings of the rules, and once for each hex string and regexp.
+func Scan(p process.Process, rs *Ruleset) (matches []RuleMatch, harderror error, softerrors []error) {
+	return ScanContext(context.Background(), p, rs)
+}
+
+// ScanContext works as Scan, but it stops when ctx is done, returning a *memaccess.CanceledError as hard error. As
+// the rules are evaluated once all the strings were searched for, no matches are returned in that case.
+func ScanContext(ctx context.Context, p process.Process, rs *Ruleset) (matches []RuleMatch, harderror error,
+	softerrors []error) {
+
+	m, harderror, softerrors := memaccess.ReadMemoryMap(p)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	maxCount := rs.MaxMatchesPerString
+	if maxCount <= 0 {
+		maxCount = DefaultMaxMatchesPerString
+	}
+
+	targets := make([]*searchTarget, 0)
+	for i, rule := range rs.Rules {
+		for _, def := range rule.strings {
+			targets = append(targets, &searchTarget{rule: i, def: def, byRegion: make(map[uintptr][]StringMatch),
+				maxCount: maxCount})
+		}
+	}
+
+	harderror, serrs := searchTargets(ctx, p, targets)
+	softerrors = append(softerrors, serrs...)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	for _, target := range targets {
+		if target.truncated {
+			softerrors = append(softerrors, fmt.Errorf("Rule %s: string %s has more than %d matches, the rest "+
+				"were ignored", rs.Rules[target.rule].Name, target.def.identifier, maxCount))
+		}
+	}
+
+	matches = make([]RuleMatch, 0)
+	for i, rule := range rs.Rules {
+		ruleTargets := make([]*searchTarget, 0, len(rule.strings))
+		for _, target := range targets {
+			if target.rule == i {
+				ruleTargets = append(ruleTargets, target)
+			}
+		}
+
+		for _, region := range m.Regions {
+			evalCtx := &evalContext{region: region, matches: make(map[string][]StringMatch)}
+			all := make([]StringMatch, 0)
+			for _, target := range ruleTargets {
+				found := target.byRegion[region.Address]
+				evalCtx.matches[target.def.identifier] = found
+				all = append(all, found...)
+			}
+
+			if !rule.condition.eval(evalCtx) {
+				continue
+			}
+
+			sort.SliceStable(all, func(i, j int) bool {
+				return all[i].Address < all[j].Address
+			})
+			matches = append(matches, RuleMatch{Rule: rule.Name, Region: region, Strings: all})
+		}
+	}
+
+	return matches, nil, softerrors
+}
+
+// searchTargets searches for all the targets in the memory of p. All the text strings are searched for at once with
+// a memsearch.Matcher.
+func searchTargets(ctx context.Context, p process.Process, targets []*searchTarget) (harderror error,
+	softerrors []error) {
+
+	softerrors = make([]error, 0)
+
+	patterns := make([]memsearch.Pattern, 0)
+	patternTargets := make([]*searchTarget, 0)
+	for _, target := range targets {
+		def := target.def
+		switch def.kind {
+		case textString:
+			for _, pattern := range def.patterns() {
+				patterns = append(patterns, pattern)
+				patternTargets = append(patternTargets, target)
+			}
+
+		case hexString:
+			err, serrs := memsearch.FindAllHexStringMatchesFuncContext(ctx, p, 0, def.hex,
+				func(match memsearch.Match) (keepSearching bool) {
+					return target.add(match)
+				})
+			softerrors = append(softerrors, serrs...)
+			if err != nil {
+				return err, softerrors
+			}
+
+		case regexpString:
+			err, serrs := memsearch.FindAllRegexpMatchesFuncContext(ctx, p, 0, def.regexp.compiled,
+				func(match memsearch.Match) (keepSearching bool) {
+					return target.add(match)
+				})
+			softerrors = append(softerrors, serrs...)
+			if err != nil {
+				return err, softerrors
+			}
+		}
+	}
+
+	if len(patterns) == 0 {
+		return nil, softerrors
+	}
+
+	matcher, err := memsearch.NewMatcher(patterns...)
+	if err != nil {
+		return err, softerrors
+	}
+
+	err, serrs := memsearch.FindAllPatternsFuncContext(ctx, p, 0, matcher,
+		func(match memsearch.PatternMatch) (keepSearching bool) {
+			patternTargets[match.Pattern].add(match.Match)
+			return true
+		})
+	softerrors = append(softerrors, serrs...)
+	return err, softerrors
+}
+
+// patterns returns the memsearch patterns for a text string with its modifiers.
+func (def *stringDef) patterns() []memsearch.Pattern {
+	patterns := make([]memsearch.Pattern, 0, 2)
+	if def.ascii || !def.wide {
+		patterns = append(patterns, memsearch.StringPattern(def.identifier, def.text))
+	}
+	if def.wide {
+		patterns = append(patterns, memsearch.UTF16LEPattern(def.identifier, def.text))
+	}
+
+	for i := range patterns {
+		patterns[i].NoCase = def.nocase
+	}
+	return patterns
+}
+
+// regionAccess returns the access of a region in the form used by the access predicate.
+func regionAccess(region memaccess.MemoryRegion) string {
+	access := []byte("---")
+	if (region.Access & memaccess.Readable) != 0 {
+		access[0] = 'r'
+	}
+	if (region.Access & memaccess.Writable) != 0 {
+		access[1] = 'w'
+	}
+	if (region.Access & memaccess.Executable) != 0 {
+		access[2] = 'x'
+	}
+	return string(access)
+}
+
+// regionKind returns the kind of a region in the form used by the kind predicate.
+func regionKind(region memaccess.MemoryRegion) string {
+	kind := region.Kind
+	switch {
+	case kind == "" || strings.HasPrefix(kind, "[anon:"):
+		return "anonymous"
+	case kind == "[heap]":
+		return "heap"
+	case strings.HasPrefix(kind, "[stack"):
+		return "stack"
+	case strings.HasPrefix(kind, "["):
+		return strings.Trim(kind, "[]")
+	}
+	return "file"
+}
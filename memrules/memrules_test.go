@@ -0,0 +1,221 @@
+package memrules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/polyverse/masche/process"
+	"github.com/polyverse/masche/test"
+)
+
+func TestCompile(t *testing.T) {
+	rs, err := Compile(`
+		// A comment
+		rule first {
+			meta:
+				author = "someone"
+				version = 2
+			strings:
+				$a = "text\x41\"" nocase wide ascii
+				$b1 = { DE AD ?? EF [1-2] (00 | 01) }
+				$b2 = /a\/b[0-9]+/is
+			condition:
+				/* another comment */
+				($a or not $b1) and 2 of ($b*) and #a > 0x10 and @b2[2] != @a and access == "r-x"
+		}
+
+		rule second {
+			condition:
+				kind != "heap" or path contains "libc"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs.Rules) != 2 || rs.Rules[0].Name != "first" || rs.Rules[1].Name != "second" {
+		t.Fatalf("Unexpected rules %+v", rs.Rules)
+	}
+
+	first := rs.Rules[0]
+	if first.Meta["author"] != "someone" || first.Meta["version"] != "2" {
+		t.Errorf("Unexpected meta %v", first.Meta)
+	}
+
+	if len(first.strings) != 3 {
+		t.Fatalf("Found %d strings, expected 3", len(first.strings))
+	}
+
+	a := first.strings[0]
+	if a.kind != textString || a.text != "textA\"" || !a.nocase || !a.wide || !a.ascii {
+		t.Errorf("Unexpected text string %+v", a)
+	}
+	if first.strings[1].kind != hexString || first.strings[1].hex.MinLen() != 6 {
+		t.Errorf("Unexpected hex string %+v", first.strings[1])
+	}
+
+	re := first.strings[2]
+	if re.kind != regexpString || !re.regexp.compiled.MatchString("A/B12") || re.regexp.source != `/a\/b[0-9]+/is` {
+		t.Errorf("Unexpected regexp %+v", re.regexp)
+	}
+
+	var invalid = []string{
+		`rule`,
+		`rule a { condition: }`,
+		`rule a { condition: true } rule a { condition: false }`,
+		`rule a { strings: $a = "x" $a = "y" condition: $a }`,
+		`rule a { strings: $a = "x" condition: $b }`,
+		`rule a { strings: $a = "" condition: $a }`,
+		`rule a { strings: $a = "x condition: $a }`,
+		`rule a { strings: $a = { DE [2] } condition: $a }`,
+		`rule a { strings: $a = /(/ condition: $a }`,
+		`rule a { strings: $a = "x" condition: 2 of them }`,
+		`rule a { strings: $a = "x" condition: any of ($b*) }`,
+		`rule a { strings: $a = "x" condition: $a* }`,
+		`rule a { condition: any of them }`,
+		`rule a { condition: access contains 1 }`,
+		`rule a { condition: 1 }`,
+		`rule a { strings: $a = "x" condition: #a }`,
+		`rule a { strings: $a = "x" condition: $a and }`,
+		`rule a { strings: $a = "x" condition: ($a }`,
+		`rule a { condition: true`,
+	}
+
+	for _, src := range invalid {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%q should be invalid", src)
+		}
+	}
+}
+
+func TestScanOtherProcess(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	rs := MustCompile(`
+		rule regexp_string {
+			strings:
+				$text = "UN DIA VI" nocase
+				$re = /vestida de [a-z]+/
+			condition:
+				all of them and @re[1] > @text and path contains "test"
+		}
+
+		rule in_heap {
+			strings:
+				$heap = { 0B 0E 0B 0E 0F 0E 00 }
+			condition:
+				$heap and kind == "heap" and access contains "rw"
+		}
+
+		rule in_stack {
+			strings:
+				$stack = { 0D 0E 0A 0D 0B 0E 0E 0F }
+			condition:
+				#stack >= 1 and kind == "stack"
+		}
+
+		rule not_present {
+			strings:
+				$a = "this string should generate a list of bytes not present in the process"
+			condition:
+				$a
+		}
+	`)
+
+	matches, err, softerrors := Scan(proc, rs)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]bool)
+	for _, match := range matches {
+		found[match.Rule] = true
+
+		if len(match.Strings) == 0 {
+			t.Errorf("Rule %s matched in %x without any string", match.Rule, match.Region.Address)
+		}
+
+		for _, s := range match.Strings {
+			if s.Address < match.Region.Address || s.Address+uintptr(len(s.Data)) >
+				match.Region.Address+uintptr(match.Region.Size) {
+				t.Errorf("Rule %s: string %s found at %x, out of the region %+v", match.Rule, s.Identifier,
+					s.Address, match.Region)
+			}
+		}
+
+		if match.Rule == "regexp_string" && !bytes.Equal(match.Strings[0].Data, []byte("Un dia vi")) {
+			t.Errorf("Rule %s: found %q first", match.Rule, match.Strings[0].Data)
+		}
+	}
+
+	for _, rule := range []string{"regexp_string", "in_heap", "in_stack"} {
+		if !found[rule] {
+			t.Errorf("Rule %s didn't match", rule)
+		}
+	}
+	if found["not_present"] {
+		t.Errorf("Rule not_present matched")
+	}
+}
+
+func TestMaxMatchesPerString(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	proc, err, softerrors := process.OpenFromPid(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	rs := MustCompile(`rule in_stack { strings: $stack = { 0D 0E 0A 0D 0B 0E 0E 0F } condition: $stack }`)
+	if rs.MaxMatchesPerString != DefaultMaxMatchesPerString {
+		t.Errorf("Expected a limit of %d matches and got %d", DefaultMaxMatchesPerString, rs.MaxMatchesPerString)
+	}
+
+	scan := func(max int) (count int, truncated bool) {
+		rs.MaxMatchesPerString = max
+		matches, err, softerrors := Scan(proc, rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range matches {
+			count += len(match.Strings)
+		}
+		for _, err := range softerrors {
+			truncated = truncated || strings.Contains(err.Error(), "has more than")
+		}
+		return count, truncated
+	}
+
+	count, truncated := scan(0)
+	if count < 2 || truncated {
+		t.Fatalf("Found %d matches, expected at least 2 without truncating them", count)
+	}
+
+	// Exactly as many matches as the limit aren't truncated.
+	if found, truncated := scan(count); found != count || truncated {
+		t.Errorf("Found %d of %d matches with a limit of %d, truncated: %v", found, count, count, truncated)
+	}
+	if found, truncated := scan(count - 1); found != count-1 || !truncated {
+		t.Errorf("Found %d of %d matches with a limit of %d, truncated: %v", found, count, count-1, truncated)
+	}
+}
@@ -0,0 +1,727 @@
+package memrules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/polyverse/masche/memsearch"
+)
+
+// regexpDef is a regexp string of a rule.
+type regexpDef struct {
+	source   string
+	compiled *regexp.Regexp
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokInt
+	tokStringID // $a, or $a* in sets
+	tokCount    // #a
+	tokAddress  // @a
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// value is the decoded value of a tokString, or the identifier of a tokStringID, tokCount or tokAddress
+	// including its $.
+	value string
+	pos   int
+}
+
+// parser is a recursive descent parser for rules. Tokens are read on demand because hex strings and regexps can
+// only be recognized by their context.
+type parser struct {
+	src string
+	pos int
+
+	// rule is the rule being parsed.
+	rule *Rule
+}
+
+func parseRules(src string) (rules []*Rule, err error) {
+	p := &parser{src: src}
+	names := make(map[string]bool)
+
+	rules = make([]*Rule, 0)
+	for p.peek().kind != tokEOF {
+		rule, err := p.parseRule()
+		if err != nil {
+			return nil, err
+		}
+
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Duplicated rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	line := strings.Count(p.src[:pos], "\n") + 1
+	return fmt.Errorf("Rules line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipSpaces skips spaces and comments.
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end == -1 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 1
+			}
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end == -1 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 4
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// lex reads the token at the current position, returning it with the position right after it.
+func (p *parser) lex() (tok token, end int, err error) {
+	p.skipSpaces()
+	start := p.pos
+	tok.pos = start
+	if start == len(p.src) {
+		return token{kind: tokEOF, pos: start}, start, nil
+	}
+
+	end = start + 1
+	c := p.src[start]
+	switch {
+	case c == '"':
+		return p.lexString()
+
+	case c == '$' || c == '#' || c == '@':
+		for end < len(p.src) && isIdentChar(p.src[end]) {
+			end++
+		}
+		if c == '$' && end < len(p.src) && p.src[end] == '*' {
+			end++
+		}
+		if end == start+1 && c != '$' {
+			return tok, end, p.errorf(start, "missing string identifier after %c", c)
+		}
+
+		tok.kind = map[byte]tokenKind{'$': tokStringID, '#': tokCount, '@': tokAddress}[c]
+		tok.value = "$" + p.src[start+1:end]
+
+	case '0' <= c && c <= '9':
+		for end < len(p.src) && isIdentChar(p.src[end]) {
+			end++
+		}
+		tok.kind = tokInt
+
+	case isIdentChar(c):
+		for end < len(p.src) && isIdentChar(p.src[end]) {
+			end++
+		}
+		tok.kind = tokIdent
+
+	default:
+		tok.kind = tokPunct
+		if end < len(p.src) && strings.Contains("=!<>", string(c)) && p.src[end] == '=' {
+			end++
+		} else if !strings.ContainsRune("{}()[],:=<>", rune(c)) {
+			return tok, end, p.errorf(start, "unexpected %q", c)
+		}
+	}
+
+	tok.text = p.src[start:end]
+	return tok, end, nil
+}
+
+// lexString reads a double quoted string at the current position.
+func (p *parser) lexString() (tok token, end int, err error) {
+	start := p.pos
+	var value strings.Builder
+	for end = start + 1; end < len(p.src); end++ {
+		c := p.src[end]
+		switch {
+		case c == '"':
+			return token{kind: tokString, text: p.src[start : end+1], value: value.String(), pos: start}, end + 1, nil
+		case c == '\n':
+			return tok, end, p.errorf(start, "unterminated string")
+		case c == '\\' && end+1 < len(p.src):
+			end++
+			switch p.src[end] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case 'x':
+				if end+2 >= len(p.src) {
+					return tok, end, p.errorf(start, "invalid escape sequence")
+				}
+				b, err := strconv.ParseUint(p.src[end+1:end+3], 16, 8)
+				if err != nil {
+					return tok, end, p.errorf(start, "invalid escape sequence \\x%s", p.src[end+1:end+3])
+				}
+				value.WriteByte(byte(b))
+				end += 2
+			default:
+				value.WriteByte(p.src[end])
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return tok, end, p.errorf(start, "unterminated string")
+}
+
+// peek returns the next token without consuming it. Lexing errors are returned as EOF tokens, the error will be
+// reported when the token is consumed.
+func (p *parser) peek() token {
+	pos := p.pos
+	tok, _, err := p.lex()
+	p.pos = pos
+	if err != nil {
+		return token{kind: tokEOF, pos: pos}
+	}
+	return tok
+}
+
+func (p *parser) next() (token, error) {
+	tok, end, err := p.lex()
+	if err != nil {
+		return tok, err
+	}
+	p.pos = end
+	return tok, nil
+}
+
+// isNext returns true if the next token is of the given kind and text.
+func (p *parser) isNext(kind tokenKind, text string) bool {
+	tok := p.peek()
+	return tok.kind == kind && tok.text == text
+}
+
+// expect consumes the next token, which must be of the given kind and, if text is not empty, text.
+func (p *parser) expect(kind tokenKind, text string) (token, error) {
+	tok, err := p.next()
+	if err != nil {
+		return tok, err
+	}
+	if tok.kind != kind || (text != "" && tok.text != text) {
+		if tok.kind == tokEOF {
+			return tok, p.errorf(tok.pos, "unexpected end of rules")
+		}
+		if text == "" {
+			text = map[tokenKind]string{tokIdent: "an identifier", tokString: "a string", tokInt: "a number",
+				tokStringID: "a string identifier"}[kind]
+		}
+		return tok, p.errorf(tok.pos, "expected %s and found %q", text, tok.text)
+	}
+	return tok, nil
+}
+
+func (p *parser) parseRule() (rule *Rule, err error) {
+	if _, err = p.expect(tokIdent, "rule"); err != nil {
+		return nil, err
+	}
+
+	name, err := p.expect(tokIdent, "")
+	if err != nil {
+		return nil, err
+	}
+	rule = &Rule{Name: name.text, Meta: make(map[string]string)}
+	p.rule = rule
+
+	if _, err = p.expect(tokPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	if p.isNext(tokIdent, "meta") {
+		p.next()
+		if _, err = p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		if err = p.parseMeta(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isNext(tokIdent, "strings") {
+		p.next()
+		if _, err = p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		if err = p.parseStrings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = p.expect(tokIdent, "condition"); err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(tokPunct, ":"); err != nil {
+		return nil, err
+	}
+
+	rule.condition, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(tokPunct, "}"); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (p *parser) parseMeta() error {
+	for p.peek().kind == tokIdent && !p.isNext(tokIdent, "strings") && !p.isNext(tokIdent, "condition") {
+		key, _ := p.next()
+		if _, err := p.expect(tokPunct, "="); err != nil {
+			return err
+		}
+
+		value, err := p.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case value.kind == tokString:
+			p.rule.Meta[key.text] = value.value
+		case value.kind == tokInt, value.kind == tokIdent && (value.text == "true" || value.text == "false"):
+			p.rule.Meta[key.text] = value.text
+		default:
+			return p.errorf(value.pos, "invalid value for meta %s", key.text)
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseStrings() error {
+	identifiers := make(map[string]bool)
+	for p.peek().kind == tokStringID {
+		identifier, _ := p.next()
+		if identifier.value == "$" || strings.HasSuffix(identifier.value, "*") {
+			return p.errorf(identifier.pos, "invalid string identifier %s", identifier.text)
+		}
+		if identifiers[identifier.value] {
+			return p.errorf(identifier.pos, "duplicated string %s", identifier.value)
+		}
+		identifiers[identifier.value] = true
+
+		if _, err := p.expect(tokPunct, "="); err != nil {
+			return err
+		}
+
+		def, err := p.parseStringValue()
+		if err != nil {
+			return err
+		}
+		def.identifier = identifier.value
+		p.rule.strings = append(p.rule.strings, def)
+	}
+	return nil
+}
+
+// parseStringValue parses the value of a string definition, with its modifiers.
+func (p *parser) parseStringValue() (def *stringDef, err error) {
+	p.skipSpaces()
+	if p.pos == len(p.src) {
+		return nil, p.errorf(p.pos, "unexpected end of rules")
+	}
+
+	start := p.pos
+	def = &stringDef{}
+	switch p.src[p.pos] {
+	case '"':
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.value == "" {
+			return nil, p.errorf(start, "empty string")
+		}
+		def.kind = textString
+		def.text = tok.value
+
+		for {
+			modifier := p.peek()
+			if modifier.kind != tokIdent || !(modifier.text == "nocase" || modifier.text == "ascii" ||
+				modifier.text == "wide") {
+				break
+			}
+			p.next()
+
+			switch modifier.text {
+			case "nocase":
+				def.nocase = true
+			case "ascii":
+				def.ascii = true
+			case "wide":
+				def.wide = true
+			}
+		}
+
+	case '{':
+		end := strings.IndexByte(p.src[start:], '}')
+		if end == -1 {
+			return nil, p.errorf(start, "unterminated hex string")
+		}
+		def.kind = hexString
+		def.hex, err = memsearch.CompileHexString(p.src[start : start+end+1])
+		if err != nil {
+			return nil, p.errorf(start, "%v", err)
+		}
+		p.pos = start + end + 1
+
+	case '/':
+		def.kind = regexpString
+		def.regexp, err = p.parseRegexp()
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, p.errorf(start, "expected a string, hex string or regexp")
+	}
+
+	return def, nil
+}
+
+// parseRegexp parses a regexp in the form /regexp/flags, where flags can be i (case insensitive) and s (. matches
+// \n).
+func (p *parser) parseRegexp() (*regexpDef, error) {
+	start := p.pos
+	var source strings.Builder
+	end := start + 1
+	for ; end < len(p.src) && p.src[end] != '/'; end++ {
+		if p.src[end] == '\n' {
+			break
+		}
+		if p.src[end] == '\\' && end+1 < len(p.src) && p.src[end+1] == '/' {
+			end++
+		} else if p.src[end] == '\\' && end+1 < len(p.src) {
+			source.WriteByte('\\')
+			end++
+		}
+		source.WriteByte(p.src[end])
+	}
+	if end >= len(p.src) || p.src[end] != '/' {
+		return nil, p.errorf(start, "unterminated regexp")
+	}
+
+	flags := ""
+	for end++; end < len(p.src) && (p.src[end] == 'i' || p.src[end] == 's'); end++ {
+		flags += string(p.src[end])
+	}
+	p.pos = end
+
+	expr := source.String()
+	if flags != "" {
+		expr = "(?" + flags + ")" + expr
+	}
+
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, p.errorf(start, "invalid regexp (%v)", err)
+	}
+	return &regexpDef{source: p.src[start:end], compiled: compiled}, nil
+}
+
+// hasString returns true if the rule being parsed has the given string.
+func (p *parser) hasString(identifier string) bool {
+	for _, def := range p.rule.strings {
+		if def.identifier == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// checkString returns an error if the rule being parsed doesn't have the string referenced by tok.
+func (p *parser) checkString(tok token) error {
+	if !p.hasString(tok.value) {
+		return p.errorf(tok.pos, "undefined string %s", tok.value)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (boolExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isNext(tokIdent, "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (boolExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isNext(tokIdent, "and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (boolExpr, error) {
+	if p.isNext(tokIdent, "not") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (boolExpr, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokPunct && tok.text == "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokPunct, ")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+
+	case tok.kind == tokIdent && (tok.text == "true" || tok.text == "false"):
+		p.next()
+		return boolLiteral(tok.text == "true"), nil
+
+	case tok.kind == tokIdent && (tok.text == "access" || tok.text == "kind" || tok.text == "path"):
+		p.next()
+		return p.parseRegionPredicate(tok.text)
+
+	case tok.kind == tokIdent && (tok.text == "any" || tok.text == "all"):
+		p.next()
+		min := 1
+		if tok.text == "all" {
+			min = -1
+		}
+		return p.parseOf(min)
+
+	case tok.kind == tokStringID:
+		p.next()
+		if strings.HasSuffix(tok.value, "*") {
+			return nil, p.errorf(tok.pos, "wildcards can only be used in sets")
+		}
+		if err := p.checkString(tok); err != nil {
+			return nil, err
+		}
+		return stringRef(tok.value), nil
+
+	case tok.kind == tokInt:
+		p.next()
+		if p.isNext(tokIdent, "of") {
+			min, err := parseInt(tok.text)
+			if err != nil {
+				return nil, p.errorf(tok.pos, "invalid number %s", tok.text)
+			}
+			return p.parseOf(int(min))
+		}
+		p.pos = tok.pos
+	}
+
+	left, err := p.parseIntExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := map[string]comparison{"==": equal, "!=": notEqual, "<": less, "<=": lessOrEqual, ">": greater,
+		">=": greaterOrEqual}[opTok.text]
+	if opTok.kind != tokPunct || !ok {
+		return nil, p.errorf(opTok.pos, "expected a comparison and found %q", opTok.text)
+	}
+
+	right, err := p.parseIntExpr()
+	if err != nil {
+		return nil, err
+	}
+	return intComparison{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseRegionPredicate(attribute string) (boolExpr, error) {
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := map[string]comparison{"==": equal, "!=": notEqual, "contains": contains}[opTok.text]
+	if !ok {
+		return nil, p.errorf(opTok.pos, "expected ==, != or contains after %s and found %q", attribute, opTok.text)
+	}
+
+	value, err := p.expect(tokString, "")
+	if err != nil {
+		return nil, err
+	}
+	return regionPredicate{attribute: attribute, op: op, value: value.value}, nil
+}
+
+// parseOf parses the set of an "of" expression, after the quantifier.
+func (p *parser) parseOf(min int) (boolExpr, error) {
+	if _, err := p.expect(tokIdent, "of"); err != nil {
+		return nil, err
+	}
+
+	identifiers := make([]string, 0)
+	if p.isNext(tokIdent, "them") {
+		p.next()
+		for _, def := range p.rule.strings {
+			identifiers = append(identifiers, def.identifier)
+		}
+	} else {
+		if _, err := p.expect(tokPunct, "("); err != nil {
+			return nil, err
+		}
+
+		for {
+			tok, err := p.expect(tokStringID, "")
+			if err != nil {
+				return nil, err
+			}
+
+			if strings.HasSuffix(tok.value, "*") {
+				prefix := strings.TrimSuffix(tok.value, "*")
+				found := false
+				for _, def := range p.rule.strings {
+					if strings.HasPrefix(def.identifier, prefix) {
+						identifiers = append(identifiers, def.identifier)
+						found = true
+					}
+				}
+				if !found {
+					return nil, p.errorf(tok.pos, "no strings match %s", tok.value)
+				}
+			} else {
+				if err := p.checkString(tok); err != nil {
+					return nil, err
+				}
+				identifiers = append(identifiers, tok.value)
+			}
+
+			if !p.isNext(tokPunct, ",") {
+				break
+			}
+			p.next()
+		}
+
+		if _, err := p.expect(tokPunct, ")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(identifiers) == 0 {
+		return nil, p.errorf(p.pos, "empty set of strings")
+	}
+	if min > len(identifiers) {
+		return nil, p.errorf(p.pos, "%d of a set of %d strings can never be true", min, len(identifiers))
+	}
+
+	return ofExpr{min: min, identifiers: identifiers}, nil
+}
+
+func (p *parser) parseIntExpr() (intExpr, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok.kind {
+	case tokInt:
+		value, err := parseInt(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "invalid number %s", tok.text)
+		}
+		return intLiteral(value), nil
+
+	case tokCount:
+		if err := p.checkString(tok); err != nil {
+			return nil, err
+		}
+		return countExpr(tok.value), nil
+
+	case tokAddress:
+		if err := p.checkString(tok); err != nil {
+			return nil, err
+		}
+
+		var index intExpr = intLiteral(1)
+		if p.isNext(tokPunct, "[") {
+			p.next()
+			index, err = p.parseIntExpr()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(tokPunct, "]"); err != nil {
+				return nil, err
+			}
+		}
+		return addressExpr{identifier: tok.value, index: index}, nil
+	}
+
+	if tok.kind == tokEOF {
+		return nil, p.errorf(tok.pos, "unexpected end of rules")
+	}
+	return nil, p.errorf(tok.pos, "unexpected %q in condition", tok.text)
+}
+
+// parseInt parses a decimal or 0x prefixed hexa number.
+func parseInt(s string) (int64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		value, err := strconv.ParseUint(s[2:], 16, 64)
+		return int64(value), err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,494 @@
+package memsearch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/polyverse/masche/memaccess"
+	"github.com/polyverse/masche/process"
+)
+
+// HexString is a compiled YARA-style hex string, like "DE AD ?? EF [2-8] 90 (90 | C3)".
+//
+// It's a sequence of:
+//   - Bytes written as two hexa digits. Any of them can be a ? wildcard, which matches any nibble.
+//   - Jumps, written as [N] or [N-M] (or [-M], the same as [0-M]), which match from N to M arbitrary bytes. Jumps must
+//     be bounded, and can't be at the beginning or the end of the string.
+//   - Alternatives, written as (A | B | ...), where each alternative is a non-empty hex string itself.
+//
+// The whole string can optionally be enclosed in braces, as in YARA rules.
+type HexString struct {
+	expr   string
+	nodes  []hexNode
+	minLen int
+	maxLen int
+	// jumps is the number of jumps in nodes, including the ones in alternatives.
+	jumps int
+}
+
+type hexNodeKind int
+
+const (
+	hexByte hexNodeKind = iota
+	hexJump
+	hexAlternatives
+)
+
+type hexNode struct {
+	kind hexNodeKind
+
+	// A byte b matches a hexByte node if b&mask == value.
+	value byte
+	mask  byte
+
+	// A hexJump node matches from min to max bytes. jump is its index among the jumps of the hex string.
+	min  int
+	max  int
+	jump int
+
+	// A hexAlternatives node matches any of alternatives.
+	alternatives [][]hexNode
+}
+
+// CompileHexString parses a YARA-style hex string. See HexString for its syntax.
+func CompileHexString(expr string) (*HexString, error) {
+	p := &hexParser{expr: expr}
+
+	s := strings.TrimSpace(expr)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		p.expr = s[1 : len(s)-1]
+	}
+
+	nodes, err := p.parseSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos != len(p.expr) {
+		return nil, p.errorf("unexpected %q", p.expr[p.pos])
+	}
+
+	h := &HexString{expr: expr, nodes: nodes, jumps: p.jumps}
+	h.minLen, h.maxLen = hexNodesLen(nodes)
+	return h, nil
+}
+
+// MustCompileHexString is like CompileHexString but panics if the expression cannot be parsed.
+func MustCompileHexString(expr string) *HexString {
+	h, err := CompileHexString(expr)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// String returns the source text used to compile the hex string.
+func (h *HexString) String() string {
+	return h.expr
+}
+
+// MinLen returns the length of the shortest bytes sequence h can match.
+func (h *HexString) MinLen() int {
+	return h.minLen
+}
+
+// MaxLen returns the length of the longest bytes sequence h can match.
+func (h *HexString) MaxLen() int {
+	return h.maxLen
+}
+
+// MatchAt checks if h matches buf starting at start. If it does, end is the position right after the match. When more
+// than a match is possible the alternatives are tried in order, and the jumps from the shortest to the longest.
+func (h *HexString) MatchAt(buf []byte, start int) (end int, matched bool) {
+	return newHexMatcher(h, buf).matchAt(start)
+}
+
+// FindIndex returns the location of the leftmost match of h in buf, as a [start, end) pair. If there is no match it
+// returns nil.
+func (h *HexString) FindIndex(buf []byte) (loc []int) {
+	m := newHexMatcher(h, buf)
+	for start := 0; start+h.minLen <= len(buf); start++ {
+		if end, matched := m.matchAt(start); matched {
+			return []int{start, end}
+		}
+	}
+	return nil
+}
+
+// FindHexStringMatch finds the first match of h in the process memory starting at a given address. It works as
+// FindBytesSequence, but searching for a hex string.
+func FindHexStringMatch(p process.Process, address uintptr, h *HexString) (found bool, foundAddress uintptr,
+	harderror error, softerrors []error) {
+
+	return FindHexStringMatchContext(context.Background(), p, address, h)
+}
+
+// FindHexStringMatchContext works as FindHexStringMatch, but it stops when ctx is done.
+func FindHexStringMatchContext(ctx context.Context, p process.Process, address uintptr, h *HexString) (found bool,
+	foundAddress uintptr, harderror error, softerrors []error) {
+
+	harderror, softerrors = FindAllHexStringMatchesFuncContext(ctx, p, address, h,
+		func(match Match) (keepSearching bool) {
+			found = true
+			foundAddress = match.Address
+			return false
+		})
+	return
+}
+
+// FindAllHexStringMatches finds all the matches of h in the process memory starting at a given address. There is at
+// most a match for each starting address, but matches starting at different addresses can overlap.
+func FindAllHexStringMatches(p process.Process, address uintptr, h *HexString) (matches []Match,
+	harderror error, softerrors []error) {
+
+	return FindAllHexStringMatchesContext(context.Background(), p, address, h)
+}
+
+// FindAllHexStringMatchesContext works as FindAllHexStringMatches, but it stops when ctx is done.
+func FindAllHexStringMatchesContext(ctx context.Context, p process.Process, address uintptr, h *HexString) (
+	matches []Match, harderror error, softerrors []error) {
+
+	matches = make([]Match, 0)
+	harderror, softerrors = FindAllHexStringMatchesFuncContext(ctx, p, address, h,
+		func(match Match) (keepSearching bool) {
+			matches = append(matches, match)
+			return true
+		})
+	return
+}
+
+// FindAllHexStringMatchesFunc works as FindAllHexStringMatches, but instead of returning the matches it calls fn with
+// each of them, in address order, as soon as they are found.
+func FindAllHexStringMatchesFunc(p process.Process, address uintptr, h *HexString, fn MatchFunc) (harderror error,
+	softerrors []error) {
+
+	return FindAllHexStringMatchesFuncContext(context.Background(), p, address, h, fn)
+}
+
+// FindAllHexStringMatchesFuncContext works as FindAllHexStringMatchesFunc, but it stops when ctx is done.
+func FindAllHexStringMatchesFuncContext(ctx context.Context, p process.Process, address uintptr, h *HexString,
+	fn MatchFunc) (harderror error, softerrors []error) {
+
+	m, harderror, softerrors := memaccess.ReadMemoryMap(p)
+	if harderror != nil {
+		return
+	}
+
+	regions := regionFinder{m: m}
+	harderror, serrs := walkMatchStarts(ctx, p, address, h.maxLen,
+		func(bufAddress uintptr, buf []byte, from int, to int) (keepSearching bool) {
+			matcher := newHexMatcher(h, buf)
+			for start := from; start < to; start++ {
+				end, matched := matcher.matchAt(start)
+				if !matched {
+					continue
+				}
+
+				matchAddress := bufAddress + uintptr(start)
+				data := make([]byte, end-start)
+				copy(data, buf[start:end])
+				if !fn(Match{Address: matchAddress, Region: regions.find(matchAddress), Data: data}) {
+					return false
+				}
+			}
+			return true
+		})
+	softerrors = append(softerrors, serrs...)
+	return
+}
+
+// startsFunc is called by walkMatchStarts with a buffer of contiguous memory starting at bufAddress, and the range
+// [from, to) of positions in buf where matches must be looked for.
+type startsFunc func(bufAddress uintptr, buf []byte, from int, to int) (keepSearching bool)
+
+// walkMatchStarts walks the memory of p calling fn so that every address is passed once as a possible start of a
+// match, and with at least maxLen bytes after it in buf, unless the contiguous memory ends before. This way matches of
+// up to maxLen bytes are never missed nor found twice, regardless of how the memory is read.
+func walkMatchStarts(ctx context.Context, p process.Process, address uintptr, maxLen int, fn startsFunc) (
+	harderror error, softerrors []error) {
+
+	const min_buffer_size = 4096
+	chunkSize := uint(min_buffer_size)
+	if uint(maxLen) > chunkSize {
+		chunkSize = uint(maxLen)
+	}
+
+	// buf has the bytes from the previous chunks that couldn't be checked yet as they didn't have maxLen bytes after
+	// them, followed by the current chunk.
+	buf := make([]byte, 0, 2*chunkSize)
+	bufAddress := uintptr(0)
+	stopped := false
+
+	harderror, softerrors = memaccess.WalkMemoryContext(ctx, p, address, chunkSize,
+		func(address uintptr, chunk []byte) (keepSearching bool) {
+			if len(buf) > 0 && bufAddress+uintptr(len(buf)) != address {
+				// The contiguous memory finished, so the remaining bytes won't have more bytes after them.
+				if !fn(bufAddress, buf, 0, len(buf)) {
+					stopped = true
+					return false
+				}
+				buf = buf[:0]
+			}
+
+			if len(buf) == 0 {
+				bufAddress = address
+			}
+			buf = append(buf, chunk...)
+
+			to := len(buf) - maxLen + 1
+			if to <= 0 {
+				return true
+			}
+
+			if !fn(bufAddress, buf, 0, to) {
+				stopped = true
+				return false
+			}
+
+			buf = append(buf[:0], buf[to:]...)
+			bufAddress += uintptr(to)
+			return true
+		})
+
+	if harderror == nil && !stopped && len(buf) > 0 {
+		fn(bufAddress, buf, 0, len(buf))
+	}
+
+	return
+}
+
+// hexMatcher matches a hex string at the positions of a buffer. The nodes after a jump match or not at a position
+// regardless of where the match started, so the positions where they failed are remembered and the jumps don't try
+// them again. That bounds the work of matching at all the positions of the buffer to its length times the number
+// and the width of the jumps, instead of growing exponentially with the number of jumps.
+type hexMatcher struct {
+	h   *HexString
+	buf []byte
+	// failed has a bit for each jump and position of buf, set when the nodes after the jump didn't match there.
+	failed []uint64
+}
+
+func newHexMatcher(h *HexString, buf []byte) *hexMatcher {
+	return &hexMatcher{h: h, buf: buf}
+}
+
+// matchAt works as HexString.MatchAt.
+func (m *hexMatcher) matchAt(start int) (end int, matched bool) {
+	return m.match(m.h.nodes, start, func(end int) (int, bool) {
+		return end, true
+	})
+}
+
+// match matches nodes against the buffer starting at pos, calling next with the position after each possible match
+// until it returns true.
+func (m *hexMatcher) match(nodes []hexNode, pos int, next func(end int) (int, bool)) (int, bool) {
+	if len(nodes) == 0 {
+		return next(pos)
+	}
+
+	node, rest := nodes[0], nodes[1:]
+	switch node.kind {
+	case hexByte:
+		if pos >= len(m.buf) || m.buf[pos]&node.mask != node.value {
+			return 0, false
+		}
+		return m.match(rest, pos+1, next)
+
+	case hexJump:
+		for skip := node.min; skip <= node.max && pos+skip <= len(m.buf); skip++ {
+			bit := node.jump*(len(m.buf)+1) + pos + skip
+			if m.failed != nil && m.failed[bit/64]&(1<<uint(bit%64)) != 0 {
+				continue
+			}
+			if end, matched := m.match(rest, pos+skip, next); matched {
+				return end, true
+			}
+
+			if m.failed == nil {
+				m.failed = make([]uint64, (m.h.jumps*(len(m.buf)+1)+63)/64)
+			}
+			m.failed[bit/64] |= 1 << uint(bit%64)
+		}
+
+	case hexAlternatives:
+		for _, alternative := range node.alternatives {
+			end, matched := m.match(alternative, pos, func(end int) (int, bool) {
+				return m.match(rest, end, next)
+			})
+			if matched {
+				return end, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// hexNodesLen returns the minimum and maximum length of the bytes sequences matched by nodes.
+func hexNodesLen(nodes []hexNode) (minLen int, maxLen int) {
+	for _, node := range nodes {
+		switch node.kind {
+		case hexByte:
+			minLen++
+			maxLen++
+		case hexJump:
+			minLen += node.min
+			maxLen += node.max
+		case hexAlternatives:
+			altMin, altMax := hexNodesLen(node.alternatives[0])
+			for _, alternative := range node.alternatives[1:] {
+				min, max := hexNodesLen(alternative)
+				if min < altMin {
+					altMin = min
+				}
+				if max > altMax {
+					altMax = max
+				}
+			}
+			minLen += altMin
+			maxLen += altMax
+		}
+	}
+	return
+}
+
+// hexParser is a recursive descent parser for hex strings.
+type hexParser struct {
+	expr string
+	pos  int
+	// jumps is the number of jumps parsed.
+	jumps int
+}
+
+func (p *hexParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid hex string %q at position %d: %s", p.expr, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *hexParser) skipSpaces() {
+	for p.pos < len(p.expr) && strings.ContainsRune(" \t\r\n", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+}
+
+// parseSequence parses nodes until the end of the expression, or a | or ) is found.
+func (p *hexParser) parseSequence() (nodes []hexNode, err error) {
+	for {
+		p.skipSpaces()
+		if p.pos == len(p.expr) || p.expr[p.pos] == '|' || p.expr[p.pos] == ')' {
+			break
+		}
+
+		var node hexNode
+		switch p.expr[p.pos] {
+		case '[':
+			node, err = p.parseJump()
+		case '(':
+			node, err = p.parseAlternatives()
+		default:
+			node, err = p.parseByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 0 {
+		return nil, p.errorf("empty hex string")
+	}
+	if nodes[0].kind == hexJump || nodes[len(nodes)-1].kind == hexJump {
+		return nil, p.errorf("a hex string can't start or end with a jump")
+	}
+
+	return nodes, nil
+}
+
+func (p *hexParser) parseByte() (node hexNode, err error) {
+	if p.pos+2 > len(p.expr) {
+		return node, p.errorf("incomplete byte")
+	}
+
+	node.kind = hexByte
+	for _, c := range p.expr[p.pos : p.pos+2] {
+		node.value <<= 4
+		node.mask <<= 4
+		if c == '?' {
+			continue
+		}
+
+		nibble, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			return node, p.errorf("invalid hexa digit %q", c)
+		}
+		node.value |= byte(nibble)
+		node.mask |= 0xf
+	}
+
+	p.pos += 2
+	return node, nil
+}
+
+func (p *hexParser) parseJump() (node hexNode, err error) {
+	end := strings.IndexByte(p.expr[p.pos:], ']')
+	if end == -1 {
+		return node, p.errorf("unterminated jump")
+	}
+
+	jump := strings.Replace(p.expr[p.pos+1:p.pos+end], " ", "", -1)
+	node.kind = hexJump
+
+	bounds := strings.Split(jump, "-")
+	switch len(bounds) {
+	case 1:
+		node.min, err = strconv.Atoi(bounds[0])
+		node.max = node.min
+	case 2:
+		if bounds[1] == "" {
+			return node, p.errorf("unbounded jumps are not supported")
+		}
+		if bounds[0] != "" {
+			node.min, err = strconv.Atoi(bounds[0])
+		}
+		if err == nil {
+			node.max, err = strconv.Atoi(bounds[1])
+		}
+	default:
+		err = fmt.Errorf("too many -")
+	}
+
+	if err != nil || node.min < 0 || node.max < node.min {
+		return node, p.errorf("invalid jump [%s]", jump)
+	}
+
+	node.jump = p.jumps
+	p.jumps++
+	p.pos += end + 1
+	return node, nil
+}
+
+func (p *hexParser) parseAlternatives() (node hexNode, err error) {
+	node.kind = hexAlternatives
+
+	// Skip the (
+	p.pos++
+	for {
+		alternative, err := p.parseSequence()
+		if err != nil {
+			return node, err
+		}
+		node.alternatives = append(node.alternatives, alternative)
+
+		if p.pos == len(p.expr) {
+			return node, p.errorf("unterminated alternatives")
+		}
+
+		p.pos++
+		if p.expr[p.pos-1] == ')' {
+			return node, nil
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package memsearch
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/polyverse/masche/memaccess"
+	"github.com/polyverse/masche/process"
+)
+
+// Pattern is a bytes sequence to search for with a Matcher.
+type Pattern struct {
+	// Name identifies the pattern in the matches, it doesn't need to be unique.
+	Name string
+	// Bytes is the sequence to search for.
+	Bytes []byte
+	// NoCase makes the ASCII letters of Bytes match regardless of their case.
+	NoCase bool
+}
+
+// LiteralPattern returns a Pattern that matches b as is.
+func LiteralPattern(name string, b []byte) Pattern {
+	return Pattern{Name: name, Bytes: b}
+}
+
+// StringPattern returns a Pattern that matches s encoded as UTF-8.
+func StringPattern(name string, s string) Pattern {
+	return Pattern{Name: name, Bytes: []byte(s)}
+}
+
+// NoCaseStringPattern returns a Pattern that matches s encoded as UTF-8, ignoring the case of its ASCII letters.
+func NoCaseStringPattern(name string, s string) Pattern {
+	return Pattern{Name: name, Bytes: []byte(s), NoCase: true}
+}
+
+// UTF16LEPattern returns a Pattern that matches s encoded as UTF-16LE, as strings are usually stored by Windows
+// programs.
+func UTF16LEPattern(name string, s string) Pattern {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 0, 2*len(codes))
+	for _, c := range codes {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return Pattern{Name: name, Bytes: b}
+}
+
+// HexPattern returns a Pattern that matches the bytes encoded as hexa in h. Spaces in h are ignored, so both
+// "deadbeef" and "DE AD BE EF" are valid.
+func HexPattern(name string, h string) (Pattern, error) {
+	b, err := hex.DecodeString(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, h))
+	if err != nil {
+		return Pattern{}, fmt.Errorf("Invalid hex pattern %s (%v)", name, err)
+	}
+
+	return Pattern{Name: name, Bytes: b}, nil
+}
+
+// Matcher searches for many patterns at the same time, reading the memory of the process only once.
+//
+// It's implemented with an Aho-Corasick automaton, so the cost of a search doesn't depend on the amount of patterns,
+// but on the size of the memory being searched.
+type Matcher struct {
+	patterns []Pattern
+	maxLen   int
+
+	// caseSensitive matches the patterns without NoCase, noCase the rest over ASCII lowercased bytes.
+	caseSensitive *automaton
+	noCase        *automaton
+}
+
+// NewMatcher compiles a Matcher that searches for all the given patterns.
+func NewMatcher(patterns ...Pattern) (*Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("A Matcher needs at least one pattern")
+	}
+
+	m := &Matcher{patterns: make([]Pattern, len(patterns))}
+	copy(m.patterns, patterns)
+
+	caseSensitive := make(map[int][]byte)
+	noCase := make(map[int][]byte)
+	for i, pattern := range m.patterns {
+		if len(pattern.Bytes) == 0 {
+			return nil, fmt.Errorf("Pattern %d (%s) is empty", i, pattern.Name)
+		}
+
+		if len(pattern.Bytes) > m.maxLen {
+			m.maxLen = len(pattern.Bytes)
+		}
+
+		if pattern.NoCase {
+			folded := make([]byte, len(pattern.Bytes))
+			for j, b := range pattern.Bytes {
+				folded[j] = toLowerASCII(b)
+			}
+			noCase[i] = folded
+		} else {
+			caseSensitive[i] = pattern.Bytes
+		}
+	}
+
+	if len(caseSensitive) > 0 {
+		m.caseSensitive = newAutomaton(caseSensitive, false)
+	}
+	if len(noCase) > 0 {
+		m.noCase = newAutomaton(noCase, true)
+	}
+
+	return m, nil
+}
+
+// Patterns returns the patterns searched by m. The index of each one is the one used in PatternMatch.
+func (m *Matcher) Patterns() []Pattern {
+	return m.patterns
+}
+
+// MaxLen returns the length of the longest pattern of m.
+func (m *Matcher) MaxLen() int {
+	return m.maxLen
+}
+
+// scan calls fn with every occurrence of the patterns of m in buf, with the index of the pattern that matched and
+// the position in buf right after the match. It returns false if fn does.
+func (m *Matcher) scan(buf []byte, fn func(pattern int, end int) bool) bool {
+	if m.caseSensitive != nil && !m.caseSensitive.scan(buf, fn) {
+		return false
+	}
+	if m.noCase != nil && !m.noCase.scan(buf, fn) {
+		return false
+	}
+	return true
+}
+
+// PatternMatch is an occurrence of one of the patterns of a Matcher.
+type PatternMatch struct {
+	Match
+	// Pattern is the index of the pattern that matched in Matcher.Patterns().
+	Pattern int
+}
+
+// PatternMatchFunc is called for each match found by FindAllPatternsFunc. If it returns false the search stops.
+type PatternMatchFunc func(match PatternMatch) (keepSearching bool)
+
+// FindAllPatterns finds all the occurrences of the patterns of m in the Process starting at a given address, sorted
+// by address.
+func FindAllPatterns(p process.Process, address uintptr, m *Matcher) (matches []PatternMatch, harderror error,
+	softerrors []error) {
+
+	return FindAllPatternsContext(context.Background(), p, address, m)
+}
+
+// FindAllPatternsContext works as FindAllPatterns, but it stops when ctx is done.
+func FindAllPatternsContext(ctx context.Context, p process.Process, address uintptr, m *Matcher) (
+	matches []PatternMatch, harderror error, softerrors []error) {
+
+	matches = make([]PatternMatch, 0)
+	harderror, softerrors = FindAllPatternsFuncContext(ctx, p, address, m,
+		func(match PatternMatch) (keepSearching bool) {
+			matches = append(matches, match)
+			return true
+		})
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Address != matches[j].Address {
+			return matches[i].Address < matches[j].Address
+		}
+		return matches[i].Pattern < matches[j].Pattern
+	})
+	return
+}
+
+// FindAllPatternsFunc works as FindAllPatterns, but instead of returning the matches it calls fn with each of them as
+// soon as they are found. Matches are not necessarily found in address order.
+func FindAllPatternsFunc(p process.Process, address uintptr, m *Matcher, fn PatternMatchFunc) (harderror error,
+	softerrors []error) {
+
+	return FindAllPatternsFuncContext(context.Background(), p, address, m, fn)
+}
+
+// FindAllPatternsFuncContext works as FindAllPatternsFunc, but it stops when ctx is done.
+func FindAllPatternsFuncContext(ctx context.Context, p process.Process, address uintptr, m *Matcher,
+	fn PatternMatchFunc) (harderror error, softerrors []error) {
+
+	regions, harderror, softerrors := memaccess.ReadMemoryMap(p)
+	if harderror != nil {
+		return
+	}
+
+	windowSize, overlap := windowFor(m.maxLen)
+	finder := regionFinder{m: regions}
+	previousEnd := uintptr(0)
+	harderror, serrs := memaccess.OverlappingWalkMemoryContext(ctx, p, address, windowSize, overlap,
+		func(address uintptr, buf []byte) (keepSearching bool) {
+			keepSearching = m.scan(buf, func(pattern int, end int) bool {
+				// Matches ending in the part of buf already scanned were reported with the previous buffer.
+				if address+uintptr(end) <= previousEnd {
+					return true
+				}
+
+				start := end - len(m.patterns[pattern].Bytes)
+				matchAddress := address + uintptr(start)
+				data := make([]byte, end-start)
+				copy(data, buf[start:end])
+				return fn(PatternMatch{
+					Match:   Match{Address: matchAddress, Region: finder.find(matchAddress), Data: data},
+					Pattern: pattern,
+				})
+			})
+
+			previousEnd = address + uintptr(len(buf))
+			return keepSearching
+		})
+	softerrors = append(softerrors, serrs...)
+	return
+}
+
+// automaton is a dense Aho-Corasick automaton: every state has a transition for each of the 256 bytes values.
+type automaton struct {
+	// delta[state*256+b] is the state reached from state when reading b.
+	delta []int32
+	// out has the indexes of the patterns that end at each state.
+	out [][]int
+	// fold makes the input bytes be lowercased before following the transitions.
+	fold bool
+}
+
+// newAutomaton builds an automaton for the given patterns, indexed by the number reported when they match.
+func newAutomaton(patterns map[int][]byte, fold bool) *automaton {
+	a := &automaton{fold: fold}
+	a.addState()
+
+	// Sort the indexes so the automaton doesn't depend on the map iteration order.
+	ids := make([]int, 0, len(patterns))
+	for id := range patterns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	// Build the trie. -1 marks the missing transitions.
+	for _, id := range ids {
+		state := int32(0)
+		for _, b := range patterns[id] {
+			next := a.delta[int(state)*256+int(b)]
+			if next == -1 {
+				next = a.addState()
+				a.delta[int(state)*256+int(b)] = next
+			}
+			state = next
+		}
+		a.out[state] = append(a.out[state], id)
+	}
+
+	// Compute the failure links in breadth-first order, replacing the missing transitions with the ones of the
+	// failure state.
+	fail := make([]int32, len(a.out))
+	queue := make([]int32, 0, len(a.out))
+	for b := 0; b < 256; b++ {
+		next := a.delta[b]
+		if next == -1 {
+			a.delta[b] = 0
+		} else {
+			fail[next] = 0
+			queue = append(queue, next)
+		}
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		a.out[state] = append(a.out[state], a.out[fail[state]]...)
+
+		for b := 0; b < 256; b++ {
+			next := a.delta[int(state)*256+b]
+			failNext := a.delta[int(fail[state])*256+b]
+			if next == -1 {
+				a.delta[int(state)*256+b] = failNext
+			} else {
+				fail[next] = failNext
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	return a
+}
+
+// addState adds a state without transitions and returns it.
+func (a *automaton) addState() int32 {
+	state := int32(len(a.out))
+	a.out = append(a.out, nil)
+	for b := 0; b < 256; b++ {
+		a.delta = append(a.delta, -1)
+	}
+	return state
+}
+
+// scan works as Matcher.scan for the patterns of a.
+func (a *automaton) scan(buf []byte, fn func(pattern int, end int) bool) bool {
+	state := int32(0)
+	for i, b := range buf {
+		if a.fold {
+			b = toLowerASCII(b)
+		}
+
+		state = a.delta[int(state)*256+int(b)]
+		for _, id := range a.out[state] {
+			if !fn(id, i+1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func toLowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
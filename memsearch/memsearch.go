@@ -2,26 +2,49 @@ package memsearch
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/polyverse/masche/memaccess"
 	"github.com/polyverse/masche/process"
 	"regexp"
 )
 
+// DefaultRegexpMaxLen is the maximum length of the matches of the regexp search functions that don't take it as an
+// argument. Longer matches may be missed or truncated.
+const DefaultRegexpMaxLen = 2048
+
+// windowFor returns the window size and overlap to walk the memory with OverlappingWalkMemory so that no match of up
+// to maxLen bytes is missed.
+func windowFor(maxLen int) (windowSize uint, overlap uint) {
+	const min_step = uint(4096)
+	step := min_step
+	if uint(maxLen) > step {
+		step = uint(maxLen)
+	}
+	return step + uint(maxLen), uint(maxLen)
+}
+
 // FindByFindBytesSequence finds for the first occurrence of needle in the Process starting at a given address (in the
 // process address space). If the needle is found the first argument will be true and the second one will contain it's
 // address.
 func FindBytesSequence(p process.Process, address uintptr, needle []byte) (found bool, foundAddress uintptr,
 	harderror error, softerrors []error) {
 
-	const min_buffer_size = uint(4096)
-	buffer_size := min_buffer_size
-	if uint(len(needle)) > buffer_size {
-		buffer_size = uint(len(needle))
-	}
+	return FindBytesSequenceContext(context.Background(), p, address, needle)
+}
+
+// FindBytesSequenceContext works as FindBytesSequence, but it stops when ctx is done.
+//
+// As this one, all the functions of this package ending in Context return a *memaccess.CanceledError as hard error
+// when ctx is done before they finish, along with what they found until then.
+func FindBytesSequenceContext(ctx context.Context, p process.Process, address uintptr, needle []byte) (found bool,
+	foundAddress uintptr, harderror error, softerrors []error) {
+
+	windowSize, overlap := windowFor(len(needle))
 
 	foundAddress = uintptr(0)
 	found = false
-	harderror, softerrors = memaccess.SlidingWalkMemory(p, address, buffer_size,
+	harderror, softerrors = memaccess.OverlappingWalkMemoryContext(ctx, p, address, windowSize, overlap,
 		func(address uintptr, buf []byte) (keepSearching bool) {
 			i := bytes.Index(buf, needle)
 			if i == -1 {
@@ -38,14 +61,41 @@ func FindBytesSequence(p process.Process, address uintptr, needle []byte) (found
 // FindFindRegexpMatch finds the first match of r in the process memory. This function works as FindFindBytesSequence
 // but instead of searching for a literal bytes sequence it uses a regexp. It tries to match the regexp in the memory
 // as is, not interpreting it as any charset in particular.
+//
+// Matches longer than DefaultRegexpMaxLen may be missed, use FindRegexpMatchMaxLen to search for longer ones.
 func FindRegexpMatch(p process.Process, address uintptr, r *regexp.Regexp) (found bool, foundAddress uintptr,
 	harderror error, softerrors []error) {
 
-	const buffer_size = uint(4096)
+	return FindRegexpMatchContext(context.Background(), p, address, r)
+}
+
+// FindRegexpMatchContext works as FindRegexpMatch, but it stops when ctx is done.
+func FindRegexpMatchContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp) (found bool,
+	foundAddress uintptr, harderror error, softerrors []error) {
+
+	return FindRegexpMatchMaxLenContext(ctx, p, address, r, DefaultRegexpMaxLen)
+}
+
+// FindRegexpMatchMaxLen works as FindRegexpMatch, but the memory is read so that matches of up to maxLen bytes are
+// never missed.
+func FindRegexpMatchMaxLen(p process.Process, address uintptr, r *regexp.Regexp, maxLen int) (found bool,
+	foundAddress uintptr, harderror error, softerrors []error) {
+
+	return FindRegexpMatchMaxLenContext(context.Background(), p, address, r, maxLen)
+}
+
+// FindRegexpMatchMaxLenContext works as FindRegexpMatchMaxLen, but it stops when ctx is done.
+func FindRegexpMatchMaxLenContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp,
+	maxLen int) (found bool, foundAddress uintptr, harderror error, softerrors []error) {
+
+	if maxLen <= 0 {
+		return false, 0, fmt.Errorf("Invalid maximum match length %d", maxLen), nil
+	}
+	windowSize, overlap := windowFor(maxLen)
 
 	foundAddress = uintptr(0)
 	found = false
-	harderror, softerrors = memaccess.SlidingWalkMemory(p, address, buffer_size,
+	harderror, softerrors = memaccess.OverlappingWalkMemoryContext(ctx, p, address, windowSize, overlap,
 		func(address uintptr, buf []byte) (keepSearching bool) {
 			loc := r.FindIndex(buf)
 			if loc == nil {
@@ -59,3 +109,216 @@ func FindRegexpMatch(p process.Process, address uintptr, r *regexp.Regexp) (foun
 
 	return
 }
+
+// Match is an occurrence of a bytes sequence or a regexp in the memory of a process.
+type Match struct {
+	// Address is where the match starts, in the process address space.
+	Address uintptr
+	// Region is the memory region containing Address, or memaccess.NoRegionAvailable if the process changed its
+	// memory layout while being searched.
+	Region memaccess.MemoryRegion
+	// Data is a copy of the matched bytes.
+	Data []byte
+}
+
+// MatchFunc is called for each match found by the FindAll*Func functions. If it returns false the search stops.
+type MatchFunc func(match Match) (keepSearching bool)
+
+// FindAllBytesSequence finds all the occurrences of needle in the Process starting at a given address (in the process
+// address space), including the ones overlapping each other.
+func FindAllBytesSequence(p process.Process, address uintptr, needle []byte) (matches []Match, harderror error,
+	softerrors []error) {
+
+	return FindAllBytesSequenceContext(context.Background(), p, address, needle)
+}
+
+// FindAllBytesSequenceContext works as FindAllBytesSequence, but it stops when ctx is done.
+func FindAllBytesSequenceContext(ctx context.Context, p process.Process, address uintptr, needle []byte) (
+	matches []Match, harderror error, softerrors []error) {
+
+	matches = make([]Match, 0)
+	harderror, softerrors = FindAllBytesSequenceFuncContext(ctx, p, address, needle,
+		func(match Match) (keepSearching bool) {
+			matches = append(matches, match)
+			return true
+		})
+	return
+}
+
+// FindAllBytesSequenceFunc works as FindAllBytesSequence, but instead of returning the matches it calls fn with each
+// of them, in address order, as soon as they are found.
+func FindAllBytesSequenceFunc(p process.Process, address uintptr, needle []byte, fn MatchFunc) (harderror error,
+	softerrors []error) {
+
+	return FindAllBytesSequenceFuncContext(context.Background(), p, address, needle, fn)
+}
+
+// FindAllBytesSequenceFuncContext works as FindAllBytesSequenceFunc, but it stops when ctx is done.
+func FindAllBytesSequenceFuncContext(ctx context.Context, p process.Process, address uintptr, needle []byte,
+	fn MatchFunc) (harderror error, softerrors []error) {
+
+	if len(needle) == 0 {
+		return fmt.Errorf("Can't search for an empty bytes sequence"), nil
+	}
+
+	return findAll(ctx, p, address, len(needle), true, func(buf []byte) (locs [][]int) {
+		for i := 0; i+len(needle) <= len(buf); i++ {
+			j := bytes.Index(buf[i:], needle)
+			if j == -1 {
+				break
+			}
+			i += j
+			locs = append(locs, []int{i, i + len(needle)})
+		}
+		return locs
+	}, fn)
+}
+
+// FindAllRegexpMatches finds all the non-overlapping matches of r in the process memory starting at a given address.
+// As with FindRegexpMatch, the memory is searched in chunks, so matches longer than DefaultRegexpMaxLen may be missed.
+func FindAllRegexpMatches(p process.Process, address uintptr, r *regexp.Regexp) (matches []Match, harderror error,
+	softerrors []error) {
+
+	return FindAllRegexpMatchesContext(context.Background(), p, address, r)
+}
+
+// FindAllRegexpMatchesContext works as FindAllRegexpMatches, but it stops when ctx is done.
+func FindAllRegexpMatchesContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp) (
+	matches []Match, harderror error, softerrors []error) {
+
+	return FindAllRegexpMatchesMaxLenContext(ctx, p, address, r, DefaultRegexpMaxLen)
+}
+
+// FindAllRegexpMatchesFunc works as FindAllRegexpMatches, but instead of returning the matches it calls fn with each
+// of them, in address order, as soon as they are found.
+func FindAllRegexpMatchesFunc(p process.Process, address uintptr, r *regexp.Regexp, fn MatchFunc) (harderror error,
+	softerrors []error) {
+
+	return FindAllRegexpMatchesFuncContext(context.Background(), p, address, r, fn)
+}
+
+// FindAllRegexpMatchesFuncContext works as FindAllRegexpMatchesFunc, but it stops when ctx is done.
+func FindAllRegexpMatchesFuncContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp,
+	fn MatchFunc) (harderror error, softerrors []error) {
+
+	return FindAllRegexpMatchesMaxLenFuncContext(ctx, p, address, r, DefaultRegexpMaxLen, fn)
+}
+
+// FindAllRegexpMatchesMaxLen works as FindAllRegexpMatches, but the memory is read so that matches of up to maxLen
+// bytes are never missed.
+func FindAllRegexpMatchesMaxLen(p process.Process, address uintptr, r *regexp.Regexp, maxLen int) (matches []Match,
+	harderror error, softerrors []error) {
+
+	return FindAllRegexpMatchesMaxLenContext(context.Background(), p, address, r, maxLen)
+}
+
+// FindAllRegexpMatchesMaxLenContext works as FindAllRegexpMatchesMaxLen, but it stops when ctx is done.
+func FindAllRegexpMatchesMaxLenContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp,
+	maxLen int) (matches []Match, harderror error, softerrors []error) {
+
+	matches = make([]Match, 0)
+	harderror, softerrors = FindAllRegexpMatchesMaxLenFuncContext(ctx, p, address, r, maxLen,
+		func(match Match) (keepSearching bool) {
+			matches = append(matches, match)
+			return true
+		})
+	return
+}
+
+// FindAllRegexpMatchesMaxLenFunc works as FindAllRegexpMatchesMaxLen, but instead of returning the matches it calls
+// fn with each of them, in address order, as soon as they are found.
+func FindAllRegexpMatchesMaxLenFunc(p process.Process, address uintptr, r *regexp.Regexp, maxLen int,
+	fn MatchFunc) (harderror error, softerrors []error) {
+
+	return FindAllRegexpMatchesMaxLenFuncContext(context.Background(), p, address, r, maxLen, fn)
+}
+
+// FindAllRegexpMatchesMaxLenFuncContext works as FindAllRegexpMatchesMaxLenFunc, but it stops when ctx is done.
+func FindAllRegexpMatchesMaxLenFuncContext(ctx context.Context, p process.Process, address uintptr, r *regexp.Regexp,
+	maxLen int, fn MatchFunc) (harderror error, softerrors []error) {
+
+	if maxLen <= 0 {
+		return fmt.Errorf("Invalid maximum match length %d", maxLen), nil
+	}
+
+	return findAll(ctx, p, address, maxLen, false, func(buf []byte) [][]int {
+		return r.FindAllIndex(buf, -1)
+	}, fn)
+}
+
+// locateFunc returns the [start, end) locations of the matches found in buf, sorted by their start.
+type locateFunc func(buf []byte) [][]int
+
+// findAll walks the memory of p with walkMatchStarts, so that matches of up to maxLen bytes are never missed nor cut
+// at the end of a buffer, calling fn with each of the matches returned by locate that start where walkMatchStarts
+// asks for. The later ones are located again in the next buffer, with all their bytes.
+//
+// If overlapping is false a match starting before the end of the previous one is ignored.
+// locate is only called with the part of each buffer after the last match reported.
+func findAll(ctx context.Context, p process.Process, address uintptr, maxLen int, overlapping bool,
+	locate locateFunc, fn MatchFunc) (harderror error, softerrors []error) {
+
+	m, harderror, softerrors := memaccess.ReadMemoryMap(p)
+	if harderror != nil {
+		return
+	}
+
+	regions := regionFinder{m: m}
+	reported := false
+	nextAddress := uintptr(0)
+	harderror, serrs := walkMatchStarts(ctx, p, address, maxLen,
+		func(bufAddress uintptr, buf []byte, from int, to int) (keepSearching bool) {
+			// The bytes before nextAddress were already searched, and a match found there in the previous buffer
+			// must not hide the ones after it.
+			skip := from
+			if reported && nextAddress > bufAddress+uintptr(skip) {
+				skip = len(buf)
+				if nextAddress-bufAddress < uintptr(len(buf)) {
+					skip = int(nextAddress - bufAddress)
+				}
+			}
+			if skip >= to {
+				return true
+			}
+
+			for _, loc := range locate(buf[skip:]) {
+				start, end := skip+loc[0], skip+loc[1]
+				if start >= to {
+					// It may run past the end of buf, it will be located again with the next one.
+					break
+				}
+
+				matchAddress := bufAddress + uintptr(start)
+				data := make([]byte, end-start)
+				copy(data, buf[start:end])
+				if !fn(Match{Address: matchAddress, Region: regions.find(matchAddress), Data: data}) {
+					return false
+				}
+
+				reported = true
+				if overlapping || end == start {
+					nextAddress = matchAddress + 1
+				} else {
+					nextAddress = bufAddress + uintptr(end)
+				}
+			}
+			return true
+		})
+	softerrors = append(softerrors, serrs...)
+	return
+}
+
+// regionFinder finds the regions containing the matches in a MemoryMap, caching the last region found as consecutive
+// matches are usually in the same one.
+type regionFinder struct {
+	m      *memaccess.MemoryMap
+	region memaccess.MemoryRegion
+}
+
+// find returns the region containing address, or memaccess.NoRegionAvailable if there is none.
+func (f *regionFinder) find(address uintptr) memaccess.MemoryRegion {
+	if address < f.region.Address || address >= f.region.Address+uintptr(f.region.Size) {
+		f.region, _ = f.m.Find(address)
+	}
+	return f.region
+}
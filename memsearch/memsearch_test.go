@@ -1,10 +1,16 @@
 package memsearch
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/polyverse/masche/memaccess"
 	"github.com/polyverse/masche/process"
 	"github.com/polyverse/masche/test"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 var needle []byte = []byte("Find This!")
@@ -110,3 +116,549 @@ func TestRegexpSearchInOtherProcess(t *testing.T) {
 		}
 	}
 }
+
+func checkMatches(t *testing.T, matches []Match, minLength int) {
+	if len(matches) == 0 {
+		t.Error("No matches found")
+		return
+	}
+
+	for i, match := range matches {
+		if i > 0 && match.Address <= matches[i-1].Address {
+			t.Errorf("Match at %x reported after match at %x", match.Address, matches[i-1].Address)
+		}
+
+		if match.Address < match.Region.Address || match.Address >= match.Region.Address+uintptr(match.Region.Size) {
+			t.Errorf("Match at %x is not in its region %v", match.Address, match.Region)
+		}
+
+		if len(match.Data) < minLength {
+			t.Errorf("Match at %x has only %d bytes", match.Address, len(match.Data))
+		}
+	}
+}
+
+func TestFindAllInOtherProcess(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	for _, buf := range buffersToFind {
+		matches, err, softerrors := FindAllBytesSequence(proc, 0, buf)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMatches(t, matches, len(buf))
+
+		for _, match := range matches {
+			if !bytes.Equal(match.Data, buf) {
+				t.Errorf("Match at %x is %v and not %v", match.Address, match.Data, buf)
+			}
+		}
+
+		// The first match must be the one FindBytesSequence finds
+		_, foundAddress, err, softerrors := FindBytesSequence(proc, 0, buf)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(matches) > 0 && matches[0].Address != foundAddress {
+			t.Errorf("First match at %x, but FindBytesSequence found %x", matches[0].Address, foundAddress)
+		}
+	}
+
+	matches, err, softerrors := FindAllBytesSequence(proc, 0, notPresent)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Fatalf("FindAllBytesSequence found a sequence of bytes that it shouldn't")
+	}
+
+	for _, str := range regexpToMatch {
+		matches, err, softerrors := FindAllRegexpMatches(proc, 0, regexp.MustCompile(str))
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMatches(t, matches, 1)
+	}
+
+	for _, str := range regexpToNotMatch {
+		matches, err, softerrors := FindAllRegexpMatches(proc, 0, regexp.MustCompile(str))
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(matches) != 0 {
+			t.Fatalf("FindAllRegexpMatches matched %s", str)
+		}
+	}
+}
+
+func TestMatcherScan(t *testing.T) {
+	hexPattern, err := HexPattern("hex", "de ad BE EF")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMatcher(
+		StringPattern("he", "he"),
+		StringPattern("she", "she"),
+		StringPattern("hers", "hers"),
+		NoCaseStringPattern("HIS", "HIS"),
+		UTF16LEPattern("wide", "hi"),
+		hexPattern,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := []byte("ushers his\xde\xad\xbe\xefh\x00i\x00")
+	expected := map[[2]int]bool{
+		// {pattern, end}
+		{1, 4}:  true,
+		{0, 4}:  true,
+		{2, 6}:  true,
+		{3, 10}: true,
+		{5, 14}: true,
+		{4, 18}: true,
+	}
+
+	m.scan(buf, func(pattern int, end int) bool {
+		if !expected[[2]int{pattern, end}] {
+			t.Errorf("Unexpected match of %s ending at %d", m.Patterns()[pattern].Name, end)
+		}
+		delete(expected, [2]int{pattern, end})
+		return true
+	})
+
+	for match := range expected {
+		t.Errorf("Pattern %s ending at %d not matched", m.Patterns()[match[0]].Name, match[1])
+	}
+
+	if _, err := HexPattern("invalid", "dea"); err == nil {
+		t.Error("An odd number of hexa digits should be an error")
+	}
+
+	if _, err := NewMatcher(StringPattern("empty", "")); err == nil {
+		t.Error("An empty pattern should be an error")
+	}
+}
+
+func TestFindAllPatternsInOtherProcess(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	patterns := make([]Pattern, 0)
+	for i, buf := range buffersToFind {
+		patterns = append(patterns, LiteralPattern(fmt.Sprintf("buffer %d", i), buf))
+	}
+	patterns = append(patterns, LiteralPattern("not present", notPresent))
+	patterns = append(patterns, NoCaseStringPattern("regexp string", "UN DIA VI UNA VACA"))
+
+	m, err := NewMatcher(patterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err, softerrors := FindAllPatterns(proc, 0, m)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, pattern := range patterns {
+		expected, err, softerrors := FindAllBytesSequence(proc, 0, pattern.Bytes)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := make([]Match, 0)
+		for _, match := range matches {
+			if match.Pattern == i {
+				found = append(found, match.Match)
+			}
+		}
+
+		if pattern.NoCase {
+			if len(found) == 0 {
+				t.Errorf("Pattern %s not found", pattern.Name)
+			}
+			continue
+		}
+
+		if len(found) != len(expected) {
+			t.Errorf("Pattern %s found %d times, expected %d", pattern.Name, len(found), len(expected))
+			continue
+		}
+
+		for j := range found {
+			if found[j].Address != expected[j].Address {
+				t.Errorf("Pattern %s found at %x, expected %x", pattern.Name, found[j].Address, expected[j].Address)
+			}
+		}
+	}
+}
+
+func TestCompileHexString(t *testing.T) {
+	var valid = []struct {
+		expr   string
+		buf    []byte
+		loc    []int
+		minLen int
+		maxLen int
+	}{
+		{"DE AD BE EF", []byte{0x00, 0xde, 0xad, 0xbe, 0xef}, []int{1, 5}, 4, 4},
+		{"{ de ad ?? ef }", []byte{0xde, 0xad, 0x12, 0xef}, []int{0, 4}, 4, 4},
+		{"DE A? ?D", []byte{0xde, 0xad, 0xde, 0xa0, 0x1d}, []int{2, 5}, 3, 3},
+		{"DE [2-4] 90 90", []byte{0xde, 0x01, 0x02, 0x03, 0x90, 0x90}, []int{0, 6}, 5, 7},
+		{"DE [-2] 90", []byte{0xde, 0x90}, []int{0, 2}, 2, 4},
+		{"DE [2] 90", []byte{0xde, 0x90, 0x90}, nil, 4, 4},
+		{"DE (AD | BE EF) 90", []byte{0xde, 0xbe, 0xef, 0x90}, []int{0, 4}, 3, 4},
+		{"DE (AD | BE (EF | 00) [1-2] 01) 90", []byte{0xde, 0xbe, 0x00, 0x33, 0x01, 0x90}, []int{0, 6}, 3, 7},
+	}
+
+	for _, c := range valid {
+		h, err := CompileHexString(c.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if h.MinLen() != c.minLen || h.MaxLen() != c.maxLen {
+			t.Errorf("%s: lengths %d-%d, expected %d-%d", c.expr, h.MinLen(), h.MaxLen(), c.minLen, c.maxLen)
+		}
+
+		loc := h.FindIndex(c.buf)
+		if (loc == nil) != (c.loc == nil) || (loc != nil && (loc[0] != c.loc[0] || loc[1] != c.loc[1])) {
+			t.Errorf("%s: found at %v, expected %v", c.expr, loc, c.loc)
+		}
+	}
+
+	var invalid = []string{
+		"",
+		"DE A",
+		"DE AG",
+		"[2] DE",
+		"DE [2]",
+		"DE [2-] AD",
+		"DE [4-2] AD",
+		"DE [x] AD",
+		"DE (AD | ) 90",
+		"DE (AD | BE 90",
+		"DE AD) 90",
+	}
+
+	for _, expr := range invalid {
+		if _, err := CompileHexString(expr); err == nil {
+			t.Errorf("%q should be an invalid hex string", expr)
+		}
+	}
+}
+
+func TestHexStringWideJumps(t *testing.T) {
+	// Each of the first bytes of buf matches every AA, so the jumps would be tried in all their combinations at every
+	// start if the matcher backtracked blindly.
+	h := MustCompileHexString("{AA [0-1000] AA [0-1000] AA [0-1000] BB}")
+	buf := bytes.Repeat([]byte{0xaa}, 8192)
+
+	done := make(chan []int)
+	go func() {
+		done <- h.FindIndex(buf)
+	}()
+	select {
+	case loc := <-done:
+		if loc != nil {
+			t.Errorf("Found at %v, expected no match", loc)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Matching the jumps takes too long")
+	}
+
+	buf[3000] = 0xbb
+	if loc := h.FindIndex(buf); loc == nil || loc[0] != 0 || loc[1] != 3001 {
+		t.Errorf("Found at %v, expected [0 3001]", loc)
+	}
+	if end, matched := h.MatchAt(buf, 2000); !matched || end != 3001 {
+		t.Errorf("Matched at 2000 up to %d (%v), expected 3001", end, matched)
+	}
+	if _, matched := h.MatchAt(buf, 2999); matched {
+		t.Error("Matched at 2999, but there is no BB after the three AA from there")
+	}
+}
+
+func TestHexStringSearchInOtherProcess(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	var hexStrings = []struct {
+		expr   string
+		buffer []byte
+	}{
+		{"0C 0A 0F 0E", buffersToFind[0]},
+		{"0C 0A ?F 0E", buffersToFind[0]},
+		{"0D 0E (0A | FF) 0D [1-3] 0E 0F", buffersToFind[1]},
+		{"0B 0E 0B 0E 0F 0E 00", buffersToFind[2]},
+	}
+
+	for _, c := range hexStrings {
+		h := MustCompileHexString(c.expr)
+		matches, err, softerrors := FindAllHexStringMatches(proc, 0, h)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMatches(t, matches, h.MinLen())
+
+		expected, err, softerrors := FindAllBytesSequence(proc, 0, c.buffer)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(matches) != len(expected) {
+			t.Errorf("%s found %d times, expected %d", c.expr, len(matches), len(expected))
+			continue
+		}
+
+		for i := range matches {
+			if matches[i].Address != expected[i].Address || !bytes.Equal(matches[i].Data, c.buffer) {
+				t.Errorf("%s found %v at %x, expected %v at %x", c.expr, matches[i].Data, matches[i].Address,
+					c.buffer, expected[i].Address)
+			}
+		}
+
+		found, foundAddress, err, softerrors := FindHexStringMatch(proc, 0, h)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !found || foundAddress != expected[0].Address {
+			t.Errorf("%s first found at %x, expected %x", c.expr, foundAddress, expected[0].Address)
+		}
+	}
+
+	found, _, err, softerrors := FindHexStringMatch(proc, 0, MustCompileHexString("DE AD BE EF [0-16] C0 FF EE"))
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Error("FindHexStringMatch found a hex string that it shouldn't")
+	}
+}
+
+func TestRegexpMaxLen(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	// The heap and the stack have long runs of zeros, longer than the buffers used by default.
+	const maxLen = 7000
+	r := regexp.MustCompile(strings.Repeat(`\x00{1000}`, maxLen/1000))
+
+	found, _, err, softerrors := FindRegexpMatch(proc, 0, r)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Errorf("FindRegexpMatch found a match longer than DefaultRegexpMaxLen")
+	}
+
+	found, foundAddress, err, softerrors := FindRegexpMatchMaxLen(proc, 0, r, maxLen)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Fatalf("FindRegexpMatchMaxLen didn't find %d zeros", maxLen)
+	}
+
+	// Searching the whole memory for such a long regexp is slow, a few matches are enough.
+	matches := make([]Match, 0)
+	err, softerrors = FindAllRegexpMatchesMaxLenFunc(proc, 0, r, maxLen, func(match Match) (keepSearching bool) {
+		matches = append(matches, match)
+		return len(matches) < 5
+	})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, matches, maxLen)
+
+	if len(matches) == 0 || matches[0].Address != foundAddress {
+		t.Fatalf("FindAllRegexpMatchesMaxLenFunc didn't find first the match at %x", foundAddress)
+	}
+
+	for i, match := range matches {
+		if len(match.Data) != maxLen || !bytes.Equal(match.Data, make([]byte, maxLen)) {
+			t.Errorf("Match at %x is not %d zeros", match.Address, maxLen)
+		}
+		if i > 0 && match.Address < matches[i-1].Address+maxLen {
+			t.Errorf("Match at %x overlaps the one at %x", match.Address, matches[i-1].Address)
+		}
+	}
+
+	if _, _, err, _ := FindRegexpMatchMaxLen(proc, 0, r, 0); err == nil {
+		t.Error("A maximum length of 0 should be an error")
+	}
+}
+
+func TestRegexpMatchAcrossBuffers(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	m, err, softerrors := memaccess.ReadMemoryMap(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := memaccess.NoRegionAvailable
+	m.Each(0, func(region memaccess.MemoryRegion) (keepIterating bool) {
+		if region.Kind == "[stack]" {
+			stack = region
+		}
+		return stack == memaccess.NoRegionAvailable
+	})
+	if stack == memaccess.NoRegionAvailable || stack.Size < 16384 {
+		t.Skip("The stack of the test process can't be found")
+	}
+
+	// The lowest part of the stack is unused. The matches cross the boundaries of 4096 bytes from its start, and the
+	// end of a first buffer of 4096+maxLen bytes.
+	const maxLen = 2048
+	offsets := []uintptr{4090, 6100}
+	data := append([]byte("QZXJ"), bytes.Repeat([]byte("A"), 100)...)
+	for _, offset := range offsets {
+		_, err, softerrors := memaccess.WriteMemory(proc, stack.Address+offset, data)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches := make([]Match, 0)
+	err, softerrors = FindAllRegexpMatchesMaxLenFunc(proc, stack.Address, regexp.MustCompile(`QZXJA+`), maxLen,
+		func(match Match) (keepSearching bool) {
+			matches = append(matches, match)
+			return len(matches) < len(offsets)
+		})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != len(offsets) {
+		t.Fatalf("Expected %d matches and got %d", len(offsets), len(matches))
+	}
+	for i, match := range matches {
+		if match.Address != stack.Address+offsets[i] || !bytes.Equal(match.Data, data) {
+			t.Errorf("Expected a match of %d bytes at %x and got %d bytes at %x", len(data),
+				stack.Address+offsets[i], len(match.Data), match.Address)
+		}
+	}
+}
+
+func TestFindContext(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := process.OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	// Zeros are everywhere, so canceling after the first match leaves plenty of memory to search.
+	ctx, cancel := context.WithCancel(context.Background())
+	matches := make([]Match, 0)
+	err, softerrors = FindAllBytesSequenceFuncContext(ctx, proc, 0, []byte{0}, func(match Match) (keepSearching bool) {
+		matches = append(matches, match)
+		cancel()
+		return true
+	})
+	test.PrintSoftErrors(softerrors)
+	if !memaccess.IsCanceled(err) {
+		t.Fatalf("Expected a CanceledError, got %v", err)
+	}
+
+	canceled := err.(*memaccess.CanceledError)
+	if len(matches) == 0 || canceled.Address <= matches[len(matches)-1].Address {
+		t.Errorf("Stopped at %x after finding %d matches", canceled.Address, len(matches))
+	}
+
+	found, _, err, softerrors := FindRegexpMatchContext(ctx, proc, 0, regexp.MustCompile(regexpToMatch[0]))
+	test.PrintSoftErrors(softerrors)
+	if found || !memaccess.IsCanceled(err) {
+		t.Errorf("FindRegexpMatchContext returned %v, %v with a canceled context", found, err)
+	}
+
+	found, _, err, softerrors = FindRegexpMatchContext(context.Background(), proc, 0,
+		regexp.MustCompile(regexpToMatch[0]))
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Errorf("FindRegexpMatchContext didn't find %s", regexpToMatch[0])
+	}
+}
@@ -0,0 +1,61 @@
+package process
+
+import (
+	"strings"
+)
+
+// AccessDiagnosis explains why the memory of a process can or can't be accessed, as returned by DiagnoseAccess.
+//
+// Only the fields that make sense in the current OS are filled.
+type AccessDiagnosis struct {
+	Pid int
+
+	// Accessible is true if the memory of the process could be opened. Otherwise Err is the error opening it.
+	Accessible bool
+	Err        error
+
+	// Zombie is true if the process exited but its parent didn't wait for it yet, so it has no memory anymore.
+	Zombie bool
+	// KernelThread is true if the process is a kernel thread, which has no user memory.
+	KernelThread bool
+
+	// PtraceScope is the value of the Yama ptrace_scope setting, or -1 if Yama is not enabled.
+	PtraceScope int
+	// Descendant is true if the process is a descendant of ours, which is needed when PtraceScope is 1.
+	Descendant bool
+	// CapSysPtrace is true if we have the CAP_SYS_PTRACE capability, which overrides most of the restrictions.
+	CapSysPtrace bool
+
+	// UidMismatch is true if the real, effective and saved uids of the process are not all our uid. GidMismatch is
+	// the same for gids.
+	UidMismatch bool
+	GidMismatch bool
+	// Dumpable is false if the process is known to be not dumpable, because it changed its credentials or called
+	// prctl(PR_SET_DUMPABLE, 0).
+	Dumpable bool
+	// DifferentUserNamespace is true if the process is known to be in another user namespace than ours, where our
+	// capabilities may not apply.
+	DifferentUserNamespace bool
+	// LSMs are the Linux Security Modules enabled, which can deny the access for their own reasons.
+	LSMs []string
+
+	// Reasons explain, in human readable form, why the memory of the process can't be accessed.
+	Reasons []string
+}
+
+// String returns the reasons of the diagnosis in a single line.
+func (d *AccessDiagnosis) String() string {
+	if d.Accessible {
+		return "The memory of the process can be accessed"
+	}
+	return strings.Join(d.Reasons, "; ")
+}
+
+// DiagnoseAccess tries to open the memory of the process with the given pid and reports why it can't be accessed,
+// checking the usual causes for it. OpenFromPid only reports the error opening the memory.
+//
+// The process may change between the checks, so they are only a hint.
+func DiagnoseAccess(pid int) (diagnosis *AccessDiagnosis, harderror error, softerrors []error) {
+	// This function is implemented by the OS-specific diagnoseAccess function.
+	return diagnoseAccess(pid)
+}
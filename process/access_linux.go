@@ -0,0 +1,172 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/polyverse/masche/common"
+)
+
+// capSysPtrace is the number of the CAP_SYS_PTRACE capability, see capabilities(7).
+const capSysPtrace = 19
+
+// pfKthread is the flag in /proc/<pid>/stat of kernel threads.
+const pfKthread = 0x00200000
+
+func diagnoseAccess(pid int) (diagnosis *AccessDiagnosis, harderror error, softerrors []error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return nil, &common.ProcessError{Pid: pid, Op: "read the stat file", Err: err}, nil
+	}
+
+	d := &AccessDiagnosis{Pid: pid, PtraceScope: -1, Dumpable: true}
+	d.Zombie = fields[statState] == "Z" || fields[statState] == "X"
+	if flags, err := strconv.ParseUint(fields[statFlags], 10, 64); err == nil {
+		d.KernelThread = flags&pfKthread != 0
+	}
+
+	mem, err := os.Open(common.MemFilePathFromPid(uint(pid)))
+	if err == nil {
+		mem.Close()
+		d.Accessible = true
+		return d, nil, nil
+	}
+	d.Err = &common.ProcessError{Pid: pid, Op: "open the mem file", Err: err}
+
+	own, err, serrs := readProcessStatus("self")
+	softerrors = append(softerrors, serrs...)
+	if err != nil {
+		return nil, &common.ProcessError{Pid: os.Getpid(), Op: "read the status file", Err: err}, softerrors
+	}
+	target, err, serrs := ReadProcessStatus(pid)
+	softerrors = append(softerrors, serrs...)
+	if err != nil {
+		return nil, &common.ProcessError{Pid: pid, Op: "read the status file", Err: err}, softerrors
+	}
+
+	if scope, err := ioutil.ReadFile("/proc/sys/kernel/yama/ptrace_scope"); err == nil {
+		d.PtraceScope, err = strconv.Atoi(strings.TrimSpace(string(scope)))
+		if err != nil {
+			d.PtraceScope = -1
+			softerrors = append(softerrors, fmt.Errorf("Invalid Yama ptrace_scope %q (%v)", scope, err))
+		}
+	}
+
+	d.Descendant = isDescendant(pid, os.Getpid())
+
+	d.CapSysPtrace = own.CapEff&(1<<capSysPtrace) != 0
+
+	// The filesystem uid and gid, the last ones, are the ones checked by the kernel against the real, effective and
+	// saved ones of the process.
+	for i := 0; i < 3; i++ {
+		d.UidMismatch = d.UidMismatch || target.Uid[i] != own.Uid[3]
+		d.GidMismatch = d.GidMismatch || target.Gid[i] != own.Gid[3]
+	}
+
+	// The files of a process that is not dumpable belong to root, no matter its effective uid.
+	if info, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid == 0 && target.Uid[1] != 0 {
+			d.Dumpable = false
+		}
+	}
+
+	ownNs, err := os.Readlink("/proc/self/ns/user")
+	if err == nil {
+		if targetNs, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", "user")); err == nil {
+			d.DifferentUserNamespace = ownNs != targetNs
+		}
+	}
+
+	if lsm, err := ioutil.ReadFile("/sys/kernel/security/lsm"); err == nil {
+		for _, name := range strings.Split(strings.TrimSpace(string(lsm)), ",") {
+			if name != "" {
+				d.LSMs = append(d.LSMs, name)
+			}
+		}
+	}
+
+	d.Reasons = accessReasons(d, target, own)
+	return d, nil, softerrors
+}
+
+// accessReasons explains the diagnosis of a process that couldn't be accessed, following the checks done by the
+// kernel described in ptrace(2).
+func accessReasons(d *AccessDiagnosis, target, own ProcessStatus) (reasons []string) {
+	if d.Zombie {
+		reasons = append(reasons, "The process is a zombie: it exited and its memory was released")
+	}
+	if d.KernelThread {
+		reasons = append(reasons, "The process is a kernel thread, which has no user memory")
+	}
+
+	switch {
+	case d.PtraceScope == 1 && !d.CapSysPtrace && !d.Descendant:
+		reasons = append(reasons, "Yama ptrace_scope is 1, so without CAP_SYS_PTRACE only our descendants can be "+
+			"accessed, unless they allow it with prctl(PR_SET_PTRACER)")
+	case d.PtraceScope == 2 && !d.CapSysPtrace:
+		reasons = append(reasons, "Yama ptrace_scope is 2, so only processes with CAP_SYS_PTRACE can access others")
+	case d.PtraceScope >= 3:
+		reasons = append(reasons, fmt.Sprintf("Yama ptrace_scope is %d, so no process can access others",
+			d.PtraceScope))
+	}
+
+	if !d.CapSysPtrace {
+		if d.UidMismatch {
+			reasons = append(reasons, fmt.Sprintf("The real, effective and saved uids of the process (%d, %d, %d) "+
+				"are not all our uid %d, and we don't have CAP_SYS_PTRACE", target.Uid[0], target.Uid[1],
+				target.Uid[2], own.Uid[3]))
+		}
+		if d.GidMismatch {
+			reasons = append(reasons, fmt.Sprintf("The real, effective and saved gids of the process (%d, %d, %d) "+
+				"are not all our gid %d, and we don't have CAP_SYS_PTRACE", target.Gid[0], target.Gid[1],
+				target.Gid[2], own.Gid[3]))
+		}
+		if !d.Dumpable {
+			reasons = append(reasons, "The process is not dumpable, because it changed its credentials or called "+
+				"prctl(PR_SET_DUMPABLE, 0), and we don't have CAP_SYS_PTRACE")
+		}
+	} else if d.DifferentUserNamespace {
+		reasons = append(reasons, "The process is in a different user namespace, where our CAP_SYS_PTRACE may not "+
+			"apply")
+	}
+
+	if len(reasons) == 0 && errors.Is(d.Err, common.ErrPermissionDenied) {
+		lsms := "none found"
+		if len(d.LSMs) > 0 {
+			lsms = strings.Join(d.LSMs, ", ")
+		}
+		reasons = append(reasons, fmt.Sprintf("No other reason was found, so it was probably denied by a Linux "+
+			"Security Module (enabled: %s)", lsms))
+	} else if len(reasons) == 0 {
+		reasons = append(reasons, fmt.Sprintf("Unknown reason: %v", d.Err))
+	}
+
+	return reasons
+}
+
+// isDescendant returns true if the process pid is a descendant of the process ancestor.
+func isDescendant(pid, ancestor int) bool {
+	// The loop is bounded in case the processes change while we walk them.
+	for i := 0; i < 1024 && pid > 1; i++ {
+		fields, err := readStatFields(pid)
+		if err != nil {
+			return false
+		}
+
+		pid, err = strconv.Atoi(fields[statPpid])
+		if err != nil {
+			return false
+		}
+		if pid == ancestor {
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,9 +4,12 @@
 package process
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"sort"
+
+	"github.com/polyverse/masche/common"
 )
 
 // Process type represents a running processes that can be used by other modules.
@@ -27,11 +30,32 @@ type Process interface {
 	Handle() uintptr
 }
 
+// ProcessGoneError is the hard error returned when an open process doesn't exist anymore, so its pid may have been
+// recycled for another process.
+type ProcessGoneError struct {
+	Pid int
+}
+
+func (e *ProcessGoneError) Error() string {
+	return fmt.Sprintf("Process %d is gone, its pid may belong to another process now", e.Pid)
+}
+
+// Is makes errors.Is(err, common.ErrProcessExited) true for a ProcessGoneError.
+func (e *ProcessGoneError) Is(target error) bool {
+	return target == common.ErrProcessExited
+}
+
+// IsProcessGone returns true if err is or wraps a ProcessGoneError.
+func IsProcessGone(err error) bool {
+	var goneErr *ProcessGoneError
+	return errors.As(err, &goneErr)
+}
+
 func GetProcess(pid int) Process {
 	return getProcess(pid)
 }
 
-// OpenFromPid opens a process by its pid.
+// OpenFromPid opens a process by its pid. If it fails because its memory can't be accessed, DiagnoseAccess tells why.
 func OpenFromPid(pid int) (p Process, harderror error, softerrors []error) {
 	// This function is implemented by the OS-specific openFromPid function.
 	return openFromPid(pid)
@@ -54,29 +78,10 @@ func GetAllPids() (pids []int, harderror error, softerrors []error) {
 // OpenAll opens all the running processes returning a slice of Process.
 // A race condition may make this generate some softerrors because from the time pids are get to actually opened some
 // of them may have dead.
+//
+// All the processes are open at the same time, WalkAll only opens one at a time.
 func OpenAll() (ps []Process, harderror error, softerrors []error) {
-	pids, err, softs := GetAllPids()
-	softerrs := make([]error, 0)
-	if softs != nil {
-		softerrs = append(softerrs, softs...)
-	}
-	if err != nil {
-		return nil, err, softerrs
-	}
-
-	ps = make([]Process, 0)
-	for _, pid := range pids {
-		p, err, softs := OpenFromPid(pid)
-		if err != nil {
-			softerrs = append(softerrs, fmt.Errorf("Pid: %d failed to Open. Error: %v", pid, err))
-			continue
-		}
-		if softs != nil {
-			softerrs = append(softerrs, softs...)
-		}
-		ps = append(ps, p)
-	}
-	return ps, nil, softerrs
+	return Select(All())
 }
 
 // CloseAll closes all the processes from the given slice.
@@ -97,30 +102,8 @@ func CloseAll(ps []Process) (harderrors []error, softerrors []error) {
 	return harderrors, softerrors
 }
 
-// OpenByName recieves a Regexp an returns a slice with all the Processes whose name matches it.
+// OpenByName recieves a Regexp an returns a slice with all the Processes whose name matches it. Select can filter
+// the processes by more than their names.
 func OpenByName(r *regexp.Regexp) (ps []Process, harderror error, softerrors []error) {
-	procs, harderror, softerrors := OpenAll()
-	if harderror != nil {
-		return nil, harderror, nil
-	}
-
-	matchs := make([]Process, 0)
-
-	for _, p := range procs {
-		name, err, softs := p.Name()
-		if err != nil {
-			softerrors = append(softerrors, err)
-		}
-		if softs != nil {
-			softerrors = append(softerrors, softs...)
-		}
-
-		if r.MatchString(name) {
-			matchs = append(matchs, p)
-		} else {
-			p.Close()
-		}
-	}
-
-	return matchs, nil, softerrors
+	return Select(NameMatches(r))
 }
@@ -6,7 +6,10 @@ package process
 // #cgo CFLAGS: -std=c99
 import "C"
 import (
+	"fmt"
 	"github.com/polyverse/masche/cresponse"
+	"os"
+	"runtime"
 	"unsafe"
 )
 
@@ -45,3 +48,63 @@ func openFromPid(pid int) (p Process, harderror error, softerrors []error) {
 
 	return result, harderror, softerrors
 }
+
+// diagnoseAccess only tries to open the process, as the reasons why it can't be accessed are not checked on this OS.
+func diagnoseAccess(pid int) (diagnosis *AccessDiagnosis, harderror error, softerrors []error) {
+	d := &AccessDiagnosis{Pid: pid, PtraceScope: -1, Dumpable: true}
+
+	p, err, softerrors := openFromPid(pid)
+	if err != nil {
+		d.Err = err
+		d.Reasons = []string{err.Error()}
+		return d, nil, softerrors
+	}
+
+	d.Accessible = true
+	_, serrs := p.Close()
+	return d, nil, append(softerrors, serrs...)
+}
+
+func listThreads(p Process) (threads []Thread, harderror error, softerrors []error) {
+	return nil, fmt.Errorf("Listing the threads of a process is not supported on %s", runtime.GOOS), nil
+}
+
+func readTreeEntries() (entries []treeEntry, harderror error, softerrors []error) {
+	pids, harderror, softerrors := getAllPids()
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	for _, pid := range pids {
+		info, err := processInfo(pid)
+		if err != nil {
+			softerrors = append(softerrors, err)
+			continue
+		}
+
+		entries = append(entries, treeEntry{pid: pid, parentPid: info.GetParentProcessId(), name: info.GetCommand()})
+	}
+
+	return entries, nil, softerrors
+}
+
+func openProcEventSource() (procEventSource, error) {
+	return nil, fmt.Errorf("Process events are not supported on %s", runtime.GOOS)
+}
+
+func readProcessState(pid int) (state processState, err error) {
+	info, err := processInfo(pid)
+	if err != nil {
+		return state, err
+	}
+
+	return processState{parentPid: info.GetParentProcessId(), program: info.GetExecutable()}, nil
+}
+
+func openExecutable(pid int) (*os.File, error) {
+	name, err := processExe(pid)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
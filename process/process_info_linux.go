@@ -1,168 +1,340 @@
 package process
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unsafe"
 )
 
-type linuxProcessInfo struct {
-	Id              int    `json:"id" statusFileKey:"Pid"`
-	Command         string `json:"command" statusFileKey:"Name"`
-	UserId          int    `json:"userId" statusFileKey:"Uid"`
-	UserName        string `json:"userName" statusFileKey:""`
-	GroupId         int    `json:"groupId" statusFileKey:"Gid"`
-	GroupName       string `json:"groupName" statusFileKey:""`
-	ParentProcessId int    `json:"parentProcessId" statusFileKey:"PPid"`
+// LinuxProcessInfo is the ProcessInfo returned on Linux, gathered from the files in /proc/<pid>.
+type LinuxProcessInfo struct {
+	Id              int    `json:"id"`
+	Command         string `json:"command"`
+	UserId          int    `json:"userId"`
+	UserName        string `json:"userName"`
+	GroupId         int    `json:"groupId"`
+	GroupName       string `json:"groupName"`
+	ParentProcessId int    `json:"parentProcessId"`
 	Executable      string `json:"executable"`
+
+	// Args is the full argv of the process, empty for kernel threads and zombies.
+	Args []string `json:"args"`
+	// Environ is the initial environment of the process, only read if it's asked for.
+	Environ []string `json:"environ,omitempty"`
+	// Cwd is the current working directory of the process, empty if it can't be read.
+	Cwd string `json:"cwd"`
+
+	// State is the state of the process as shown by ps(1), like R (running), S (sleeping) or Z (zombie).
+	State string `json:"state"`
+	// StartTime is when the process started, and StartTicks the same in clock ticks after the system boot.
+	StartTime  time.Time `json:"startTime"`
+	StartTicks uint64    `json:"startTicks"`
+	Nice       int       `json:"nice"`
+	Priority   int       `json:"priority"`
+	Threads    int       `json:"threads"`
+	// RSS is the resident set size and VSZ the size of the virtual memory of the process, both in bytes.
+	RSS uint64 `json:"rss"`
+	VSZ uint64 `json:"vsz"`
+
+	// UserId and GroupId are the real ids of the process, these are the other ones.
+	EffectiveUserId    int    `json:"effectiveUserId"`
+	EffectiveUserName  string `json:"effectiveUserName"`
+	SavedUserId        int    `json:"savedUserId"`
+	SavedUserName      string `json:"savedUserName"`
+	EffectiveGroupId   int    `json:"effectiveGroupId"`
+	EffectiveGroupName string `json:"effectiveGroupName"`
+	SavedGroupId       int    `json:"savedGroupId"`
+	SavedGroupName     string `json:"savedGroupName"`
+
+	SessionId      int `json:"sessionId"`
+	ProcessGroupId int `json:"processGroupId"`
+	// Tty is the name of the controlling terminal under /dev, like pts/0, or empty if there is none.
+	Tty string `json:"tty"`
+
+	// Status has all the fields of the /proc/<pid>/status file of the process.
+	Status ProcessStatus `json:"status"`
 }
 
-func (lpi linuxProcessInfo) GetId() int {
+func (lpi LinuxProcessInfo) GetId() int {
 	return lpi.Id
 }
 
-func (lpi linuxProcessInfo) GetCommand() string {
+func (lpi LinuxProcessInfo) GetCommand() string {
 	return lpi.Command
 }
 
-func (lpi linuxProcessInfo) GetParentProcessId() int {
+func (lpi LinuxProcessInfo) GetParentProcessId() int {
 	return lpi.ParentProcessId
 }
 
-func (lpi linuxProcessInfo) GetExecutable() string {
+func (lpi LinuxProcessInfo) GetExecutable() string {
 	return lpi.Executable
 }
 
-var (
-	tmpLpi         = linuxProcessInfo{}
-	keyToFieldName = map[string]string{}
-	mtx            = &sync.RWMutex{}
-)
+func processInfo(pid int) (LinuxProcessInfo, error) {
+	return GetLinuxProcessInfo(pid, false)
+}
 
-func processInfo(pid int) (linuxProcessInfo, error) {
+// GetLinuxProcessInfo works as GetProcessInfo, but returns all the information available on Linux. The environment of
+// the process is only read if environ is true.
+//
+// As with GetProcessInfo, if some of the information can't be read an error is returned with the rest of it.
+func GetLinuxProcessInfo(pid int, environ bool) (LinuxProcessInfo, error) {
 	statusPath := filepath.Join("/proc", fmt.Sprintf("%d", pid), "status")
 	statusFile, err := os.Open(statusPath)
 	if err != nil {
-		return linuxProcessInfo{}, fmt.Errorf("Unable to open proc %d's status file at %s (%v)", pid, statusPath, err)
+		return LinuxProcessInfo{}, fmt.Errorf("Unable to open proc %d's status file at %s (%v)", pid, statusPath, err)
 	}
 	defer statusFile.Close()
 
 	data, err := ioutil.ReadAll(statusFile)
 	if err != nil {
-		return linuxProcessInfo{}, fmt.Errorf("Unable to read data from proc %d's status file at %s (%v)", pid, statusPath, err)
+		return LinuxProcessInfo{}, fmt.Errorf("Unable to read data from proc %d's status file at %s (%v)", pid, statusPath, err)
 	}
 
-	lpi := linuxProcessInfo{}
-	err = parseStatusToStruct(data, &lpi)
+	status, err, softerrors := ParseProcessStatus(data)
 	if err != nil {
-		return linuxProcessInfo{}, fmt.Errorf("Unable to process data from %s into linuxProcessInfo struct (%v)", statusPath, err)
+		return LinuxProcessInfo{}, fmt.Errorf("Unable to process data from %s into LinuxProcessInfo struct (%v)", statusPath, err)
 	}
-
-	//we ignore this error
-	lpi.Executable, err = ProcessExe(pid)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[Warning] Error when expanding symlink to executable: %v\n", err)
+	// The fields of the lines that couldn't be parsed are missing, but the rest of the information is returned.
+	var statusErr error
+	if len(softerrors) > 0 {
+		statusErr = fmt.Errorf("Unable to parse some lines of %s (%v)", statusPath, softerrors)
 	}
 
-	return lpi, err
-}
+	lpi := LinuxProcessInfo{Id: status.Pid, Command: status.Name, ParentProcessId: status.PPid, Status: status}
+	lpi.readCredentials(status)
 
-func processExe(pid int) (string, error) {
-	exePath := filepath.Join("/proc", fmt.Sprintf("%d", pid), "exe")
-	name, err := filepath.EvalSymlinks(exePath)
-	if err != nil {
-		return "", fmt.Errorf("Unable to expand process executable symlink %s (%v)", exePath, err)
+	if err := lpi.readStat(pid); err != nil {
+		return LinuxProcessInfo{}, fmt.Errorf("Unable to read the stat file of proc %d (%v)", pid, err)
 	}
-	return name, nil
-}
 
-func parseStatusToStruct(data []byte, lpi *linuxProcessInfo) error {
-	if lpi == nil {
-		return fmt.Errorf("Cannot parse Process Status into a nil linuxProcessInfo")
+	// The command line is empty for kernel threads and zombies, and the cwd can't be read without the permissions to
+	// access the process.
+	if cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline")); err == nil {
+		lpi.Args = splitNulSeparated(cmdline)
 	}
+	lpi.Cwd, _ = os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "cwd"))
 
-	r := bufio.NewReader(bytes.NewReader(data))
-	for line, err := r.ReadString('\n'); err != io.EOF; line, err = r.ReadString('\n') {
+	var environErr error
+	if environ {
+		data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
 		if err != nil {
-			return fmt.Errorf("Error when parsing Status line from Proc Status data (%v)", err)
+			environErr = fmt.Errorf("Unable to read the environment of proc %d (%v)", pid, err)
 		}
+		lpi.Environ = splitNulSeparated(data)
+	}
 
-		statusComponents := strings.Split(line, ":")
-		if len(statusComponents) != 2 {
-			continue
-		}
+	// The executable can't be read for kernel threads, zombies, or without the permissions to access the process, so
+	// its error is returned with the rest of the information.
+	lpi.Executable, err = ProcessExe(pid)
+	if err == nil {
+		err = environErr
+	}
+	if err == nil {
+		err = statusErr
+	}
+	return lpi, err
+}
+
+// readCredentials fills the ids of the user and group of the process, and their names, from its status.
+func (lpi *LinuxProcessInfo) readCredentials(status ProcessStatus) {
+	lpi.UserId, lpi.EffectiveUserId, lpi.SavedUserId = status.Uid[0], status.Uid[1], status.Uid[2]
+	lpi.GroupId, lpi.EffectiveGroupId, lpi.SavedGroupId = status.Gid[0], status.Gid[1], status.Gid[2]
+
+	lpi.UserName = lookupUserName(lpi.UserId)
+	lpi.EffectiveUserName = lookupUserName(lpi.EffectiveUserId)
+	lpi.SavedUserName = lookupUserName(lpi.SavedUserId)
+	lpi.GroupName = lookupGroupName(lpi.GroupId)
+	lpi.EffectiveGroupName = lookupGroupName(lpi.EffectiveGroupId)
+	lpi.SavedGroupName = lookupGroupName(lpi.SavedGroupId)
+}
 
-		key := strings.TrimSpace(statusComponents[0])
-		value := strings.TrimSpace(statusComponents[1])
+// atClkTck is the type of the entry of the auxiliary vector with the frequency of the clock ticks.
+const atClkTck = 17
 
-		vals := strings.Fields(value)
-		if len(vals) > 0 {
-			value = vals[0]
+// userHz is the frequency of the clock ticks in the files under /proc. The kernel passes it to every program in its
+// auxiliary vector, and it's 100 on most systems.
+var userHz = readUserHz()
+
+// readUserHz returns the frequency of the clock ticks from /proc/self/auxv, or 100 if it can't be read.
+func readUserHz() int64 {
+	auxv, err := ioutil.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return 100
+	}
+	if hz, ok := auxvValue(auxv, atClkTck); ok && hz > 0 {
+		return int64(hz)
+	}
+	return 100
+}
+
+// auxvValue returns the value of the entry of the given type of an auxiliary vector, which is made of pairs of native
+// words with the type and the value of each entry.
+func auxvValue(auxv []byte, key uint64) (value uint64, ok bool) {
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	word := func(b []byte) uint64 {
+		if wordSize == 4 {
+			return uint64(nativeEndian.Uint32(b))
 		}
+		return nativeEndian.Uint64(b)
+	}
 
-		fieldName := getFieldNameForKey(key)
-		vfield := reflect.ValueOf(lpi).Elem().FieldByName(fieldName)
-		if !vfield.IsValid() {
-			continue //Nobody wants this value
+	for i := 0; i+2*wordSize <= len(auxv); i += 2 * wordSize {
+		if word(auxv[i:]) == key {
+			return word(auxv[i+wordSize:]), true
 		}
+	}
+	return 0, false
+}
 
-		val, err := stringToReflectValue(value, vfield.Type())
-		if err != nil {
+// readStat fills the information of the process from its /proc/<pid>/stat file.
+func (lpi *LinuxProcessInfo) readStat(pid int) error {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return err
+	}
+	if len(fields) <= statRss {
+		return fmt.Errorf("Invalid stat file of process %d", pid)
+	}
+
+	lpi.State = fields[statState]
+
+	var ttyNr int
+	ints := map[int]*int{statPgrp: &lpi.ProcessGroupId, statSession: &lpi.SessionId, statTtyNr: &ttyNr,
+		statPriority: &lpi.Priority, statNice: &lpi.Nice, statNumThreads: &lpi.Threads}
+	for i, value := range ints {
+		if *value, err = strconv.Atoi(fields[i]); err != nil {
 			return err
 		}
+	}
+	lpi.Tty = ttyName(ttyNr)
 
-		vfield.Set(val)
+	if lpi.StartTicks, err = strconv.ParseUint(fields[statStartTime], 10, 64); err != nil {
+		return err
+	}
+	if bootTime, err := readBootTime(); err == nil {
+		lpi.StartTime = bootTime.Add(time.Duration(lpi.StartTicks) * time.Second / time.Duration(userHz))
+	}
+
+	if lpi.VSZ, err = strconv.ParseUint(fields[statVsize], 10, 64); err != nil {
+		return err
+	}
+	rss, err := strconv.ParseInt(fields[statRss], 10, 64)
+	if err != nil {
+		return err
 	}
+	if rss > 0 {
+		lpi.RSS = uint64(rss) * uint64(os.Getpagesize())
+	}
+
 	return nil
 }
 
-func stringToReflectValue(value string, t reflect.Type) (reflect.Value, error) {
-	switch t.Name() {
-	case "string":
-		return reflect.ValueOf(value), nil
-	case "int":
-		intVal, err := strconv.Atoi(value)
-		if err != nil {
-			return reflect.Value{}, fmt.Errorf("Error converting string %s into an integer. (%v)", value, err)
+// readBootTime returns the time the system booted, from the btime line of /proc/stat.
+func readBootTime() (time.Time, error) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(string(stat), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			btime, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(btime, 0), nil
 		}
-		return reflect.ValueOf(intVal), nil
 	}
-	return reflect.Value{}, fmt.Errorf("Unsupported Converstion: string %s to value of type %v", value, t)
+
+	return time.Time{}, fmt.Errorf("No btime found in /proc/stat")
+}
+
+// ttyName returns the name under /dev of the terminal with the given device number, as found in /proc/<pid>/stat, or
+// an empty string if it's 0. Only the usual terminals are recognised, the others are named by their numbers.
+func ttyName(ttyNr int) string {
+	if ttyNr == 0 {
+		return ""
+	}
+
+	major := (ttyNr >> 8) & 0xfff
+	minor := (ttyNr & 0xff) | ((ttyNr >> 12) & 0xfff00)
+	switch {
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("pts/%d", (major-136)*256+minor)
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("tty%d", minor)
+	case major == 4:
+		return fmt.Sprintf("ttyS%d", minor-64)
+	case major == 5 && minor == 1:
+		return "console"
+	}
+	return fmt.Sprintf("%d:%d", major, minor)
 }
 
-func getFieldNameForKey(key string) string {
-	mtx.RLock()
-	fieldName, ok := keyToFieldName[key]
-	mtx.RUnlock()
-	if ok {
-		return fieldName
+// splitNulSeparated splits the contents of files like /proc/<pid>/cmdline, where each string ends with a NUL byte.
+func splitNulSeparated(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
 	}
+	return strings.Split(string(data), "\x00")
+}
 
-	t := reflect.TypeOf(tmpLpi)
-	fieldForKey, found := t.FieldByNameFunc(func(name string) bool {
-		fieldCandidate, found := t.FieldByName(name)
-		if found && fieldCandidate.Tag.Get("statusFileKey") == key {
-			return true
+// The names of the users and groups are cached, as /etc/passwd and /etc/group would be read for each process
+// otherwise.
+var (
+	namesMtx   sync.Mutex
+	userNames  = map[int]string{}
+	groupNames = map[int]string{}
+)
+
+// lookupUserName returns the name of the user with the given uid, or an empty string if it has none.
+func lookupUserName(uid int) string {
+	namesMtx.Lock()
+	defer namesMtx.Unlock()
+
+	name, ok := userNames[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
 		}
-		return false
-	})
+		userNames[uid] = name
+	}
+	return name
+}
 
-	if !found {
-		return ""
+// lookupGroupName returns the name of the group with the given gid, or an empty string if it has none.
+func lookupGroupName(gid int) string {
+	namesMtx.Lock()
+	defer namesMtx.Unlock()
+
+	name, ok := groupNames[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			name = g.Name
+		}
+		groupNames[gid] = name
 	}
+	return name
+}
 
-	mtx.Lock()
-	defer mtx.Unlock()
-	keyToFieldName[key] = fieldForKey.Name
-	return keyToFieldName[key]
+func processExe(pid int) (string, error) {
+	exePath := filepath.Join("/proc", fmt.Sprintf("%d", pid), "exe")
+	name, err := filepath.EvalSymlinks(exePath)
+	if err != nil {
+		return "", fmt.Errorf("Unable to expand process executable symlink %s (%v)", exePath, err)
+	}
+	return name, nil
 }
 
 func appendError(errs []error, err error, format string, params ...interface{}) []error {
@@ -2,6 +2,7 @@ package process
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"github.com/polyverse/masche/common"
 	"io"
@@ -10,19 +11,56 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
 )
 
-type linuxProcess int
+// nativeEndian is the byte order of the data shared with the kernel, like netlink messages and auxiliary vectors.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// linuxProcess keeps the process' mem and maps files open from the moment it's opened until it's closed. That way
+// reading its memory doesn't need to open the files on each call, and as the file descriptors stay bound to the
+// original task a recycled pid won't make us read another process.
+//
+// The operations that access the process by its pid instead, like process_vm_readv(2), are protected by checking its
+// identity after them: a pidfd refers to the process opened even if its pid is recycled, and its start time tells it
+// apart from a new process with the same pid when pidfds are not supported.
+type linuxProcess struct {
+	pid int
+
+	// startTime is the start time of the process in /proc/<pid>/stat when it was opened, 0 if it wasn't.
+	startTime uint64
+	// pidfd refers to the process opened, or is -1 if it wasn't opened or pidfd_open(2) is not supported.
+	pidfd int
+
+	// mtx protects the files, and the offset of mapsFile, which needs to be rewinded before each read.
+	mtx      sync.Mutex
+	memFile  *os.File
+	mapsFile *os.File
 
-func getProcess(pid int) linuxProcess {
-	return linuxProcess(pid)
+	// memWriteFile is only opened the first time the memory of the process is written.
+	memWriteFile *os.File
 }
 
-func (p linuxProcess) Pid() int {
-	return int(p)
+// getProcess returns a Process for the given pid without opening it, so its files will be opened on each use.
+//
+// As its identity isn't captured either, nothing detects that its pid was recycled.
+func getProcess(pid int) *linuxProcess {
+	return &linuxProcess{pid: pid, pidfd: -1}
 }
 
-func (p linuxProcess) Name() (name string, harderror error, softerrors []error) {
+func (p *linuxProcess) Pid() int {
+	return p.pid
+}
+
+func (p *linuxProcess) Name() (name string, harderror error, softerrors []error) {
 	name, err := ProcessExe(p.Pid())
 
 	if err != nil {
@@ -47,6 +85,11 @@ func (p linuxProcess) Name() (name string, harderror error, softerrors []error)
 			if strings.HasPrefix(string(line), namePrefix) {
 				name := strings.Trim(string(line[len(namePrefix):]), " \t")
 
+				// As the exe link, the status file could be the one of a new process with the same pid.
+				if err := p.checkIdentity(); err != nil {
+					return "", err, nil
+				}
+
 				// We add the square brackets to be consistent with ps(1) output.
 				return "[" + name + "]", nil, nil
 			}
@@ -55,15 +98,250 @@ func (p linuxProcess) Name() (name string, harderror error, softerrors []error)
 		return name, fmt.Errorf("No name found for pid %v", p.Pid()), nil
 	}
 
+	// The exe link could be the one of a new process with the same pid.
+	if err := p.checkIdentity(); err != nil {
+		return "", err, nil
+	}
+
 	return name, err, nil
 }
 
-func (p linuxProcess) Close() (harderror error, softerrors []error) {
+func (p *linuxProcess) Close() (harderror error, softerrors []error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, f := range []**os.File{&p.memFile, &p.mapsFile, &p.memWriteFile} {
+		if *f == nil {
+			continue
+		}
+
+		if err := (*f).Close(); err != nil {
+			if harderror == nil {
+				harderror = err
+			} else {
+				softerrors = append(softerrors, err)
+			}
+		}
+		*f = nil
+	}
+
+	if p.pidfd >= 0 {
+		syscall.Close(p.pidfd)
+		p.pidfd = -1
+	}
+
+	return harderror, softerrors
+}
+
+func (p *linuxProcess) Handle() uintptr {
+	return uintptr(p.pid)
+}
+
+// MemFile returns the /proc/<pid>/mem file kept open by p, or nil if p doesn't keep one open.
+//
+// The file must not be closed, and as it's shared it should only be accessed with ReadAt and WriteAt.
+func MemFile(p Process) *os.File {
+	if lp, ok := p.(*linuxProcess); ok {
+		return lp.getMemFile()
+	}
+
+	return nil
+}
+
+// MemWriteFile returns the /proc/<pid>/mem file of p opened for writing. It's opened the first time it's needed and
+// kept open until p is closed. If p doesn't keep its files open nil is returned, and the caller must open the file
+// itself.
+//
+// The file must not be closed, and as it's shared it should only be accessed with WriteAt.
+func MemWriteFile(p Process) (*os.File, error) {
+	if lp, ok := p.(*linuxProcess); ok {
+		return lp.getMemWriteFile()
+	}
+
 	return nil, nil
 }
 
-func (p linuxProcess) Handle() uintptr {
-	return uintptr(p)
+// ReadMapsEntries parses the /proc/<pid>/maps file of p, reusing the file kept open by p if there is one.
+func ReadMapsEntries(p Process) (entries []common.MapsEntry, err error) {
+	lp, ok := p.(*linuxProcess)
+	if !ok {
+		lp = getProcess(p.Pid())
+	}
+
+	entries, err = lp.mapsEntries()
+
+	// Check the identity even if the read failed, as the maps file of a dead process can't be read.
+	if err := lp.checkIdentity(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// CheckIdentity returns a *ProcessGoneError if p is not the process that was opened anymore: it exited and its pid
+// may belong to another process now. Processes that were not opened with OpenFromPid are not checked.
+//
+// As a pid can't be recycled while the process is alive, an operation on p done by its pid can be trusted if
+// CheckIdentity returns nil after it.
+func CheckIdentity(p Process) error {
+	if lp, ok := p.(*linuxProcess); ok {
+		return lp.checkIdentity()
+	}
+
+	return nil
+}
+
+// Syscall numbers of pidfd_open(2) and pidfd_send_signal(2), which are the same in all the architectures and missing
+// from the syscall package.
+const (
+	sysPidfdSendSignal = 424
+	sysPidfdOpen       = 434
+)
+
+// openPidfd returns a pidfd for the given pid, or -1 if pidfds are not supported.
+func openPidfd(pid int) int {
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return -1
+	}
+	return int(fd)
+}
+
+func (p *linuxProcess) checkIdentity() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.pidfd >= 0 {
+		// Sending the signal 0 only checks that the process still exists.
+		_, _, errno := syscall.Syscall6(sysPidfdSendSignal, uintptr(p.pidfd), 0, 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.ESRCH:
+			return &ProcessGoneError{Pid: p.pid}
+		}
+		// We may not be allowed to send signals to the process, so we check its start time.
+	}
+
+	if p.startTime == 0 {
+		return nil
+	}
+
+	startTime, err := readStartTime(p.pid)
+	if err != nil || startTime != p.startTime {
+		return &ProcessGoneError{Pid: p.pid}
+	}
+	return nil
+}
+
+// readStartTime reads the start time of a process, in clock ticks after the system boot, from its /proc/<pid>/stat
+// file.
+func readStartTime(pid int) (uint64, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(fields[statStartTime], 10, 64)
+}
+
+// Indexes in the result of readStatFields of some fields of /proc/<pid>/stat. The first field returned is the 3rd one
+// of the file, as described in proc(5).
+const (
+	statState      = 3 - 3
+	statPpid       = 4 - 3
+	statPgrp       = 5 - 3
+	statSession    = 6 - 3
+	statTtyNr      = 7 - 3
+	statFlags      = 9 - 3
+	statUtime      = 14 - 3
+	statStime      = 15 - 3
+	statPriority   = 18 - 3
+	statNice       = 19 - 3
+	statNumThreads = 20 - 3
+	statStartTime  = 22 - 3
+	statVsize      = 23 - 3
+	statRss        = 24 - 3
+)
+
+// readStatFields reads the /proc/<pid>/stat file of a process and returns its fields after the name. There are at
+// least statStartTime+1 of them.
+func readStatFields(pid int) ([]string, error) {
+	_, fields, err := readStatFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	return fields, err
+}
+
+// readStatFile reads a stat file of a process or of one of its threads, and returns the name and the fields after it.
+func readStatFile(path string) (name string, fields []string, err error) {
+	stat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The name of the process is between parentheses and can have spaces and parentheses, so the fields are counted
+	// from the last ')'.
+	start := strings.IndexByte(string(stat), '(')
+	end := strings.LastIndexByte(string(stat), ')')
+	if start == -1 || end < start {
+		return "", nil, fmt.Errorf("Invalid stat file %s", path)
+	}
+
+	fields = strings.Fields(string(stat[end+1:]))
+	if len(fields) <= statStartTime {
+		return "", nil, fmt.Errorf("Invalid stat file %s", path)
+	}
+
+	return string(stat[start+1 : end]), fields, nil
+}
+
+func (p *linuxProcess) getMemFile() *os.File {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.memFile
+}
+
+func (p *linuxProcess) getMemWriteFile() (*os.File, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// If the process isn't open (or was closed) we don't keep any file.
+	if p.memFile == nil {
+		return nil, nil
+	}
+
+	if p.memWriteFile == nil {
+		memWriteFile, err := os.OpenFile(common.MemFilePathFromPid(uint(p.pid)), os.O_WRONLY, 0)
+		if err != nil {
+			return nil, &common.ProcessError{Pid: p.pid, Op: "open the mem file for writing", Err: err}
+		}
+		p.memWriteFile = memWriteFile
+	}
+
+	return p.memWriteFile, nil
+}
+
+func (p *linuxProcess) mapsEntries() (entries []common.MapsEntry, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	mapsFile := p.mapsFile
+	if mapsFile == nil {
+		mapsFile, err = os.Open(common.MapsFilePathFromPid(uint(p.pid)))
+		if err != nil {
+			return nil, &common.ProcessError{Pid: p.pid, Op: "open the maps file", Err: err}
+		}
+		defer mapsFile.Close()
+	} else if _, err := mapsFile.Seek(0, io.SeekStart); err != nil {
+		return nil, &common.ProcessError{Pid: p.pid, Op: "read the maps file", Err: err}
+	}
+
+	entries, err = common.ParseMapsFile(mapsFile)
+	if _, ok := err.(*common.MapsParseError); err != nil && !ok {
+		err = &common.ProcessError{Pid: p.pid, Op: "read the maps file", Err: err}
+	}
+	return entries, err
 }
 
 func getAllPids() (pids []int, harderror error, softerrors []error) {
@@ -86,14 +364,68 @@ func getAllPids() (pids []int, harderror error, softerrors []error) {
 }
 
 func openFromPid(pid int) (p Process, harderror error, softerrors []error) {
-	// Check if we have permissions to read the process memory
+	// The pidfd is opened first, and the start time read after, so if the process still exists after opening its
+	// files all of them refer to the same process.
+	lp := &linuxProcess{pid: pid, pidfd: openPidfd(pid)}
+
+	startTime, err := readStartTime(pid)
+	if err != nil {
+		lp.Close()
+		harderror = &common.ProcessError{Pid: pid, Op: "read the start time", Err: err}
+		return
+	}
+	lp.startTime = startTime
+
+	// Opening the mem file also checks if we have permissions to read the process memory
 	memPath := common.MemFilePathFromPid(uint(pid))
-	memFile, err := os.Open(memPath)
+	lp.memFile, err = os.Open(memPath)
 	if err != nil {
-		harderror = fmt.Errorf("Permission denied to access memory of process %v", pid)
+		lp.Close()
+		harderror = &common.ProcessError{Pid: pid, Op: "open the mem file", Err: err}
 		return
 	}
-	defer memFile.Close()
 
-	return linuxProcess(pid), nil, nil
+	mapsPath := common.MapsFilePathFromPid(uint(pid))
+	lp.mapsFile, err = os.Open(mapsPath)
+	if err != nil {
+		lp.Close()
+		harderror = &common.ProcessError{Pid: pid, Op: "open the maps file", Err: err}
+		return
+	}
+
+	if err := lp.checkIdentity(); err != nil {
+		lp.Close()
+		return nil, err, nil
+	}
+
+	return lp, nil, nil
+}
+
+func readTreeEntries() (entries []treeEntry, harderror error, softerrors []error) {
+	pids, harderror, softerrors := getAllPids()
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	entries = make([]treeEntry, 0, len(pids))
+	for _, pid := range pids {
+		name, fields, err := readStatFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if os.IsNotExist(err) {
+			// The process exited.
+			continue
+		} else if err != nil {
+			softerrors = append(softerrors, err)
+			continue
+		}
+
+		ppid, err := strconv.Atoi(fields[statPpid])
+		if err != nil {
+			softerrors = append(softerrors, fmt.Errorf("Invalid parent pid of process %d (%v)", pid, err))
+			continue
+		}
+
+		entries = append(entries, treeEntry{pid: pid, parentPid: ppid, name: name})
+	}
+
+	return entries, nil, softerrors
 }
@@ -0,0 +1,701 @@
+package process
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/polyverse/masche/common"
+	"github.com/polyverse/masche/test"
+)
+
+func TestCloseReleasesFiles(t *testing.T) {
+	// The maps of the process must not change while it's read twice, so we wait for it to initialize.
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if MemFile(proc) == nil {
+		t.Error("An open process should keep its mem file open")
+	}
+
+	entries, err := ReadMapsEntries(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The maps file must be rewinded on each read.
+	again, err := ReadMapsEntries(proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) == 0 || len(entries) != len(again) {
+		t.Errorf("Reading the maps file twice returned %d and %d entries", len(entries), len(again))
+	}
+
+	err, softerrors = proc.Close()
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if MemFile(proc) != nil {
+		t.Error("A closed process shouldn't keep its mem file open")
+	}
+
+	err, softerrors = proc.Close()
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Error("Closing a process twice shouldn't fail:", err)
+	}
+}
+
+func TestProcessGone(t *testing.T) {
+	cmd, err := test.LaunchTestCase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	proc, err, softerrors := OpenFromPid(pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	startTime, err := readStartTime(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startTime == 0 {
+		t.Error("The start time of the process should not be 0")
+	}
+
+	if err := CheckIdentity(proc); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if err := CheckIdentity(proc); !IsProcessGone(err) || !errors.Is(err, common.ErrProcessExited) {
+		t.Errorf("Expected a ProcessGoneError and got %v", err)
+	}
+
+	if _, err := ReadMapsEntries(proc); !IsProcessGone(err) {
+		t.Errorf("Reading the maps of a dead process should return a ProcessGoneError, and got %v", err)
+	}
+}
+
+func TestDiagnoseAccess(t *testing.T) {
+	cmd, err := test.LaunchTestCase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	d, err, softerrors := DiagnoseAccess(cmd.Process.Pid)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Accessible || d.Err != nil || len(d.Reasons) != 0 {
+		t.Errorf("Our child should be accessible, got %+v", d)
+	}
+
+	// The process 2 is kthreadd, the parent of all the kernel threads, unless we are in a pid namespace.
+	d, err, softerrors = DiagnoseAccess(2)
+	test.PrintSoftErrors(softerrors)
+	if err == nil && d.KernelThread && (d.Accessible || len(d.Reasons) == 0) {
+		t.Errorf("A kernel thread should not be accessible, got %+v", d)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if _, err, _ := DiagnoseAccess(cmd.Process.Pid); !errors.Is(err, common.ErrProcessExited) {
+		t.Errorf("Diagnosing a process that exited returned %v", err)
+	}
+}
+
+func TestAccessReasons(t *testing.T) {
+	target := ProcessStatus{Uid: [4]int{1000, 0, 1000, 1000}, Gid: [4]int{1000, 1000, 1000, 1000}}
+	own := ProcessStatus{Uid: [4]int{1000, 1000, 1000, 1000}, Gid: [4]int{1000, 1000, 1000, 1000}}
+
+	d := &AccessDiagnosis{PtraceScope: 1, UidMismatch: true, Dumpable: true, Err: common.ErrPermissionDenied}
+	reasons := accessReasons(d, target, own)
+	if len(reasons) != 2 || !strings.Contains(reasons[0], "ptrace_scope is 1") ||
+		!strings.Contains(reasons[1], "1000, 0, 1000") {
+		t.Errorf("Unexpected reasons %q", reasons)
+	}
+
+	d = &AccessDiagnosis{PtraceScope: 1, CapSysPtrace: true, Dumpable: true, LSMs: []string{"apparmor"},
+		Err: &common.ProcessError{Err: syscall.EACCES}}
+	reasons = accessReasons(d, own, own)
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "Linux Security Module (enabled: apparmor)") {
+		t.Errorf("Unexpected reasons %q", reasons)
+	}
+}
+
+func TestLinuxProcessInfo(t *testing.T) {
+	cmd := exec.Command(test.GetTestCasePath(), "first arg", "second")
+	cmd.Env = []string{"MASCHE_TEST=value"}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	before := time.Now()
+	info, err := GetLinuxProcessInfo(cmd.Process.Pid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Id != cmd.Process.Pid || info.ParentProcessId != os.Getpid() {
+		t.Errorf("Unexpected pids %d and %d", info.Id, info.ParentProcessId)
+	}
+
+	args := []string{test.GetTestCasePath(), "first arg", "second"}
+	if len(info.Args) != len(args) || info.Args[1] != args[1] || info.Args[2] != args[2] {
+		t.Errorf("Expected args %q and got %q", args, info.Args)
+	}
+	if len(info.Environ) != 1 || info.Environ[0] != "MASCHE_TEST=value" {
+		t.Errorf("Unexpected environment %q", info.Environ)
+	}
+
+	cwd, _ := os.Getwd()
+	if cwd, _ = filepath.EvalSymlinks(cwd); info.Cwd != cwd {
+		t.Errorf("Expected cwd %s and got %s", cwd, info.Cwd)
+	}
+
+	if info.UserId != os.Getuid() || info.EffectiveUserId != os.Geteuid() || info.GroupId != os.Getgid() {
+		t.Errorf("Unexpected credentials %+v", info)
+	}
+	if u, err := user.Current(); err == nil && info.UserName != u.Username {
+		t.Errorf("Expected user name %s and got %s", u.Username, info.UserName)
+	}
+
+	if info.State == "" || info.Threads < 1 || info.RSS == 0 || info.VSZ < info.RSS {
+		t.Errorf("Unexpected state, threads or memory sizes %+v", info)
+	}
+	if info.StartTicks == 0 || info.StartTime.After(before.Add(time.Second)) ||
+		info.StartTime.Before(before.Add(-time.Minute)) {
+		t.Errorf("Unexpected start time %v, %d ticks", info.StartTime, info.StartTicks)
+	}
+
+	self, err := GetLinuxProcessInfo(os.Getpid(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.Environ != nil || info.SessionId != self.SessionId || info.ProcessGroupId != self.ProcessGroupId ||
+		info.Tty != self.Tty {
+		t.Errorf("The child should inherit the session, process group and tty: %+v and %+v", info, self)
+	}
+}
+
+func TestUserHz(t *testing.T) {
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	auxv := make([]byte, 0, 6*wordSize)
+	for _, word := range []uint64{6, 4096, atClkTck, 250, 0, 0} {
+		b := make([]byte, 8)
+		nativeEndian.PutUint64(b, word)
+		if wordSize == 4 {
+			nativeEndian.PutUint32(b, uint32(word))
+		}
+		auxv = append(auxv, b[:wordSize]...)
+	}
+
+	if hz, ok := auxvValue(auxv, atClkTck); !ok || hz != 250 {
+		t.Errorf("Expected a frequency of 250 and got %d", hz)
+	}
+	if _, ok := auxvValue(auxv[:len(auxv)-1], 1); ok {
+		t.Error("Found an entry that isn't in the auxiliary vector")
+	}
+
+	out, err := exec.Command("getconf", "CLK_TCK").Output()
+	if err != nil {
+		t.Skipf("Unable to run getconf (%v)", err)
+	}
+	if hz := strings.TrimSpace(string(out)); hz != strconv.FormatInt(userHz, 10) {
+		t.Errorf("Expected a frequency of %s and got %d", hz, userHz)
+	}
+}
+
+func TestTtyName(t *testing.T) {
+	var names = map[int]string{0: "", 0x8803: "pts/3", 0x8900: "pts/256", 0x0401: "tty1", 0x0440: "ttyS0",
+		0x0501: "console"}
+
+	for ttyNr, name := range names {
+		if ttyName(ttyNr) != name {
+			t.Errorf("Expected %q for %x and got %q", name, ttyNr, ttyName(ttyNr))
+		}
+	}
+}
+
+const statusSample = `Name:	a: b
+Umask:	0022
+State:	S (sleeping)
+Tgid:	42
+Ngid:	0
+Pid:	42
+PPid:	1
+TracerPid:	7
+Uid:	1000	1001	1002	1003
+Gid:	100	101	102	103
+FDSize:	64
+Groups:	4 24 27 
+NStgid:	42	1
+NSpid:	42	1
+NSpgid:	42	1
+NSsid:	42	1
+Kthread:	0
+VmPeak:	    2640 kB
+VmRSS:	    1424 kB
+VmSwap:	       0 kB
+CoreDumping:	0
+THP_enabled:	1
+Threads:	3
+SigQ:	2/24002
+SigBlk:	0000000000010000
+SigCgt:	0000000180004a02
+CapEff:	000001fffeffffff
+CapAmb:	0000000000000000
+NoNewPrivs:	1
+Seccomp:	2
+Seccomp_filters:	1
+Speculation_Store_Bypass:	thread vulnerable
+Cpus_allowed:	f3
+Cpus_allowed_list:	0-1,4-7
+Mems_allowed_list:	0
+voluntary_ctxt_switches:	150
+nonvoluntary_ctxt_switches:	545
+`
+
+func TestParseProcessStatus(t *testing.T) {
+	status, err, softerrors := ParseProcessStatus([]byte(statusSample))
+	if err != nil || len(softerrors) != 0 {
+		t.Fatal(err, softerrors)
+	}
+
+	expected := ProcessStatus{Name: "a: b", Umask: 0022, State: "S (sleeping)", Tgid: 42, Pid: 42, PPid: 1,
+		TracerPid: 7, Uid: [4]int{1000, 1001, 1002, 1003}, Gid: [4]int{100, 101, 102, 103}, FDSize: 64,
+		Groups: []int{4, 24, 27}, NStgid: []int{42, 1}, NSpid: []int{42, 1}, NSpgid: []int{42, 1},
+		NSsid: []int{42, 1}, VmPeak: 2640 * 1024, VmRSS: 1424 * 1024, THPEnabled: true, Threads: 3, SigQueued: 2,
+		SigQueueLimit: 24002, SigBlk: 0x10000, SigCgt: 0x180004a02, CapEff: 0x1fffeffffff, NoNewPrivs: true,
+		Seccomp: 2, SeccompFilters: 1, SpeculationStoreBypass: "thread vulnerable",
+		CpusAllowed: []int{0, 1, 4, 5, 6, 7}, MemsAllowed: []int{0}, VoluntaryCtxtSwitches: 150,
+		NonvoluntaryCtxtSwitches: 545}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected\n%+v\nand got\n%+v", expected, status)
+	}
+
+	// Unknown lines, even if they don't look like the known ones, are ignored.
+	data := []byte(statusSample + "Future_field:\t1 2 x/y\n")
+	if status, err, softerrors := ParseProcessStatus(data); err != nil || len(softerrors) != 0 ||
+		!reflect.DeepEqual(status, expected) {
+		t.Errorf("An unknown line changed the status to %+v (%v, %v)", status, err, softerrors)
+	}
+
+	required := "Pid:\t1\nPPid:\t0\nUid:\t0 0 0 0\nGid:\t0 0 0 0\n"
+	if status, err, _ := ParseProcessStatus([]byte("Name:\tx\n" + required)); err != nil || status.Umask != -1 {
+		t.Errorf("A missing umask should be -1, got %d (%v)", status.Umask, err)
+	}
+
+	// The lines that can't be parsed leave their fields unset, and the rest of the status is parsed.
+	var malformed = []string{"VmRSS:\t12 MB\n", "SigQ:\t12\n", "NoNewPrivs:\t2\n", "Cpus_allowed_list:\t3-1\n",
+		"Umask:\t0999\n", "Threads:\tmany\n", "no colon\n"}
+	for _, line := range malformed {
+		status, err, softerrors := ParseProcessStatus([]byte(line + required + "Name:\tx\n"))
+		if err != nil || len(softerrors) != 1 {
+			t.Errorf("%q should be a soft error, got %v and %v", line, err, softerrors)
+		}
+		if status.Pid != 1 || status.Name != "x" || status.VmRSS != 0 || status.NoNewPrivs || status.Threads != 0 ||
+			status.Umask != -1 {
+			t.Errorf("Unexpected status with %q: %+v", line, status)
+		}
+	}
+
+	var invalid = []string{"Uid:\t1 2 3\n", "Uid:\t1 2 3 4 5\n", "Pid:\tx\n", "PPid:\t-\n", "Gid:\tx 0 0 0\n"}
+	for _, line := range invalid {
+		if _, err, _ := ParseProcessStatus([]byte(line + required)); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+	if _, err, _ := ParseProcessStatus([]byte("Name:\tx\nPid:\t1\n")); err == nil {
+		t.Error("A status without the PPid, Uid and Gid lines should be invalid")
+	}
+
+	self, err, softerrors := ReadProcessStatus(os.Getpid())
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.Pid != os.Getpid() || self.Uid[1] != os.Geteuid() || self.Threads < 1 || self.VmRSS == 0 {
+		t.Errorf("Unexpected status of our own process %+v", self)
+	}
+}
+
+func BenchmarkParseProcessStatus(b *testing.B) {
+	data := []byte(statusSample)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err, _ := ParseProcessStatus(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	// Our own process has many threads, created by the Go runtime.
+	proc, err, softerrors := OpenFromPid(os.Getpid())
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	threads, err, softerrors := Threads(proc)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(threads) < 2 || threads[0].Tid != os.Getpid() {
+		t.Fatalf("Unexpected threads %+v", threads)
+	}
+
+	name, _ := ioutil.ReadFile("/proc/self/comm")
+	main := threads[0]
+	if main.Name != strings.TrimSpace(string(name)) || main.State == "" || main.StackStart == 0 ||
+		main.StackEnd <= main.StackStart {
+		t.Errorf("Unexpected main thread %+v", main)
+	}
+
+	for i, thread := range threads {
+		if i > 0 && thread.Tid <= threads[i-1].Tid {
+			t.Errorf("The threads are not sorted by tid")
+		}
+		if thread.Syscall != UnknownSyscall && thread.StackPointer != 0 &&
+			(thread.StackPointer < thread.StackStart || thread.StackPointer >= thread.StackEnd) {
+			t.Errorf("The stack pointer of thread %+v is not in its stack", thread)
+		}
+	}
+}
+
+func TestParseSyscall(t *testing.T) {
+	var thread Thread
+	if err := thread.parseSyscall("202 0xc000 0x80 0x0 0x0 0x0 0x0 0x7ffd1000 0x46e3a3"); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Syscall != 202 || thread.SyscallArgs != [6]uintptr{0xc000, 0x80} || thread.StackPointer != 0x7ffd1000 ||
+		thread.ProgramCounter != 0x46e3a3 {
+		t.Errorf("Unexpected syscall %+v", thread)
+	}
+
+	thread = Thread{Syscall: UnknownSyscall}
+	if err := thread.parseSyscall("-1 0x7ffd2000 0x46e3a4"); err != nil || thread.Syscall != NoSyscall ||
+		thread.StackPointer != 0x7ffd2000 {
+		t.Errorf("Unexpected syscall %+v (%v)", thread, err)
+	}
+
+	thread = Thread{Syscall: UnknownSyscall}
+	if err := thread.parseSyscall("running"); err != nil || thread.Syscall != UnknownSyscall {
+		t.Errorf("Unexpected syscall %+v (%v)", thread, err)
+	}
+
+	for _, invalid := range []string{"", "1 0x1 0x2", "-1 0x1 0x2 0x3 0x4 0x5 0x6 0x7 0x8", "x 0x1 0x2"} {
+		if err := thread.parseSyscall(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	for _, noKernelEvents := range []bool{true, false} {
+		w, err, softerrors := NewWatcher(WatcherOptions{Interval: 20 * time.Millisecond,
+			NoKernelEvents: noKernelEvents, Buffer: 64})
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if noKernelEvents && w.KernelEvents() {
+			t.Errorf("The processes should be scanned")
+		}
+
+		// The shell executes the test program once it's found by the scans.
+		cmd := exec.Command("/bin/sh", "-c", "sleep 0.2; exec "+test.GetTestCasePath())
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		pid := cmd.Process.Pid
+
+		var kinds []EventKind
+		timeout := time.After(5 * time.Second)
+		for len(kinds) == 0 || kinds[len(kinds)-1] != Exited {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					t.Fatalf("The events were closed: %v", w.Err())
+				}
+				if event.Pid != pid {
+					continue
+				}
+
+				kinds = append(kinds, event.Kind)
+				switch event.Kind {
+				case Started:
+					if event.ParentPid != os.Getpid() {
+						t.Errorf("Unexpected parent in %+v", event)
+					}
+				case Exec:
+					if event.Info != nil && event.Info.GetExecutable() == test.GetTestCasePath() {
+						cmd.Process.Kill()
+						cmd.Wait()
+					}
+				}
+			case <-timeout:
+				t.Fatalf("Timeout with the events %v (kernel events: %v)", kinds, w.KernelEvents())
+			}
+		}
+
+		if kinds[0] != Started {
+			t.Errorf("Unexpected events %v (kernel events: %v)", kinds, w.KernelEvents())
+		}
+
+		w.Close()
+		for range w.Events {
+		}
+		if w.Err() != nil {
+			t.Error(w.Err())
+		}
+	}
+}
+
+func TestProcConnectorSkipsMalformedDatagrams(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	c := &procConnector{socket: os.NewFile(uintptr(fds[0]), "socketpair"), buf: make([]byte, os.Getpagesize())}
+	defer c.close()
+
+	// procEvent returns a datagram with an event of the process connector with the given size and fields.
+	procEvent := func(size int, what uint32, fields ...uint32) []byte {
+		msg := make([]byte, syscall.NLMSG_HDRLEN+cnMsgSize+size)
+		nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+		nativeEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+		cn := msg[syscall.NLMSG_HDRLEN:]
+		nativeEndian.PutUint32(cn[0:], cnIdxProc)
+		nativeEndian.PutUint32(cn[4:], cnValProc)
+		nativeEndian.PutUint16(cn[16:], uint16(size))
+		if size >= procEventHeaderLen+4*len(fields) {
+			nativeEndian.PutUint32(cn[cnMsgSize:], what)
+			for i, field := range fields {
+				nativeEndian.PutUint32(cn[cnMsgSize+procEventHeaderLen+4*i:], field)
+			}
+		}
+		return msg
+	}
+
+	valid := procEvent(procEventHeaderLen+24, procEventExec, 1234, 1234)
+	datagrams := [][]byte{
+		{1, 2, 3},
+		valid[:len(valid)-8],
+		procEvent(procEventHeaderLen+4, procEventExec),
+		valid,
+	}
+	for _, datagram := range datagrams {
+		if _, err := syscall.Write(fds[1], datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range datagrams {
+		events, err := c.read()
+		if err != nil {
+			t.Fatalf("The datagram %d stopped the reads: %v", i, err)
+		}
+		if i < len(datagrams)-1 {
+			if len(events) != 1 || events[0].Kind != Lost {
+				t.Errorf("The datagram %d should be lost, got %+v", i, events)
+			}
+		} else if len(events) != 1 || events[0].Kind != Exec || events[0].Pid != 1234 {
+			t.Errorf("Unexpected events %+v", events)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	cmd, err := test.LaunchTestCase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	self, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nsInode uint64
+	fmt.Sscanf(self, "pid:[%d]", &nsInode)
+
+	filter := And(
+		ParentPid(os.Getpid()),
+		Or(NameMatches(regexp.MustCompile(`^/nonexistent$`)), ArgsMatch(regexp.MustCompile(`tools/test$`))),
+		Not(CommandMatches(regexp.MustCompile(`^go$`))),
+		User(strconv.Itoa(os.Geteuid())),
+		Uid(os.Getuid()),
+		StartedWithin(time.Minute),
+		Executable(test.GetTestCasePath()),
+		CgroupMatches(regexp.MustCompile(``)),
+		InNamespace("pid", nsInode),
+		SameNamespace("net", os.Getpid()),
+	)
+
+	ps, err, softerrors := Select(filter)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseAll(ps)
+
+	if len(ps) != 1 || ps[0].Pid() != pid {
+		t.Fatalf("Expected only the process %d, got %v", pid, ps)
+	}
+	if name, err, _ := ps[0].Name(); err != nil || name != test.GetTestCasePath() {
+		t.Errorf("The process selected should be open, got %q (%v)", name, err)
+	}
+
+	data, err := ioutil.ReadFile(test.GetTestCasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	matches := ExecutableHash(hex.EncodeToString(hash[:]))
+	for _, wanted := range []bool{true, true, false} {
+		candidate := &Candidate{Pid: pid}
+		if !wanted {
+			candidate.Pid = os.Getpid()
+		}
+		if match, err := matches(candidate); err != nil || match != wanted {
+			t.Errorf("Unexpected hash match %v for process %d (%v)", match, candidate.Pid, err)
+		}
+	}
+
+	if ps, _, _ := Select(StartedBetween(time.Time{}, time.Unix(0, 0))); len(ps) != 0 {
+		CloseAll(ps)
+		t.Errorf("No process should have started before 1970")
+	}
+}
+
+func TestWalkProcesses(t *testing.T) {
+	pids := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		cmd, err := test.LaunchTestCase()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+		pids[cmd.Process.Pid] = true
+	}
+
+	// isClosed returns true if none of the files and the pidfd of a process walked are open.
+	isClosed := func(p Process) bool {
+		lp := p.(*linuxProcess)
+		lp.mtx.Lock()
+		defer lp.mtx.Unlock()
+		return lp.memFile == nil && lp.mapsFile == nil && lp.memWriteFile == nil && lp.pidfd < 0
+	}
+
+	// The walk stops at the first process, which must be closed after it.
+	var walked []Process
+	err, softerrors := WalkProcesses(ParentPid(os.Getpid()), func(p Process) bool {
+		if isClosed(p) {
+			t.Errorf("The process %d should be open", p.Pid())
+		}
+		walked = append(walked, p)
+		return false
+	})
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || !pids[walked[0].Pid()] {
+		t.Fatalf("Expected only one of the processes %v, got %v", pids, walked)
+	}
+	if !isClosed(walked[0]) {
+		t.Errorf("The process should be closed after the walk")
+	}
+
+	walked = nil
+	err, softerrors = WalkAll(func(p Process) bool {
+		walked = append(walked, p)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, p := range walked {
+		if pids[p.Pid()] {
+			found++
+		}
+		if !isClosed(p) {
+			t.Errorf("The process %d should be closed after the walk", p.Pid())
+		}
+	}
+	if found != len(pids) {
+		t.Errorf("The processes %v were not all walked", pids)
+	}
+
+	var panicked Process
+	func() {
+		defer func() { recover() }()
+		WalkByName(regexp.MustCompile(regexp.QuoteMeta(test.GetTestCasePath())), func(p Process) bool {
+			panicked = p
+			panic("stop")
+		})
+	}()
+	if panicked == nil || !pids[panicked.Pid()] || !isClosed(panicked) {
+		t.Errorf("The process should be closed after a panic")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err, _ = WalkProcessesContext(ctx, All(), func(p Process) bool {
+		t.Errorf("No process should be walked")
+		return false
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled and got %v", err)
+	}
+}
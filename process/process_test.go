@@ -86,10 +86,45 @@ func TestProcessInfo(t *testing.T) {
 	defer cmd.Process.Kill()
 
 	pid := int(cmd.Process.Pid)
-	procInfo, err := ProcessInfo(pid)
+	procInfo, err := GetProcessInfo(pid)
 	if err != nil {
 		t.Fatalf("Error when calling ProcInfo: %v", err)
 	}
 
 	fmt.Printf("ProcessInfo: %+v\n", procInfo)
 }
+
+func TestFilterComposition(t *testing.T) {
+	yes := func(c *Candidate) (bool, error) { return true, nil }
+	no := func(c *Candidate) (bool, error) { return false, nil }
+	fails := func(c *Candidate) (bool, error) { return true, fmt.Errorf("Unable to filter") }
+
+	filters := []struct {
+		name   string
+		filter Filter
+		match  bool
+		err    bool
+	}{
+		{"All", All(), true, false},
+		{"And()", And(), true, false},
+		{"And(yes, yes)", And(yes, yes), true, false},
+		{"And(yes, no)", And(yes, no), false, false},
+		{"And(no, fails)", And(no, fails), false, false},
+		{"And(yes, fails)", And(yes, fails), false, true},
+		{"Or()", Or(), false, false},
+		{"Or(no, yes)", Or(no, yes), true, false},
+		{"Or(fails, yes)", Or(fails, yes), true, false},
+		{"Or(no, fails)", Or(no, fails), false, true},
+		{"Not(no)", Not(no), true, false},
+		{"Not(yes)", Not(yes), false, false},
+		{"Not(fails)", Not(fails), false, true},
+		{"Or(And(yes, no), Not(no))", Or(And(yes, no), Not(no)), true, false},
+	}
+
+	for _, f := range filters {
+		match, err := f.filter(&Candidate{Pid: 1})
+		if match != f.match || (err != nil) != f.err {
+			t.Errorf("%s returned %v (%v)", f.name, match, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package process
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Candidate is a process considered by Select. Its information is read the first time a Filter needs it, so the
+// filters that are cheaper to check should come first in an And or an Or.
+type Candidate struct {
+	Pid int
+
+	p       Process
+	openErr error
+	opened  bool
+	// softerrors are the soft errors of opening the process.
+	softerrors []error
+
+	info     ProcessInfo
+	infoErr  error
+	infoRead bool
+}
+
+// Process returns the candidate opened. The process is kept open if it's selected, and closed otherwise.
+func (c *Candidate) Process() (Process, error) {
+	if !c.opened {
+		c.opened = true
+		c.p, c.openErr, c.softerrors = OpenFromPid(c.Pid)
+		if c.openErr != nil {
+			c.p = nil
+		}
+	}
+	return c.p, c.openErr
+}
+
+// Info returns the information about the candidate. If only some of it could be read, the rest is returned without
+// an error.
+func (c *Candidate) Info() (ProcessInfo, error) {
+	if !c.infoRead {
+		c.infoRead = true
+		// This function is implemented by the OS-specific processInfo function.
+		info, err := processInfo(c.Pid)
+		if err == nil || info.GetId() == c.Pid {
+			c.info = info
+		} else {
+			c.infoErr = err
+		}
+	}
+	return c.info, c.infoErr
+}
+
+// close closes the candidate if it was opened.
+func (c *Candidate) close() (harderror error, softerrors []error) {
+	if c.p == nil {
+		return nil, nil
+	}
+	return c.p.Close()
+}
+
+// Filter tells if a process must be selected. If it returns an error the process is not selected, and the error is
+// reported as a soft error by Select.
+type Filter func(c *Candidate) (bool, error)
+
+// Select opens the running processes that match the filter, sorted by pid. The processes that exit while they are
+// selected are skipped, and so are the ones whose information needed by the filter can't be read, with a soft error.
+//
+// All the processes selected are open at the same time, WalkProcesses only opens one at a time.
+func Select(filter Filter) (ps []Process, harderror error, softerrors []error) {
+	ps = make([]Process, 0)
+	harderror, softerrors = SelectFuncContext(context.Background(), filter, func(p Process) (keepSelecting bool) {
+		ps = append(ps, p)
+		return true
+	})
+	if harderror != nil {
+		CloseAll(ps)
+		return nil, harderror, softerrors
+	}
+
+	return ps, nil, softerrors
+}
+
+// SelectFunc is the function called by SelectFuncContext with each process selected. The process is handed over to
+// it, so it must close the process once it's not needed. If it returns false the selection stops.
+type SelectFunc func(p Process) (keepSelecting bool)
+
+// SelectFuncContext works as Select, but instead of returning the processes it calls fn with each of them, in pid
+// order, as soon as it's selected. Unlike with WalkProcesses, the processes are not closed after fn returns, so they
+// can be used by other goroutines. It stops as soon as ctx is done, checking it between processes, returning the
+// error of the context as hard error.
+func SelectFuncContext(ctx context.Context, filter Filter, fn SelectFunc) (harderror error, softerrors []error) {
+	return walkProcesses(ctx, filter, func(p Process) (keepWalking bool, keepOpen bool) {
+		return fn(p), true
+	})
+}
+
+// WalkFunc is the function called by WalkProcesses for each process selected. If it returns false the walk stops.
+type WalkFunc func(p Process) (keepWalking bool)
+
+// WalkProcesses calls walkFn with each running process that matches the filter, in pid order. The filter is checked
+// before opening the process, unless it needs the process open, and the process is closed once walkFn returns, so it
+// must not be used after that. The processes are skipped as in Select.
+func WalkProcesses(filter Filter, walkFn WalkFunc) (harderror error, softerrors []error) {
+	return WalkProcessesContext(context.Background(), filter, walkFn)
+}
+
+// WalkProcessesContext works as WalkProcesses, but it stops as soon as ctx is done, checking it between processes.
+// In that case the hard error is the error of the context.
+func WalkProcessesContext(ctx context.Context, filter Filter, walkFn WalkFunc) (harderror error,
+	softerrors []error) {
+
+	return walkProcesses(ctx, filter, func(p Process) (keepWalking bool, keepOpen bool) {
+		return walkFn(p), false
+	})
+}
+
+// WalkAll works as WalkProcesses with every running process.
+func WalkAll(walkFn WalkFunc) (harderror error, softerrors []error) {
+	return WalkProcesses(All(), walkFn)
+}
+
+// WalkByName works as WalkProcesses with the processes whose name matches r, as OpenByName.
+func WalkByName(r *regexp.Regexp, walkFn WalkFunc) (harderror error, softerrors []error) {
+	return WalkProcesses(NameMatches(r), walkFn)
+}
+
+// walkProcesses calls visit with each running process that matches the filter. The process is closed after visit
+// returns unless it asks to keep it open.
+func walkProcesses(ctx context.Context, filter Filter, visit func(p Process) (keepWalking bool, keepOpen bool)) (
+	harderror error, softerrors []error) {
+
+	pids, harderror, softerrors := GetAllPids()
+	if harderror != nil {
+		return harderror, softerrors
+	}
+
+	for _, pid := range pids {
+		if err := ctx.Err(); err != nil {
+			return err, softerrors
+		}
+
+		keepWalking, serrs := visitCandidate(&Candidate{Pid: pid}, filter, visit)
+		softerrors = append(softerrors, serrs...)
+		if !keepWalking {
+			break
+		}
+	}
+
+	return nil, softerrors
+}
+
+// visitCandidate calls visit with the candidate opened if it matches the filter. The candidate is closed afterwards,
+// even if visit panics, unless visit asks to keep it open.
+func visitCandidate(c *Candidate, filter Filter, visit func(p Process) (keepWalking bool, keepOpen bool)) (
+	keepWalking bool, softerrors []error) {
+
+	keepOpen := false
+	defer func() {
+		softerrors = append(softerrors, c.softerrors...)
+		if keepOpen {
+			return
+		}
+
+		err, serrs := c.close()
+		if err != nil {
+			softerrors = append(softerrors, err)
+		}
+		softerrors = append(softerrors, serrs...)
+	}()
+
+	match, err := filter(c)
+	if err != nil {
+		return true, []error{fmt.Errorf("Pid: %d failed to be filtered. Error: %v", c.Pid, err)}
+	}
+	if !match {
+		return true, nil
+	}
+
+	p, err := c.Process()
+	if err != nil {
+		return true, []error{fmt.Errorf("Pid: %d failed to Open. Error: %v", c.Pid, err)}
+	}
+
+	keepWalking, keepOpen = visit(p)
+	return keepWalking, nil
+}
+
+// All matches every process.
+func All() Filter {
+	return func(c *Candidate) (bool, error) {
+		return true, nil
+	}
+}
+
+// And matches the processes that match all the filters, which are checked in order until one doesn't match.
+func And(filters ...Filter) Filter {
+	return func(c *Candidate) (bool, error) {
+		for _, filter := range filters {
+			if match, err := filter(c); err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// Or matches the processes that match any of the filters, which are checked in order until one matches. The error of
+// a filter is only returned if no other one matches.
+func Or(filters ...Filter) Filter {
+	return func(c *Candidate) (bool, error) {
+		var firstErr error
+		for _, filter := range filters {
+			match, err := filter(c)
+			if err == nil && match {
+				return true, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return false, firstErr
+	}
+}
+
+// Not matches the processes that don't match the filter.
+func Not(filter Filter) Filter {
+	return func(c *Candidate) (bool, error) {
+		match, err := filter(c)
+		if err != nil {
+			return false, err
+		}
+		return !match, nil
+	}
+}
+
+// Pids matches the processes with the given pids.
+func Pids(pids ...int) Filter {
+	accepted := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		accepted[pid] = true
+	}
+
+	return func(c *Candidate) (bool, error) {
+		return accepted[c.Pid], nil
+	}
+}
+
+// NameMatches matches the processes whose binary full path, as returned by their Name method, matches r. The processes
+// are not opened to read it.
+func NameMatches(r *regexp.Regexp) Filter {
+	return func(c *Candidate) (bool, error) {
+		name, err, _ := GetProcess(c.Pid).Name()
+		if err != nil {
+			return false, err
+		}
+		return r.MatchString(name), nil
+	}
+}
+
+// CommandMatches matches the processes whose short name, as shown by ps(1), matches r.
+func CommandMatches(r *regexp.Regexp) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.Info()
+		if err != nil {
+			return false, err
+		}
+		return r.MatchString(info.GetCommand()), nil
+	}
+}
+
+// ParentPid matches the children of the process with the given pid.
+func ParentPid(ppid int) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.Info()
+		if err != nil {
+			return false, err
+		}
+		return info.GetParentProcessId() == ppid, nil
+	}
+}
+
+// ExecutableHash matches the processes whose executable file has the given SHA-256 hash, in hexadecimal. The hash of
+// each file is only computed once, unless the file changes.
+func ExecutableHash(sha256Hex string) Filter {
+	sha256Hex = strings.ToLower(sha256Hex)
+
+	type fileKey struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var mtx sync.Mutex
+	hashes := make(map[fileKey]string)
+
+	return func(c *Candidate) (bool, error) {
+		// This function is implemented by the OS-specific openExecutable function.
+		f, err := openExecutable(c.Pid)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+
+		stat, err := f.Stat()
+		if err != nil {
+			return false, err
+		}
+		name, _ := processExe(c.Pid)
+		key := fileKey{name: name, size: stat.Size(), modTime: stat.ModTime()}
+
+		mtx.Lock()
+		hash, ok := hashes[key]
+		mtx.Unlock()
+		if !ok {
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return false, fmt.Errorf("Unable to hash the executable of process %d (%v)", c.Pid, err)
+			}
+			hash = hex.EncodeToString(h.Sum(nil))
+
+			mtx.Lock()
+			hashes[key] = hash
+			mtx.Unlock()
+		}
+
+		return hash == sha256Hex, nil
+	}
+}
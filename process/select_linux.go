@@ -0,0 +1,178 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func openExecutable(pid int) (*os.File, error) {
+	// The exe link can be opened even if the file was deleted or replaced.
+	return os.Open(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+}
+
+// linuxInfo returns the information about a candidate, as it's always a LinuxProcessInfo on Linux.
+func (c *Candidate) linuxInfo() (LinuxProcessInfo, error) {
+	info, err := c.Info()
+	if err != nil {
+		return LinuxProcessInfo{}, err
+	}
+	return info.(LinuxProcessInfo), nil
+}
+
+// ArgsMatch matches the processes whose command line, with their arguments separated by spaces, matches r. Kernel
+// threads and zombies have an empty command line.
+func ArgsMatch(r *regexp.Regexp) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.linuxInfo()
+		if err != nil {
+			return false, err
+		}
+		return r.MatchString(strings.Join(info.Args, " ")), nil
+	}
+}
+
+// User matches the processes whose effective user has the given name or uid, like the -u option of ps(1).
+func User(user string) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.linuxInfo()
+		if err != nil {
+			return false, err
+		}
+		return info.EffectiveUserName == user || strconv.Itoa(info.EffectiveUserId) == user, nil
+	}
+}
+
+// Uid matches the processes whose real, effective or saved user id is uid.
+func Uid(uid int) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.linuxInfo()
+		if err != nil {
+			return false, err
+		}
+		return info.UserId == uid || info.EffectiveUserId == uid || info.SavedUserId == uid, nil
+	}
+}
+
+// StartedBetween matches the processes started between from and to, both included. A zero time leaves that end of
+// the window open.
+func StartedBetween(from, to time.Time) Filter {
+	return func(c *Candidate) (bool, error) {
+		info, err := c.linuxInfo()
+		if err != nil {
+			return false, err
+		}
+		if info.StartTime.IsZero() {
+			return false, fmt.Errorf("The start time of process %d is unknown", c.Pid)
+		}
+		return (from.IsZero() || !info.StartTime.Before(from)) && (to.IsZero() || !info.StartTime.After(to)), nil
+	}
+}
+
+// StartedWithin matches the processes started in the last d, counted from when each process is checked.
+func StartedWithin(d time.Duration) Filter {
+	return func(c *Candidate) (bool, error) {
+		// The start time is only precise to a second, as the system boot time.
+		return StartedBetween(time.Now().Add(-d-time.Second), time.Time{})(c)
+	}
+}
+
+// Executable matches the processes running the file at path, even if they refer to it by another name, as long as it
+// isn't replaced. The file is found the first time the filter is checked.
+func Executable(path string) Filter {
+	var once sync.Once
+	var file os.FileInfo
+	var fileErr error
+
+	return func(c *Candidate) (bool, error) {
+		once.Do(func() { file, fileErr = os.Stat(path) })
+		if fileErr != nil {
+			return false, fileErr
+		}
+
+		exe, err := os.Stat(filepath.Join("/proc", strconv.Itoa(c.Pid), "exe"))
+		if err != nil {
+			return false, err
+		}
+		return os.SameFile(file, exe), nil
+	}
+}
+
+// CgroupMatches matches the processes in a cgroup whose path matches r, in any of their hierarchies. Containers are
+// usually in cgroups named after their ids, like /docker/<id> or /system.slice/docker-<id>.scope.
+func CgroupMatches(r *regexp.Regexp) Filter {
+	return func(c *Candidate) (bool, error) {
+		cgroups, err := readCgroups(c.Pid)
+		if err != nil {
+			return false, err
+		}
+
+		for _, cgroup := range cgroups {
+			if r.MatchString(cgroup) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// readCgroups returns the paths of the cgroups of a process, one per hierarchy, from its /proc/<pid>/cgroup file.
+func readCgroups(pid int) (cgroups []string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line is hierarchy-ID:controller-list:cgroup-path.
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Invalid line %q in the cgroup file of process %d", line, pid)
+		}
+		cgroups = append(cgroups, parts[2])
+	}
+
+	return cgroups, nil
+}
+
+// InNamespace matches the processes in the namespace of the given kind, like pid, net or mnt, identified by its inode
+// number as listed by lsns(8).
+func InNamespace(kind string, inode uint64) Filter {
+	namespace := fmt.Sprintf("%s:[%d]", kind, inode)
+	return func(c *Candidate) (bool, error) {
+		ns, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(c.Pid), "ns", kind))
+		if err != nil {
+			return false, err
+		}
+		return ns == namespace, nil
+	}
+}
+
+// SameNamespace matches the processes in the same namespace of the given kind, like pid, net or mnt, as the process
+// with the given pid. That namespace is found the first time the filter is checked.
+func SameNamespace(kind string, pid int) Filter {
+	var once sync.Once
+	var namespace string
+	var namespaceErr error
+
+	return func(c *Candidate) (bool, error) {
+		once.Do(func() {
+			namespace, namespaceErr = os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", kind))
+		})
+		if namespaceErr != nil {
+			return false, namespaceErr
+		}
+
+		ns, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(c.Pid), "ns", kind))
+		if err != nil {
+			return false, err
+		}
+		return ns == namespace, nil
+	}
+}
@@ -0,0 +1,395 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// ProcessStatus is the content of a /proc/<pid>/status file, as described in proc(5).
+//
+// The fields missing in the file, because the kernel is older or they don't apply to the process, are left with their
+// zero values, except Umask which is -1 then. The sizes of memory are in bytes.
+type ProcessStatus struct {
+	Name  string `json:"name"`
+	Umask int    `json:"umask"`
+	// State is the state of the process, like "S (sleeping)".
+	State     string `json:"state"`
+	Tgid      int    `json:"tgid"`
+	Ngid      int    `json:"ngid"`
+	Pid       int    `json:"pid"`
+	PPid      int    `json:"ppid"`
+	TracerPid int    `json:"tracerPid"`
+
+	// Uid and Gid are the real, effective, saved and filesystem ids.
+	Uid    [4]int `json:"uid"`
+	Gid    [4]int `json:"gid"`
+	FDSize int    `json:"fdSize"`
+	Groups []int  `json:"groups"`
+
+	// The ids of the process in each of the pid namespaces it belongs to, from the outermost to its own.
+	NStgid []int `json:"nstgid"`
+	NSpid  []int `json:"nspid"`
+	NSpgid []int `json:"nspgid"`
+	NSsid  []int `json:"nssid"`
+
+	Kthread bool `json:"kthread"`
+
+	VmPeak       uint64 `json:"vmPeak"`
+	VmSize       uint64 `json:"vmSize"`
+	VmLck        uint64 `json:"vmLck"`
+	VmPin        uint64 `json:"vmPin"`
+	VmHWM        uint64 `json:"vmHWM"`
+	VmRSS        uint64 `json:"vmRSS"`
+	RssAnon      uint64 `json:"rssAnon"`
+	RssFile      uint64 `json:"rssFile"`
+	RssShmem     uint64 `json:"rssShmem"`
+	VmData       uint64 `json:"vmData"`
+	VmStk        uint64 `json:"vmStk"`
+	VmExe        uint64 `json:"vmExe"`
+	VmLib        uint64 `json:"vmLib"`
+	VmPTE        uint64 `json:"vmPTE"`
+	VmSwap       uint64 `json:"vmSwap"`
+	HugetlbPages uint64 `json:"hugetlbPages"`
+	CoreDumping  bool   `json:"coreDumping"`
+	THPEnabled   bool   `json:"thpEnabled"`
+
+	Threads int `json:"threads"`
+
+	// SigQueued and SigQueueLimit are the signals queued for the real user of the process, and its limit.
+	SigQueued     uint64 `json:"sigQueued"`
+	SigQueueLimit uint64 `json:"sigQueueLimit"`
+	// Masks of the pending (for the thread and the process), blocked, ignored and caught signals.
+	SigPnd uint64 `json:"sigPnd"`
+	ShdPnd uint64 `json:"shdPnd"`
+	SigBlk uint64 `json:"sigBlk"`
+	SigIgn uint64 `json:"sigIgn"`
+	SigCgt uint64 `json:"sigCgt"`
+
+	// Masks of the inheritable, permitted, effective, bounding and ambient capabilities.
+	CapInh uint64 `json:"capInh"`
+	CapPrm uint64 `json:"capPrm"`
+	CapEff uint64 `json:"capEff"`
+	CapBnd uint64 `json:"capBnd"`
+	CapAmb uint64 `json:"capAmb"`
+
+	NoNewPrivs bool `json:"noNewPrivs"`
+	// Seccomp is the seccomp mode: 0 disabled, 1 strict or 2 filter.
+	Seccomp                   int    `json:"seccomp"`
+	SeccompFilters            int    `json:"seccompFilters"`
+	SpeculationStoreBypass    string `json:"speculationStoreBypass"`
+	SpeculationIndirectBranch string `json:"speculationIndirectBranch"`
+
+	// CpusAllowed and MemsAllowed are the CPUs and memory nodes where the process may run and allocate memory.
+	CpusAllowed []int `json:"cpusAllowed"`
+	MemsAllowed []int `json:"memsAllowed"`
+
+	VoluntaryCtxtSwitches    uint64 `json:"voluntaryCtxtSwitches"`
+	NonvoluntaryCtxtSwitches uint64 `json:"nonvoluntaryCtxtSwitches"`
+}
+
+// ReadProcessStatus reads and parses the /proc/<pid>/status file of a process, as ParseProcessStatus.
+func ReadProcessStatus(pid int) (status ProcessStatus, harderror error, softerrors []error) {
+	return readProcessStatus(strconv.Itoa(pid))
+}
+
+// readProcessStatus reads the /proc/<dir>/status file, where dir is a pid or "self".
+func readProcessStatus(dir string) (status ProcessStatus, harderror error, softerrors []error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", dir, "status"))
+	if err != nil {
+		return ProcessStatus{Umask: -1}, err, nil
+	}
+	return ParseProcessStatus(data)
+}
+
+// requiredStatusLines are the lines of the status file needed to identify the process and its credentials, which have
+// been there since the first kernels.
+var requiredStatusLines = []string{"Pid", "PPid", "Uid", "Gid"}
+
+// requiredStatusLine returns the index of key in requiredStatusLines, or -1 if it isn't a required line.
+func requiredStatusLine(key []byte) int {
+	// Comparing the converted key doesn't allocate a string for it.
+	for i, required := range requiredStatusLines {
+		if string(key) == required {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseProcessStatus parses the content of a /proc/<pid>/status file. Unknown lines are ignored, as the kernel adds new
+// ones over time, and the lines that can't be parsed are reported as soft errors and leave their fields unset. Only a
+// missing or invalid line among the ones with the pid, the parent pid and the credentials is a hard error.
+func ParseProcessStatus(data []byte) (status ProcessStatus, harderror error, softerrors []error) {
+	status.Umask = -1
+	// found has the bit of the index of each required line in requiredStatusLines set once the line is found.
+	var found uint
+
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+
+		// Only the first ':' separates the key, values like the name of the process can have more.
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 {
+			if len(bytes.TrimSpace(line)) > 0 {
+				softerrors = append(softerrors, fmt.Errorf("Invalid line in status file: %q", line))
+			}
+			continue
+		}
+
+		key, value := line[:colon], bytes.TrimSpace(line[colon+1:])
+		required := requiredStatusLine(key)
+		if required != -1 {
+			found |= 1 << uint(required)
+		}
+		if err := status.parseLine(key, value); err != nil {
+			err = fmt.Errorf("Invalid %s line in status file: %q (%v)", key, value, err)
+			if required != -1 {
+				return status, err, softerrors
+			}
+			softerrors = append(softerrors, err)
+		}
+	}
+
+	for i, required := range requiredStatusLines {
+		if found&(1<<uint(i)) == 0 {
+			return status, fmt.Errorf("The status file doesn't have a %s line", required), softerrors
+		}
+	}
+
+	return status, nil, softerrors
+}
+
+// parseLine sets the field of the status corresponding to key.
+func (s *ProcessStatus) parseLine(key, value []byte) (err error) {
+	switch string(key) {
+	case "Name":
+		s.Name = string(value)
+	case "Umask":
+		var umask uint64
+		if umask, err = strconv.ParseUint(string(value), 8, 32); err == nil {
+			s.Umask = int(umask)
+		}
+	case "State":
+		s.State = string(value)
+	case "Tgid":
+		s.Tgid, err = strconv.Atoi(string(value))
+	case "Ngid":
+		s.Ngid, err = strconv.Atoi(string(value))
+	case "Pid":
+		s.Pid, err = strconv.Atoi(string(value))
+	case "PPid":
+		s.PPid, err = strconv.Atoi(string(value))
+	case "TracerPid":
+		s.TracerPid, err = strconv.Atoi(string(value))
+	case "Uid":
+		err = parseIdQuadruple(value, &s.Uid)
+	case "Gid":
+		err = parseIdQuadruple(value, &s.Gid)
+	case "FDSize":
+		s.FDSize, err = strconv.Atoi(string(value))
+	case "Groups":
+		s.Groups, err = parseIntList(value)
+	case "NStgid":
+		s.NStgid, err = parseIntList(value)
+	case "NSpid":
+		s.NSpid, err = parseIntList(value)
+	case "NSpgid":
+		s.NSpgid, err = parseIntList(value)
+	case "NSsid":
+		s.NSsid, err = parseIntList(value)
+	case "Kthread":
+		s.Kthread, err = parseFlag(value)
+	case "VmPeak":
+		s.VmPeak, err = parseKilobytes(value)
+	case "VmSize":
+		s.VmSize, err = parseKilobytes(value)
+	case "VmLck":
+		s.VmLck, err = parseKilobytes(value)
+	case "VmPin":
+		s.VmPin, err = parseKilobytes(value)
+	case "VmHWM":
+		s.VmHWM, err = parseKilobytes(value)
+	case "VmRSS":
+		s.VmRSS, err = parseKilobytes(value)
+	case "RssAnon":
+		s.RssAnon, err = parseKilobytes(value)
+	case "RssFile":
+		s.RssFile, err = parseKilobytes(value)
+	case "RssShmem":
+		s.RssShmem, err = parseKilobytes(value)
+	case "VmData":
+		s.VmData, err = parseKilobytes(value)
+	case "VmStk":
+		s.VmStk, err = parseKilobytes(value)
+	case "VmExe":
+		s.VmExe, err = parseKilobytes(value)
+	case "VmLib":
+		s.VmLib, err = parseKilobytes(value)
+	case "VmPTE":
+		s.VmPTE, err = parseKilobytes(value)
+	case "VmSwap":
+		s.VmSwap, err = parseKilobytes(value)
+	case "HugetlbPages":
+		s.HugetlbPages, err = parseKilobytes(value)
+	case "CoreDumping":
+		s.CoreDumping, err = parseFlag(value)
+	case "THP_enabled":
+		s.THPEnabled, err = parseFlag(value)
+	case "Threads":
+		s.Threads, err = strconv.Atoi(string(value))
+	case "SigQ":
+		slash := bytes.IndexByte(value, '/')
+		if slash == -1 {
+			return fmt.Errorf("Expected queued/limit")
+		}
+		if s.SigQueued, err = strconv.ParseUint(string(value[:slash]), 10, 64); err != nil {
+			return err
+		}
+		s.SigQueueLimit, err = strconv.ParseUint(string(value[slash+1:]), 10, 64)
+	case "SigPnd":
+		s.SigPnd, err = strconv.ParseUint(string(value), 16, 64)
+	case "ShdPnd":
+		s.ShdPnd, err = strconv.ParseUint(string(value), 16, 64)
+	case "SigBlk":
+		s.SigBlk, err = strconv.ParseUint(string(value), 16, 64)
+	case "SigIgn":
+		s.SigIgn, err = strconv.ParseUint(string(value), 16, 64)
+	case "SigCgt":
+		s.SigCgt, err = strconv.ParseUint(string(value), 16, 64)
+	case "CapInh":
+		s.CapInh, err = strconv.ParseUint(string(value), 16, 64)
+	case "CapPrm":
+		s.CapPrm, err = strconv.ParseUint(string(value), 16, 64)
+	case "CapEff":
+		s.CapEff, err = strconv.ParseUint(string(value), 16, 64)
+	case "CapBnd":
+		s.CapBnd, err = strconv.ParseUint(string(value), 16, 64)
+	case "CapAmb":
+		s.CapAmb, err = strconv.ParseUint(string(value), 16, 64)
+	case "NoNewPrivs":
+		s.NoNewPrivs, err = parseFlag(value)
+	case "Seccomp":
+		s.Seccomp, err = strconv.Atoi(string(value))
+	case "Seccomp_filters":
+		s.SeccompFilters, err = strconv.Atoi(string(value))
+	case "Speculation_Store_Bypass":
+		s.SpeculationStoreBypass = string(value)
+	case "SpeculationIndirectBranch":
+		s.SpeculationIndirectBranch = string(value)
+	case "Cpus_allowed_list":
+		s.CpusAllowed, err = parseRangeList(value)
+	case "Mems_allowed_list":
+		s.MemsAllowed, err = parseRangeList(value)
+	case "voluntary_ctxt_switches":
+		s.VoluntaryCtxtSwitches, err = strconv.ParseUint(string(value), 10, 64)
+	case "nonvoluntary_ctxt_switches":
+		s.NonvoluntaryCtxtSwitches, err = strconv.ParseUint(string(value), 10, 64)
+	}
+
+	return err
+}
+
+// parseIdQuadruple parses the real, effective, saved and filesystem ids of the Uid and Gid lines.
+func parseIdQuadruple(value []byte, ids *[4]int) error {
+	for i := range ids {
+		var field []byte
+		field, value = nextField(value)
+
+		id, err := strconv.Atoi(string(field))
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	if len(value) != 0 {
+		return fmt.Errorf("Expected 4 ids")
+	}
+	return nil
+}
+
+// parseIntList parses a list of integers separated by spaces or tabs.
+func parseIntList(value []byte) (list []int, err error) {
+	for len(value) > 0 {
+		var field []byte
+		field, value = nextField(value)
+
+		n, err := strconv.Atoi(string(field))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+
+	return list, nil
+}
+
+// parseRangeList parses a list of ranges of integers like 0-3,8,10-11, used by the *_allowed_list lines.
+func parseRangeList(value []byte) (list []int, err error) {
+	for len(value) > 0 {
+		item := value
+		if i := bytes.IndexByte(value, ','); i != -1 {
+			item, value = value[:i], value[i+1:]
+		} else {
+			value = nil
+		}
+
+		first, last := item, item
+		if i := bytes.IndexByte(item, '-'); i != -1 {
+			first, last = item[:i], item[i+1:]
+		}
+
+		start, err := strconv.Atoi(string(first))
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.Atoi(string(last))
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("Invalid range %s", item)
+		}
+
+		for n := start; n <= end; n++ {
+			list = append(list, n)
+		}
+	}
+
+	return list, nil
+}
+
+// parseKilobytes parses sizes like "1234 kB" into bytes.
+func parseKilobytes(value []byte) (uint64, error) {
+	value = bytes.TrimSuffix(value, []byte(" kB"))
+	kb, err := strconv.ParseUint(string(bytes.TrimSpace(value)), 10, 64)
+	return kb * 1024, err
+}
+
+// parseFlag parses the lines with a value of 0 or 1.
+func parseFlag(value []byte) (bool, error) {
+	switch string(value) {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, fmt.Errorf("Expected 0 or 1")
+}
+
+// nextField returns the first field of value, separated by spaces or tabs, and the rest of it.
+func nextField(value []byte) (field, rest []byte) {
+	end := bytes.IndexAny(value, " \t")
+	if end == -1 {
+		return value, nil
+	}
+	return value[:end], bytes.TrimLeft(value[end:], " \t")
+}
@@ -0,0 +1,48 @@
+package process
+
+import (
+	"time"
+)
+
+// Special values of Thread.Syscall.
+const (
+	// NoSyscall means that the thread is blocked, but not in a syscall.
+	NoSyscall = -1
+	// UnknownSyscall means that the thread is running, so it's not blocked in a syscall, or that its syscall
+	// couldn't be read.
+	UnknownSyscall = -2
+)
+
+// Thread describes one of the threads of a process.
+type Thread struct {
+	Tid int
+	// Name is the name of the thread, which is the name of the process unless it's changed.
+	Name string
+	// State is the state of the thread as shown by ps(1), like R (running), S (sleeping) or D (disk sleep).
+	State string
+
+	// UserTime and SystemTime are the CPU time the thread spent in user and kernel mode.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// Syscall is the number of the syscall the thread is blocked in, or NoSyscall or UnknownSyscall. SyscallArgs are
+	// its arguments.
+	Syscall     int
+	SyscallArgs [6]uintptr
+	// StackPointer and ProgramCounter are the registers of the thread, when its Syscall is known.
+	StackPointer   uintptr
+	ProgramCounter uintptr
+
+	// WChan is the kernel function where the thread is waiting, or empty if it's not known.
+	WChan string
+
+	// StackStart and StackEnd are the limits of the memory region of the thread's stack, 0 if it's not known.
+	StackStart uintptr
+	StackEnd   uintptr
+}
+
+// Threads returns the threads of a process, sorted by tid. The threads that exit while they are read are skipped.
+func Threads(p Process) (threads []Thread, harderror error, softerrors []error) {
+	// This function is implemented by the OS-specific listThreads function.
+	return listThreads(p)
+}
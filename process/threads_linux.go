@@ -0,0 +1,137 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polyverse/masche/common"
+)
+
+func listThreads(p Process) (threads []Thread, harderror error, softerrors []error) {
+	taskDir := filepath.Join("/proc", strconv.Itoa(p.Pid()), "task")
+	files, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, &common.ProcessError{Pid: p.Pid(), Op: "list the threads", Err: err}, nil
+	}
+
+	entries, err := ReadMapsEntries(p)
+	if err != nil {
+		softerrors = append(softerrors, fmt.Errorf("The stacks of the threads of process %d are unknown (%v)",
+			p.Pid(), err))
+	}
+
+	for _, f := range files {
+		tid, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+
+		thread, err := readThread(filepath.Join(taskDir, f.Name()), tid)
+		if os.IsNotExist(err) {
+			// The thread exited.
+			continue
+		} else if err != nil {
+			softerrors = append(softerrors, err)
+			continue
+		}
+
+		thread.StackStart, thread.StackEnd = threadStack(thread, p.Pid(), entries)
+		threads = append(threads, thread)
+	}
+
+	// The threads could belong to a new process with the same pid.
+	if err := CheckIdentity(p); err != nil {
+		return nil, err, softerrors
+	}
+
+	sort.Slice(threads, func(i, j int) bool { return threads[i].Tid < threads[j].Tid })
+	return threads, nil, softerrors
+}
+
+// readThread reads the information of a thread from its /proc/<pid>/task/<tid> directory.
+func readThread(dir string, tid int) (thread Thread, err error) {
+	name, fields, err := readStatFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return thread, err
+	}
+
+	thread = Thread{Tid: tid, Name: name, State: fields[statState], Syscall: UnknownSyscall}
+
+	for i, t := range map[int]*time.Duration{statUtime: &thread.UserTime, statStime: &thread.SystemTime} {
+		ticks, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return thread, fmt.Errorf("Invalid stat file of thread %d (%v)", tid, err)
+		}
+		*t = time.Duration(ticks) * time.Second / time.Duration(userHz)
+	}
+
+	// Reading the syscall needs the permissions to access the process, and it's not supported by all the kernels,
+	// so it's left unknown if it fails.
+	if syscall, err := ioutil.ReadFile(filepath.Join(dir, "syscall")); err == nil {
+		if err := thread.parseSyscall(strings.TrimSpace(string(syscall))); err != nil {
+			return thread, fmt.Errorf("Invalid syscall file of thread %d (%v)", tid, err)
+		}
+	}
+
+	if wchan, err := ioutil.ReadFile(filepath.Join(dir, "wchan")); err == nil && string(wchan) != "0" {
+		thread.WChan = string(wchan)
+	}
+
+	return thread, nil
+}
+
+// parseSyscall parses the contents of a /proc/<pid>/task/<tid>/syscall file, which can be "running", "-1 sp pc" or
+// the syscall number followed by its 6 arguments, sp and pc.
+func (t *Thread) parseSyscall(syscall string) error {
+	if syscall == "running" {
+		return nil
+	}
+
+	fields := strings.Fields(syscall)
+	if len(fields) != 3 && len(fields) != 9 {
+		return fmt.Errorf("Unexpected %q", syscall)
+	}
+
+	nr, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+	if (nr == NoSyscall) != (len(fields) == 3) {
+		return fmt.Errorf("Unexpected %q", syscall)
+	}
+
+	values := make([]uintptr, len(fields)-1)
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(strings.TrimPrefix(field, "0x"), 16, 64)
+		if err != nil {
+			return err
+		}
+		values[i] = uintptr(value)
+	}
+
+	t.Syscall = nr
+	copy(t.SyscallArgs[:], values[:len(values)-2])
+	t.StackPointer, t.ProgramCounter = values[len(values)-2], values[len(values)-1]
+	return nil
+}
+
+// threadStack returns the limits of the mapping with the stack of a thread: the one with its stack pointer, or the
+// [stack] mapping for the main thread if its stack pointer isn't known.
+func threadStack(t Thread, pid int, entries []common.MapsEntry) (start, end uintptr) {
+	for _, entry := range entries {
+		if t.StackPointer != 0 && entry.Start <= t.StackPointer && t.StackPointer < entry.End {
+			return entry.Start, entry.End
+		}
+		if t.StackPointer == 0 && t.Tid == pid && entry.Pathname == "[stack]" {
+			return entry.Start, entry.End
+		}
+	}
+
+	return 0, 0
+}
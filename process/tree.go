@@ -0,0 +1,241 @@
+package process
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TreeNode is a process in a Tree.
+type TreeNode struct {
+	Pid       int
+	ParentPid int
+	// Name is the short name of the process, as shown by ps(1) and pstree(1).
+	Name string
+
+	// Parent is nil for the roots of the tree. Children are sorted by pid.
+	Parent   *TreeNode
+	Children []*TreeNode
+}
+
+// String returns the name and the pid of the process, like sshd(1234).
+func (n *TreeNode) String() string {
+	return fmt.Sprintf("%s(%d)", n.Name, n.Pid)
+}
+
+// Tree is the hierarchy of the processes, built from their parent pids.
+type Tree struct {
+	// Roots are the processes whose parent is not in the tree, sorted by pid.
+	Roots []*TreeNode
+
+	nodes map[int]*TreeNode
+}
+
+// treeEntry is the information about a process needed to build a Tree.
+type treeEntry struct {
+	pid       int
+	parentPid int
+	name      string
+}
+
+// BuildTree builds the Tree of all the running processes. The processes that exit while the tree is built are not in
+// it, and the processes whose parent exited are roots.
+func BuildTree() (tree *Tree, harderror error, softerrors []error) {
+	// This function is implemented by the OS-specific readTreeEntries function.
+	entries, harderror, softerrors := readTreeEntries()
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	return newTree(entries), nil, softerrors
+}
+
+// newTree links the entries into a Tree.
+func newTree(entries []treeEntry) *Tree {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].pid < entries[j].pid })
+
+	t := &Tree{nodes: make(map[int]*TreeNode, len(entries))}
+	for _, entry := range entries {
+		t.nodes[entry.pid] = &TreeNode{Pid: entry.pid, ParentPid: entry.parentPid, Name: entry.name}
+	}
+
+	// As the entries are sorted, the children are added sorted too.
+	for _, entry := range entries {
+		node := t.nodes[entry.pid]
+		if parent, ok := t.nodes[node.ParentPid]; ok && parent != node {
+			node.Parent = parent
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	// If pids are recycled while the tree is built a process could appear as its own ancestor. The nodes in such
+	// cycles are not reachable from any root, so we cut the cycles making their first node a root.
+	reached := make(map[*TreeNode]bool, len(t.nodes))
+	for _, entry := range entries {
+		node := t.nodes[entry.pid]
+		if node.Parent == nil {
+			t.Roots = append(t.Roots, node)
+			markReached(node, reached)
+		}
+	}
+	for _, entry := range entries {
+		node := t.nodes[entry.pid]
+		if reached[node] {
+			continue
+		}
+
+		node.Parent.Children = removeNode(node.Parent.Children, node)
+		node.Parent = nil
+		t.Roots = append(t.Roots, node)
+		markReached(node, reached)
+	}
+	sort.Slice(t.Roots, func(i, j int) bool { return t.Roots[i].Pid < t.Roots[j].Pid })
+
+	return t
+}
+
+func markReached(node *TreeNode, reached map[*TreeNode]bool) {
+	reached[node] = true
+	for _, child := range node.Children {
+		if !reached[child] {
+			markReached(child, reached)
+		}
+	}
+}
+
+func removeNode(nodes []*TreeNode, node *TreeNode) []*TreeNode {
+	for i, n := range nodes {
+		if n == node {
+			return append(nodes[:i:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+// Len returns the number of processes in the tree.
+func (t *Tree) Len() int {
+	return len(t.nodes)
+}
+
+// Node returns the node of the process with the given pid, or nil if it isn't in the tree.
+func (t *Tree) Node(pid int) *TreeNode {
+	return t.nodes[pid]
+}
+
+// Ancestors returns the ancestors of the process with the given pid, from its parent to its root. It returns nil if
+// the process is not in the tree.
+func (t *Tree) Ancestors(pid int) (ancestors []*TreeNode) {
+	node := t.nodes[pid]
+	if node == nil {
+		return nil
+	}
+
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		ancestors = append(ancestors, parent)
+	}
+	return ancestors
+}
+
+// Descendants returns the descendants of the process with the given pid, each one followed by its own descendants
+// as in the output of pstree(1). It returns nil if the process is not in the tree.
+func (t *Tree) Descendants(pid int) (descendants []*TreeNode) {
+	node := t.nodes[pid]
+	if node == nil {
+		return nil
+	}
+
+	var walk func(node *TreeNode)
+	walk = func(node *TreeNode) {
+		for _, child := range node.Children {
+			descendants = append(descendants, child)
+			walk(child)
+		}
+	}
+	walk(node)
+
+	return descendants
+}
+
+// Chain returns the ancestry chain of the process with the given pid, from its root to it, like
+// "systemd(1) -> sshd(812) -> bash(1500)". It returns an empty string if the process is not in the tree.
+func (t *Tree) Chain(pid int) string {
+	node := t.nodes[pid]
+	if node == nil {
+		return ""
+	}
+
+	ancestors := t.Ancestors(pid)
+	chain := make([]string, 0, len(ancestors)+1)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		chain = append(chain, ancestors[i].String())
+	}
+	chain = append(chain, node.String())
+
+	return strings.Join(chain, " -> ")
+}
+
+// Subtree returns a new Tree with the process with the given pid as its only root, and all its descendants. It
+// returns an empty tree if the process is not in the tree.
+func (t *Tree) Subtree(pid int) *Tree {
+	node := t.nodes[pid]
+	if node == nil {
+		return newTree(nil)
+	}
+
+	entries := []treeEntry{{pid: node.Pid, parentPid: node.ParentPid, name: node.Name}}
+	for _, descendant := range t.Descendants(pid) {
+		entries = append(entries, treeEntry{pid: descendant.Pid, parentPid: descendant.ParentPid,
+			name: descendant.Name})
+	}
+
+	return newTree(entries)
+}
+
+// Filter returns a new Tree with the processes for which keep returns true and their ancestors, so the ancestry of
+// each process kept is preserved.
+func (t *Tree) Filter(keep func(node *TreeNode) bool) *Tree {
+	kept := make(map[int]bool)
+	var entries []treeEntry
+	for _, node := range t.nodes {
+		if !keep(node) {
+			continue
+		}
+
+		for n := node; n != nil && !kept[n.Pid]; n = n.Parent {
+			kept[n.Pid] = true
+			entries = append(entries, treeEntry{pid: n.Pid, parentPid: n.ParentPid, name: n.Name})
+		}
+	}
+
+	return newTree(entries)
+}
+
+// String renders the tree like pstree(1) does with its -p and -A options, with a line per process.
+func (t *Tree) String() string {
+	var b strings.Builder
+
+	var render func(node *TreeNode, prefix string, last bool, root bool)
+	render = func(node *TreeNode, prefix string, last bool, root bool) {
+		childPrefix := prefix
+		if root {
+			b.WriteString(node.String())
+		} else if last {
+			b.WriteString(prefix + "`-" + node.String())
+			childPrefix += "  "
+		} else {
+			b.WriteString(prefix + "|-" + node.String())
+			childPrefix += "| "
+		}
+		b.WriteByte('\n')
+
+		for i, child := range node.Children {
+			render(child, childPrefix, i == len(node.Children)-1, false)
+		}
+	}
+
+	for _, root := range t.Roots {
+		render(root, "", true, true)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package process
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/polyverse/masche/test"
+)
+
+func TestTree(t *testing.T) {
+	tree := newTree([]treeEntry{
+		{pid: 300, parentPid: 1, name: "cron"},
+		{pid: 1, parentPid: 0, name: "init"},
+		{pid: 100, parentPid: 1, name: "sshd"},
+		{pid: 200, parentPid: 100, name: "bash"},
+		{pid: 210, parentPid: 200, name: "curl"},
+		{pid: 220, parentPid: 210, name: "sh"},
+		{pid: 250, parentPid: 100, name: "bash"},
+		// Its parent exited.
+		{pid: 400, parentPid: 399, name: "orphan"},
+		// A cycle made by recycled pids.
+		{pid: 500, parentPid: 501, name: "a"},
+		{pid: 501, parentPid: 500, name: "b"},
+	})
+
+	if tree.Len() != 10 || len(tree.Roots) != 3 || tree.Roots[0].Pid != 1 || tree.Roots[1].Pid != 400 ||
+		tree.Roots[2].Pid != 500 {
+		t.Fatalf("Unexpected roots %v", tree.Roots)
+	}
+
+	if chain := tree.Chain(220); chain != "init(1) -> sshd(100) -> bash(200) -> curl(210) -> sh(220)" {
+		t.Errorf("Unexpected chain %q", chain)
+	}
+	if tree.Chain(1) != "init(1)" || tree.Chain(2) != "" || tree.Ancestors(2) != nil {
+		t.Errorf("Unexpected chains for a root and a missing process")
+	}
+
+	var pids []int
+	for _, node := range tree.Descendants(100) {
+		pids = append(pids, node.Pid)
+	}
+	if len(pids) != 4 || pids[0] != 200 || pids[1] != 210 || pids[2] != 220 || pids[3] != 250 {
+		t.Errorf("Unexpected descendants %v", pids)
+	}
+
+	expected := `init(1)
+|-sshd(100)
+| |-bash(200)
+| | ` + "`" + `-curl(210)
+| |   ` + "`" + `-sh(220)
+| ` + "`" + `-bash(250)
+` + "`" + `-cron(300)
+orphan(400)
+a(500)
+` + "`" + `-b(501)
+`
+	if tree.String() != expected {
+		t.Errorf("Expected\n%s\nand got\n%s", expected, tree.String())
+	}
+
+	subtree := tree.Subtree(200)
+	if subtree.Len() != 3 || len(subtree.Roots) != 1 || subtree.Roots[0].Pid != 200 || subtree.Chain(220) !=
+		"bash(200) -> curl(210) -> sh(220)" {
+		t.Errorf("Unexpected subtree\n%s", subtree)
+	}
+	if tree.Subtree(2).Len() != 0 {
+		t.Errorf("The subtree of a missing process should be empty")
+	}
+
+	filtered := tree.Filter(func(node *TreeNode) bool { return node.Name == "sh" || node.Name == "cron" })
+	if filtered.Len() != 6 || filtered.Chain(220) != tree.Chain(220) || filtered.Node(250) != nil ||
+		filtered.Node(300) == nil {
+		t.Errorf("Unexpected filtered tree\n%s", filtered)
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	cmd, err := test.LaunchTestCase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	tree, err, softerrors := BuildTree()
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := tree.Node(cmd.Process.Pid)
+	if node == nil || node.Parent == nil || node.Parent.Pid != os.Getpid() {
+		t.Fatalf("The test process should be our child, got %v", node)
+	}
+
+	if !strings.HasSuffix(tree.Chain(node.Pid), " -> "+node.String()) {
+		t.Errorf("Unexpected chain %q", tree.Chain(node.Pid))
+	}
+
+	found := false
+	for _, descendant := range tree.Descendants(os.Getpid()) {
+		found = found || descendant == node
+	}
+	if !found {
+		t.Errorf("The test process should be our descendant")
+	}
+}
@@ -0,0 +1,374 @@
+package process
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWatchInterval is the interval between the scans of the processes of a Watcher when none is given.
+const DefaultWatchInterval = time.Second
+
+// EventKind is the kind of an Event of a Watcher.
+type EventKind int
+
+const (
+	// Started is the event of a new process.
+	Started EventKind = iota
+	// Exited is the event of a process that exited.
+	Exited
+	// Exec is the event of a process that executed a new program.
+	Exec
+	// Lost means that the kernel dropped some events because they weren't received in time. The events lost can
+	// be found scanning the processes again, for example with BuildTree.
+	Lost
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Started:
+		return "started"
+	case Exited:
+		return "exited"
+	case Exec:
+		return "exec"
+	case Lost:
+		return "lost"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is a change in the lifecycle of a process reported by a Watcher.
+type Event struct {
+	Kind EventKind
+	// Pid is the pid of the process, or 0 for the Lost events.
+	Pid int
+	// ParentPid is the pid of the parent of a Started process, or 0 if it's not known.
+	ParentPid int
+	// Time is when the event happened, or when it was found if the processes are scanned.
+	Time time.Time
+	// ExitCode is the exit code of an Exited process, or -1 if it's not known or it was killed by a signal.
+	ExitCode int
+	// Info is the information about a Started process, or a process after its Exec, or nil if it couldn't be read
+	// or the process is gone.
+	Info ProcessInfo
+}
+
+// WatcherOptions configures how a Watcher finds the events.
+type WatcherOptions struct {
+	// Interval is the interval between the scans of the processes, when they are scanned. If it's 0,
+	// DefaultWatchInterval is used.
+	Interval time.Duration
+	// NoKernelEvents makes the Watcher scan the processes even if the kernel can report the events.
+	NoKernelEvents bool
+	// NoInfo disables reading the ProcessInfo of the processes in the events.
+	NoInfo bool
+	// Buffer is the capacity of the Events channel.
+	Buffer int
+}
+
+// procEventSource reports the events of the processes as they happen, like the netlink process connector on Linux.
+type procEventSource interface {
+	// read blocks until there are events, or the source is closed. If some events were dropped it returns a Lost
+	// event in their place.
+	read() ([]Event, error)
+	close() error
+}
+
+// Watcher reports when processes start, exit or execute a new program.
+//
+// The events are reported by the kernel if it's possible, which usually requires privileges, and found scanning the
+// processes at an interval otherwise. In that case the processes that live less than the interval are missed, and the
+// events are reported in the order they are found. The events reported by the kernel are queued as soon as they are
+// received, and the information about the processes is read afterwards, so they are only dropped if the Watcher
+// itself can't keep up with the kernel. Then it reports a Lost event.
+type Watcher struct {
+	// Events receives the events, and it's closed when the Watcher stops.
+	Events <-chan Event
+
+	events chan Event
+	opts   WatcherOptions
+	source procEventSource
+	done   chan struct{}
+	once   sync.Once
+
+	mtx sync.Mutex
+	err error
+}
+
+// NewWatcher starts watching the processes. The Watcher must be closed once it's not needed.
+func NewWatcher(opts WatcherOptions) (w *Watcher, harderror error, softerrors []error) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultWatchInterval
+	}
+
+	events := make(chan Event, opts.Buffer)
+	w = &Watcher{Events: events, events: events, opts: opts, done: make(chan struct{})}
+
+	if !opts.NoKernelEvents {
+		// This function is implemented by the OS-specific openProcEventSource function.
+		source, err := openProcEventSource()
+		if err == nil {
+			w.source = source
+			go w.watchSource()
+			return w, nil, nil
+		}
+		softerrors = append(softerrors, fmt.Errorf("The kernel can't report the events, scanning the processes "+
+			"instead (%v)", err))
+	}
+
+	states, harderror, serrs := scanProcessStates()
+	softerrors = append(softerrors, serrs...)
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	go w.watchScans(states)
+	return w, nil, softerrors
+}
+
+// KernelEvents returns true if the events are reported by the kernel, instead of found scanning the processes.
+func (w *Watcher) KernelEvents() bool {
+	return w.source != nil
+}
+
+// Close stops the Watcher, closing its Events channel.
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		if w.source != nil {
+			err = w.source.close()
+		}
+	})
+	return err
+}
+
+// Err returns the error that stopped the Watcher, if any.
+func (w *Watcher) Err() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.err
+}
+
+// stop records the error that stopped the Watcher and closes its Events channel.
+func (w *Watcher) stop(err error) {
+	select {
+	case <-w.done:
+		// The error was caused by closing the Watcher.
+		err = nil
+	default:
+	}
+
+	w.mtx.Lock()
+	w.err = err
+	w.mtx.Unlock()
+
+	close(w.events)
+}
+
+// send sends an event, attaching its ProcessInfo. It returns false if the Watcher was closed.
+func (w *Watcher) send(event Event) bool {
+	if !w.opts.NoInfo && (event.Kind == Started || event.Kind == Exec) {
+		// This function is implemented by the OS-specific processInfo function.
+		info, err := processInfo(event.Pid)
+		if err == nil || info.GetId() == event.Pid {
+			event.Info = info
+		}
+	}
+
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// watchSource receives the events from the source into a queue, which is drained by sendQueued. That way the
+// source is read as fast as possible, while sendQueued reads the information about the processes and waits for the
+// receiver of the events.
+func (w *Watcher) watchSource() {
+	queue := newEventQueue()
+	go w.sendQueued(queue)
+
+	for {
+		events, err := w.source.read()
+		if err != nil {
+			queue.close(err)
+			return
+		}
+		queue.push(events)
+	}
+}
+
+// sendQueued sends the events of the queue until it's closed or the Watcher is closed.
+func (w *Watcher) sendQueued(queue *eventQueue) {
+	for {
+		events, err, ok := queue.pop(w.done)
+		if !ok {
+			w.stop(err)
+			return
+		}
+
+		for _, event := range events {
+			if !w.send(event) {
+				w.stop(nil)
+				return
+			}
+		}
+	}
+}
+
+// eventQueue is an unbounded queue of events between a goroutine receiving them and another one sending them.
+type eventQueue struct {
+	mtx    sync.Mutex
+	events []Event
+	closed bool
+	err    error
+	// ready is signaled when events are pushed or the queue is closed.
+	ready chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(events []Event) {
+	q.mtx.Lock()
+	q.events = append(q.events, events...)
+	q.mtx.Unlock()
+	q.signal()
+}
+
+// close makes pop return err once the events pushed before are popped.
+func (q *eventQueue) close(err error) {
+	q.mtx.Lock()
+	q.closed, q.err = true, err
+	q.mtx.Unlock()
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop blocks until there are events and returns all of them. It returns false once the queue is closed and empty,
+// with the error it was closed with, or when done is closed.
+func (q *eventQueue) pop(done <-chan struct{}) (events []Event, err error, ok bool) {
+	for {
+		q.mtx.Lock()
+		events, q.events = q.events, nil
+		closed, err := q.closed, q.err
+		q.mtx.Unlock()
+
+		if len(events) > 0 {
+			return events, nil, true
+		}
+		if closed {
+			return nil, err, false
+		}
+
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil, nil, false
+		}
+	}
+}
+
+// processState is what is compared between the scans of the processes to find their events.
+type processState struct {
+	parentPid int
+	// startTime tells apart processes with the same pid, and it's 0 if it's not known.
+	startTime uint64
+	// program changes when the process executes a new program.
+	program string
+}
+
+func (w *Watcher) watchScans(states map[int]processState) {
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			w.stop(nil)
+			return
+		}
+
+		current, err, _ := scanProcessStates()
+		if err != nil {
+			w.stop(err)
+			return
+		}
+
+		for _, event := range diffProcessStates(states, current, time.Now()) {
+			if !w.send(event) {
+				w.stop(nil)
+				return
+			}
+		}
+		states = current
+	}
+}
+
+// diffProcessStates returns the events that happened between two scans of the processes.
+func diffProcessStates(previous, current map[int]processState, now time.Time) (events []Event) {
+	for pid, state := range previous {
+		if newState, ok := current[pid]; !ok || newState.startTime != state.startTime {
+			events = append(events, Event{Kind: Exited, Pid: pid, Time: now, ExitCode: -1})
+		}
+	}
+
+	for pid, state := range current {
+		oldState, ok := previous[pid]
+		if !ok || oldState.startTime != state.startTime {
+			events = append(events, Event{Kind: Started, Pid: pid, ParentPid: state.parentPid, Time: now,
+				ExitCode: -1})
+		} else if oldState.program != state.program {
+			events = append(events, Event{Kind: Exec, Pid: pid, Time: now, ExitCode: -1})
+		}
+	}
+
+	// The exits are reported first, as a pid may have been recycled.
+	sortEvents(events)
+	return events
+}
+
+// sortEvents sorts the events found scanning the processes: the exits first, and then by pid.
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if (events[i].Kind == Exited) != (events[j].Kind == Exited) {
+			return events[i].Kind == Exited
+		}
+		return events[i].Pid < events[j].Pid
+	})
+}
+
+// scanProcessStates reads the state of all the running processes.
+func scanProcessStates() (states map[int]processState, harderror error, softerrors []error) {
+	pids, harderror, softerrors := getAllPids()
+	if harderror != nil {
+		return nil, harderror, softerrors
+	}
+
+	states = make(map[int]processState, len(pids))
+	for _, pid := range pids {
+		// This function is implemented by the OS-specific readProcessState function.
+		state, err := readProcessState(pid)
+		if err != nil {
+			// The process probably exited.
+			softerrors = append(softerrors, err)
+			continue
+		}
+		states[pid] = state
+	}
+
+	return states, nil, softerrors
+}
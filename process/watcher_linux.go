@@ -0,0 +1,173 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Constants of the netlink process connector, from linux/connector.h and linux/cn_proc.h.
+const (
+	netlinkConnector  = 11
+	cnIdxProc         = 1
+	cnValProc         = 1
+	procCnMcastListen = 1
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	// Sizes of struct cn_msg and of the header of struct proc_event, before its union.
+	cnMsgSize          = 20
+	procEventHeaderLen = 16
+)
+
+// procConnector receives the events of the processes from the netlink process connector, which needs the
+// CAP_NET_ADMIN capability.
+type procConnector struct {
+	// The socket is wrapped in a file, so reading it can be interrupted closing it.
+	socket *os.File
+	buf    []byte
+}
+
+func openProcEventSource() (procEventSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkConnector)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the netlink process connector (%v)", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to bind the netlink process connector (%v)", err)
+	}
+
+	// Subscribe to the events: a netlink message with a cn_msg with the PROC_CN_MCAST_LISTEN operation.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+cnMsgSize+4)
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+	cn := msg[syscall.NLMSG_HDRLEN:]
+	nativeEndian.PutUint32(cn[0:], cnIdxProc)
+	nativeEndian.PutUint32(cn[4:], cnValProc)
+	nativeEndian.PutUint16(cn[16:], 4)
+	nativeEndian.PutUint32(cn[cnMsgSize:], procCnMcastListen)
+
+	err = syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to subscribe to the netlink process connector (%v)", err)
+	}
+
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &procConnector{socket: os.NewFile(uintptr(fd), "netlink"), buf: make([]byte, os.Getpagesize())}, nil
+}
+
+func (c *procConnector) read() (events []Event, err error) {
+	for len(events) == 0 {
+		n, err := c.socket.Read(c.buf)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOBUFS {
+				// The socket buffer overflowed and some events were lost, but the next ones can be read.
+				events = append(events, Event{Kind: Lost, Time: time.Now(), ExitCode: -1})
+				continue
+			}
+			return nil, err
+		}
+
+		// A malformed or truncated datagram doesn't break the socket, so its events are reported as lost and the next
+		// ones are read. One shorter than a message header is parsed without messages nor errors.
+		messages, err := syscall.ParseNetlinkMessage(c.buf[:n])
+		if err != nil || len(messages) == 0 {
+			events = append(events, Event{Kind: Lost, Time: time.Now(), ExitCode: -1})
+			continue
+		}
+
+		for _, msg := range messages {
+			if event, ok := parseProcEvent(msg); ok {
+				events = append(events, event)
+			}
+		}
+	}
+
+	return events, nil
+}
+
+func (c *procConnector) close() error {
+	return c.socket.Close()
+}
+
+// parseProcEvent parses a message of the process connector, returning false if it's not an event of a Watcher. The
+// events of the threads are ignored, and a truncated event is returned as a Lost one.
+func parseProcEvent(msg syscall.NetlinkMessage) (event Event, ok bool) {
+	data := msg.Data
+	if msg.Header.Type != syscall.NLMSG_DONE || len(data) < cnMsgSize ||
+		nativeEndian.Uint32(data[0:]) != cnIdxProc || nativeEndian.Uint32(data[4:]) != cnValProc {
+		return event, false
+	}
+	if len(data) < cnMsgSize+procEventHeaderLen+16 {
+		return Event{Kind: Lost, Time: time.Now(), ExitCode: -1}, true
+	}
+
+	ev := data[cnMsgSize:]
+	union := ev[procEventHeaderLen:]
+	field := func(i int) int {
+		return int(nativeEndian.Uint32(union[4*i:]))
+	}
+
+	// The timestamp of the event is the monotonic time, so we use the time it's received.
+	event = Event{Time: time.Now(), ExitCode: -1}
+	switch nativeEndian.Uint32(ev[0:]) {
+	case procEventFork:
+		// The fields are parent_pid, parent_tgid, child_pid and child_tgid.
+		if field(2) != field(3) {
+			return event, false
+		}
+		event.Kind, event.Pid, event.ParentPid = Started, field(3), field(1)
+	case procEventExec:
+		// The fields are process_pid and process_tgid.
+		event.Kind, event.Pid = Exec, field(1)
+	case procEventExit:
+		// The fields are process_pid, process_tgid, exit_code and exit_signal, and exit_code is a wait status.
+		if field(0) != field(1) {
+			return event, false
+		}
+		event.Kind, event.Pid = Exited, field(1)
+		if status := syscall.WaitStatus(field(2)); status.Exited() {
+			event.ExitCode = status.ExitStatus()
+		}
+	default:
+		return event, false
+	}
+
+	return event, true
+}
+
+func readProcessState(pid int) (state processState, err error) {
+	name, fields, err := readStatFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return state, err
+	}
+
+	if state.parentPid, err = strconv.Atoi(fields[statPpid]); err != nil {
+		return state, err
+	}
+	if state.startTime, err = strconv.ParseUint(fields[statStartTime], 10, 64); err != nil {
+		return state, err
+	}
+
+	// The exe link can't be read without the permissions to access the process, and it's missing for kernel threads,
+	// so the name is used then. It changes on exec too, but not always.
+	state.program, err = os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err != nil {
+		state.program = "(" + name + ")"
+	}
+
+	return state, nil
+}
@@ -0,0 +1,110 @@
+package process
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiffProcessStates(t *testing.T) {
+	previous := map[int]processState{
+		1:  {parentPid: 0, startTime: 1, program: "/sbin/init"},
+		10: {parentPid: 1, startTime: 5, program: "/bin/sh"},
+		20: {parentPid: 1, startTime: 6, program: "/bin/sleep"},
+		30: {parentPid: 1, startTime: 7, program: "/bin/bash"},
+	}
+	current := map[int]processState{
+		1: {parentPid: 0, startTime: 1, program: "/sbin/init"},
+		// It executed a new program.
+		10: {parentPid: 1, startTime: 5, program: "/usr/bin/python3"},
+		// Its pid was recycled.
+		30: {parentPid: 10, startTime: 9, program: "/bin/bash"},
+		40: {parentPid: 10, startTime: 9, program: "/bin/ls"},
+	}
+
+	now := time.Now()
+	events := diffProcessStates(previous, current, now)
+
+	expected := []Event{
+		{Kind: Exited, Pid: 20, Time: now, ExitCode: -1},
+		{Kind: Exited, Pid: 30, Time: now, ExitCode: -1},
+		{Kind: Exec, Pid: 10, Time: now, ExitCode: -1},
+		{Kind: Started, Pid: 30, ParentPid: 10, Time: now, ExitCode: -1},
+		{Kind: Started, Pid: 40, ParentPid: 10, Time: now, ExitCode: -1},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v and got %v", expected, events)
+	}
+	for i := range events {
+		if events[i] != expected[i] {
+			t.Errorf("Expected %+v and got %+v", expected[i], events[i])
+		}
+	}
+}
+
+// fakeEventSource returns its batches of events, and then blocks until it's closed.
+type fakeEventSource struct {
+	batches [][]Event
+	reads   chan int
+	closed  chan struct{}
+}
+
+func (s *fakeEventSource) read() ([]Event, error) {
+	if len(s.batches) > 0 {
+		events := s.batches[0]
+		s.batches = s.batches[1:]
+		s.reads <- len(s.batches)
+		return events, nil
+	}
+	<-s.closed
+	return nil, errors.New("Closed")
+}
+
+func (s *fakeEventSource) close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestWatchSourceDrainsSource(t *testing.T) {
+	now := time.Now()
+	expected := []Event{
+		{Kind: Started, Pid: 10, ParentPid: 1, Time: now, ExitCode: -1},
+		{Kind: Lost, Time: now, ExitCode: -1},
+		{Kind: Exited, Pid: 10, Time: now, ExitCode: 0},
+	}
+	source := &fakeEventSource{
+		batches: [][]Event{expected[:1], expected[1:2], expected[2:]},
+		reads:   make(chan int, 3),
+		closed:  make(chan struct{}),
+	}
+
+	events := make(chan Event)
+	w := &Watcher{Events: events, events: events, opts: WatcherOptions{NoInfo: true}, source: source,
+		done: make(chan struct{})}
+	go w.watchSource()
+
+	// The source is read even if no one receives the events.
+	for left := len(expected); left > 0; {
+		select {
+		case left = <-source.reads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The source wasn't read while the events weren't received")
+		}
+	}
+
+	for i, event := range expected {
+		if got := <-w.Events; got != event {
+			t.Errorf("Expected event %d to be %+v and got %+v", i, event, got)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w.Events; ok {
+		t.Error("The Events channel wasn't closed")
+	}
+	if err := w.Err(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,255 @@
+// This package runs a job over many processes of the host at the same time.
+//
+// It takes care of listing and opening the processes, filtering them, running the job on each one with a bounded
+// concurrency and an optional timeout, and collecting the results and errors of each process by its pid.
+package scan
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/polyverse/masche/listlibs"
+	"github.com/polyverse/masche/memaccess"
+	"github.com/polyverse/masche/memrules"
+	"github.com/polyverse/masche/memsearch"
+	"github.com/polyverse/masche/process"
+)
+
+// Job is run by Run for each process, already open. It must stop when ctx is done, which happens when the timeout of
+// the process is reached or the whole scan is canceled. The value returned is stored in Result.Value.
+type Job func(ctx context.Context, p process.Process) (value interface{}, harderror error, softerrors []error)
+
+// Options configures Run.
+type Options struct {
+	// Filter selects the processes to scan, before opening them unless it needs them open. If it's nil all of them
+	// are scanned.
+	Filter process.Filter
+	// Concurrency is the amount of processes scanned at the same time. If it's 0, runtime.NumCPU() is used.
+	Concurrency int
+	// Timeout limits the time the job can run on each process. If it's 0 there is no limit.
+	Timeout time.Duration
+	// IncludeSelf makes the process running the scan be scanned too. It's excluded by default, as searching its own
+	// memory would find the buffers used by the search.
+	IncludeSelf bool
+}
+
+// Result is the outcome of running a job on a process.
+type Result struct {
+	Pid  int
+	Name string
+	// Value is the value returned by the job, nil if it couldn't be run.
+	Value interface{}
+	// HardError is the hard error returned by the job, or the error opening the process, in which case the job
+	// wasn't run.
+	HardError  error
+	SoftErrors []error
+	// TimedOut is true if the job was stopped because Options.Timeout was reached.
+	TimedOut bool
+	Duration time.Duration
+}
+
+// Run runs job on all the running processes accepted by opts.Filter, returning a Result for each one of them sorted by
+// pid.
+//
+// If ctx is done before all the processes were scanned, no more jobs are started, the running ones are canceled, and
+// the error of ctx is returned as hard error along with the results of the processes scanned until then.
+func Run(ctx context.Context, opts Options, job Job) (results []Result, harderror error, softerrors []error) {
+	filter := opts.Filter
+	if filter == nil {
+		filter = process.All()
+	}
+	if !opts.IncludeSelf {
+		filter = process.And(process.Not(process.Pids(os.Getpid())), filter)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	var mtx sync.Mutex
+	results = make([]Result, 0)
+
+	// The processes accepted are opened by the filter, so the ones that can't be opened get a Result with the error.
+	filter = process.And(filter, func(c *process.Candidate) (bool, error) {
+		if _, err := c.Process(); err != nil {
+			name, _, _ := process.GetProcess(c.Pid).Name()
+
+			mtx.Lock()
+			results = append(results, Result{Pid: c.Pid, Name: name, HardError: err})
+			mtx.Unlock()
+			return false, nil
+		}
+		return true, nil
+	})
+
+	processesToScan := make(chan process.Process)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range processesToScan {
+				result := runJob(ctx, opts.Timeout, p, job)
+
+				mtx.Lock()
+				results = append(results, result)
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	// The processes are opened as they are selected, and each worker closes the ones it scans.
+	var canceled error
+	harderror, softerrors = process.SelectFuncContext(ctx, filter, func(p process.Process) (keepSelecting bool) {
+		select {
+		case processesToScan <- p:
+			return true
+		case <-ctx.Done():
+			canceled = ctx.Err()
+			p.Close()
+			return false
+		}
+	})
+	close(processesToScan)
+	wg.Wait()
+
+	if harderror == nil {
+		harderror = canceled
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Pid < results[j].Pid
+	})
+	return results, harderror, softerrors
+}
+
+// runJob runs job on the process p, closing it afterwards.
+func runJob(ctx context.Context, timeout time.Duration, p process.Process, job Job) (result Result) {
+	result.Pid = p.Pid()
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	defer func() {
+		err, softerrors := p.Close()
+		result.SoftErrors = append(result.SoftErrors, softerrors...)
+		if err != nil {
+			result.SoftErrors = append(result.SoftErrors, err)
+		}
+	}()
+
+	name, err, softerrors := p.Name()
+	result.SoftErrors = append(result.SoftErrors, softerrors...)
+	if err != nil {
+		result.SoftErrors = append(result.SoftErrors, err)
+	}
+	result.Name = name
+
+	jobCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result.Value, result.HardError, softerrors = job(jobCtx, p)
+	result.SoftErrors = append(result.SoftErrors, softerrors...)
+	result.TimedOut = jobCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	return
+}
+
+// HardErrors returns the hard errors of the results, by pid.
+func HardErrors(results []Result) map[int]error {
+	errors := make(map[int]error)
+	for _, result := range results {
+		if result.HardError != nil {
+			errors[result.Pid] = result.HardError
+		}
+	}
+	return errors
+}
+
+// SoftErrors returns the soft errors of the results, by pid.
+func SoftErrors(results []Result) map[int][]error {
+	errors := make(map[int][]error)
+	for _, result := range results {
+		if len(result.SoftErrors) > 0 {
+			errors[result.Pid] = result.SoftErrors
+		}
+	}
+	return errors
+}
+
+// MatcherJob returns a Job that searches the memory of the process for the patterns of m. Its value is the
+// []memsearch.PatternMatch found.
+func MatcherJob(m *memsearch.Matcher) Job {
+	return func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		return memsearch.FindAllPatternsContext(ctx, p, 0, m)
+	}
+}
+
+// RulesJob returns a Job that evaluates the rules of rs against the memory of the process. Its value is the
+// []memrules.RuleMatch found.
+func RulesJob(rs *memrules.Ruleset) Job {
+	return func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		return memrules.ScanContext(ctx, p, rs)
+	}
+}
+
+// LibrariesJob returns a Job that lists the libraries loaded by the process whose path matches r, or all of them if r
+// is nil. Its value is the []string with their paths.
+func LibrariesJob(r *regexp.Regexp) Job {
+	return func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err, nil
+		}
+
+		var libraries []string
+		var harderror error
+		var softerrors []error
+		if r == nil {
+			libraries, harderror, softerrors = listlibs.ListLoadedLibraries(p)
+		} else {
+			libraries, harderror, softerrors = listlibs.GetMatchingLoadedLibraries(p, r)
+		}
+		if harderror == nil {
+			harderror = ctx.Err()
+		}
+		return libraries, harderror, softerrors
+	}
+}
+
+// RegionAuditJob returns a Job that lists the memory regions of the process with at least the given access, for
+// example memaccess.Writable|memaccess.Executable. Its value is the []memaccess.MemoryRegion found.
+func RegionAuditJob(access memaccess.Access) Job {
+	return func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err, nil
+		}
+
+		m, harderror, softerrors := memaccess.ReadMemoryMap(p)
+		if harderror != nil {
+			return nil, harderror, softerrors
+		}
+
+		regions := make([]memaccess.MemoryRegion, 0)
+		for _, region := range m.Regions {
+			if err := ctx.Err(); err != nil {
+				return regions, err, softerrors
+			}
+
+			if region.Access&access == access {
+				regions = append(regions, region)
+			}
+		}
+		return regions, nil, softerrors
+	}
+}
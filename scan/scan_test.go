@@ -0,0 +1,181 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/polyverse/masche/common"
+	"github.com/polyverse/masche/memaccess"
+	"github.com/polyverse/masche/memsearch"
+	"github.com/polyverse/masche/process"
+	"github.com/polyverse/masche/test"
+)
+
+func TestRun(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	matcher, err := memsearch.NewMatcher(memsearch.StringPattern("regexp", "Un dia vi una vaca"),
+		memsearch.LiteralPattern("data", []byte{0xc, 0xa, 0xf, 0xe}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := map[string]Job{
+		"matcher":   MatcherJob(matcher),
+		"libraries": LibrariesJob(regexp.MustCompile("libc")),
+		"regions":   RegionAuditJob(memaccess.Readable | memaccess.Writable),
+	}
+
+	for name, job := range jobs {
+		results, err, softerrors := Run(context.Background(), Options{Filter: process.Pids(pid)}, job)
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 1 || results[0].Pid != pid {
+			t.Fatalf("%s: expected a result for pid %d, got %+v", name, pid, results)
+		}
+
+		result := results[0]
+		test.PrintSoftErrors(result.SoftErrors)
+		if result.HardError != nil {
+			t.Fatalf("%s: %v", name, result.HardError)
+		}
+
+		empty := false
+		switch value := result.Value.(type) {
+		case []memsearch.PatternMatch:
+			empty = len(value) < 2
+		case []string:
+			empty = len(value) == 0
+		case []memaccess.MemoryRegion:
+			empty = len(value) == 0
+		default:
+			t.Fatalf("%s: unexpected value %v", name, value)
+		}
+		if empty {
+			t.Errorf("%s: found nothing in the test process", name)
+		}
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	pid := int(cmd.Process.Pid)
+	name, err, _ := process.GetProcess(pid).Name()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitJob := func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		<-ctx.Done()
+		return nil, ctx.Err(), nil
+	}
+
+	opts := Options{Filter: process.NameMatches(regexp.MustCompile(regexp.QuoteMeta(name))),
+		Timeout: 10 * time.Millisecond}
+	results, err, softerrors := Run(context.Background(), opts, waitJob)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, result := range results {
+		if result.Pid == pid {
+			found = true
+			if !result.TimedOut || HardErrors(results)[pid] != context.DeadlineExceeded {
+				t.Errorf("Expected the job to time out, got %+v", result)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Process %d (%s) not scanned", pid, name)
+	}
+
+	self := os.Getpid()
+	for _, includeSelf := range []bool{false, true} {
+		opts := Options{Filter: process.Pids(self), IncludeSelf: includeSelf}
+		results, err, softerrors := Run(context.Background(), opts, RegionAuditJob(memaccess.Readable))
+		test.PrintSoftErrors(softerrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if includeSelf != (len(results) == 1) {
+			t.Errorf("Scanned %d processes with IncludeSelf %v", len(results), includeSelf)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err, _ = Run(ctx, Options{}, waitJob)
+	if err != context.Canceled {
+		t.Errorf("Run with a canceled context returned %v", err)
+	}
+}
+
+func TestJobsStopWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := process.GetProcess(os.Getpid())
+	for name, job := range map[string]Job{
+		"libraries": LibrariesJob(nil),
+		"regions":   RegionAuditJob(memaccess.Readable),
+	} {
+		if _, err, _ := job(ctx, p); err != context.Canceled {
+			t.Errorf("%s: expected context.Canceled and got %v", name, err)
+		}
+	}
+}
+
+func TestProcessesThatCantBeOpened(t *testing.T) {
+	cmd, err := test.LaunchTestCaseAndWaitForInitialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	// The process exits once it's selected, so it can't be opened.
+	pid := cmd.Process.Pid
+	exit := func(c *process.Candidate) (bool, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return true, nil
+	}
+
+	ran := false
+	job := func(ctx context.Context, p process.Process) (interface{}, error, []error) {
+		ran = true
+		return nil, nil, nil
+	}
+
+	results, err, softerrors := Run(context.Background(), Options{Filter: process.And(process.Pids(pid), exit)}, job)
+	test.PrintSoftErrors(softerrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Pid != pid || ran {
+		t.Fatalf("Expected a result for pid %d without running the job, got %+v", pid, results)
+	}
+	if err := HardErrors(results)[pid]; !errors.Is(err, common.ErrProcessExited) {
+		t.Errorf("Expected the process to be gone and got %v", err)
+	}
+}